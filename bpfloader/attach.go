@@ -0,0 +1,84 @@
+package bpfloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// lsmListPath lists the active LSMs in the order they are called.
+const lsmListPath = "/sys/kernel/security/lsm"
+
+// Attach methods reported in HookStatus.Method
+const (
+	MethodLSM    = "lsm"
+	MethodFentry = "fentry"
+	MethodFexit  = "fexit"
+)
+
+var errBPFLSMDisabled = errors.New("BPF LSM not enabled (add bpf to the lsm= boot parameter)")
+
+// HookStatus describes how a single kernel hook was attached.
+type HookStatus struct {
+	Hook   string    // Hook is the LSM hook or kernel function, e.g. inode_create.
+	Method string    // Method is MethodLSM, MethodFentry or MethodFexit, empty if not attached.
+	Link   link.Link // Link is the attached link, nil if not attached.
+	Err    error     // Err is why the hook is not attached.
+
+	prog   *ebpf.Program // attached program, to verify and re-attach the link
+	target uint32        // BTF ID of the attach target at attach time
+}
+
+// AttachReport is the per-hook result of AttachPrograms.
+type AttachReport struct {
+	BPFLSM   bool  // BPFLSM is true if bpf is in the active LSM list.
+	ProbeErr error // ProbeErr is set if the active LSM list could not be read.
+	Hooks    []HookStatus
+}
+
+// BPFLSMEnabled reports whether bpf is in the active LSM list.
+//
+// It reads /sys/kernel/security/lsm, which requires securityfs to be mounted.
+func BPFLSMEnabled() (bool, error) {
+
+	data, err := os.ReadFile(lsmListPath)
+	if err != nil {
+		return false, err
+	}
+
+	for _, lsm := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		if lsm == "bpf" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// String formats the report one hook per line.
+func (r AttachReport) String() string {
+
+	var b strings.Builder
+
+	switch {
+	case r.ProbeErr != nil:
+		fmt.Fprintf(&b, "BPF LSM: unknown (%v)\n", r.ProbeErr)
+	case r.BPFLSM:
+		b.WriteString("BPF LSM: enabled\n")
+	default:
+		b.WriteString("BPF LSM: disabled, using fentry/fexit fallbacks\n")
+	}
+
+	for _, h := range r.Hooks {
+		if h.Err != nil {
+			fmt.Fprintf(&b, "  %-14s not attached: %v\n", h.Hook, h.Err)
+			continue
+		}
+		fmt.Fprintf(&b, "  %-14s %s\n", h.Hook, h.Method)
+	}
+
+	return b.String()
+}
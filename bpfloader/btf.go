@@ -0,0 +1,141 @@
+package bpfloader
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// builtinBTF is where kernels built with CONFIG_DEBUG_INFO_BTF expose their types.
+const builtinBTF = "/sys/kernel/btf/vmlinux"
+
+// CollectionOptions returns the options to load the eBPF objects with and
+// a description of the BTF source used for CO-RE relocations.
+//
+// btfPath may be empty, a BTF file, or a directory of BTFHub-style files
+// (<distro>/<version>/<arch>/<release>.btf) which is searched for the
+// running kernel release. Compressed BTFHub archives must be extracted first.
+//
+// With an empty btfPath the kernel's built-in BTF is used, and nil options are
+// returned.
+func CollectionOptions(btfPath string) (*ebpf.CollectionOptions, string, error) {
+
+	if btfPath == "" {
+		if _, err := os.Stat(builtinBTF); err != nil {
+			return nil, "", fmt.Errorf("kernel has no built-in BTF (%w), use --btf", err)
+		}
+		return nil, builtinBTF + " (built-in)", nil
+	}
+
+	info, err := os.Stat(btfPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	file := btfPath
+	if info.IsDir() {
+		file, err = findBTF(btfPath)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	spec, err := btf.LoadSpec(file)
+	if err != nil {
+		return nil, "", fmt.Errorf("loading BTF from %s: %w", file, err)
+	}
+
+	opts := &ebpf.CollectionOptions{
+		Programs: ebpf.ProgramOptions{
+			KernelTypes: spec,
+		},
+	}
+	return opts, file, nil
+}
+
+// findBTF searches dir recursively for <kernel release>.btf
+func findBTF(dir string) (string, error) {
+
+	release, err := kernelRelease()
+	if err != nil {
+		return "", err
+	}
+	want := release + ".btf"
+
+	var found string
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() == want {
+			found = path
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", errors.New("no " + want + " found in " + dir)
+	}
+	return found, nil
+}
+
+// kernelRelease returns the running kernel release as printed by uname -r
+func kernelRelease() (string, error) {
+
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return "", err
+	}
+
+	release := make([]byte, 0, len(uts.Release))
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	return string(release), nil
+}
+
+// vfsHasIdmap reports whether the vfs_* function fn takes an idmap, before
+// 6.3 a mnt_userns, ahead of the directory, as it does since 5.12. It reads
+// the BTF the objects were loaded with.
+func (b *BPF) vfsHasIdmap(fn string) (bool, error) {
+
+	var spec *btf.Spec
+	if b.opts != nil {
+		spec = b.opts.Programs.KernelTypes
+	}
+	if spec == nil {
+		var err error
+		if spec, err = btf.LoadKernelSpec(); err != nil {
+			return false, fmt.Errorf("loading kernel BTF: %w", err)
+		}
+	}
+
+	var f *btf.Func
+	if err := spec.TypeByName(fn, &f); err != nil {
+		return false, fmt.Errorf("%s in kernel BTF: %w", fn, err)
+	}
+	proto, ok := f.Type.(*btf.FuncProto)
+	if !ok || len(proto.Params) == 0 {
+		return false, fmt.Errorf("%s in kernel BTF has no arguments", fn)
+	}
+
+	// the old prototypes start with struct inode *dir
+	if ptr, ok := btf.UnderlyingType(proto.Params[0].Type).(*btf.Pointer); ok {
+		if s, ok := btf.UnderlyingType(ptr.Target).(*btf.Struct); ok && s.Name == "inode" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
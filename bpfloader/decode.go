@@ -0,0 +1,193 @@
+package bpfloader
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Wire format of the events (src/mtypes.h):
+//
+//	header  : u32 magic, u16 version, u16 type, u32 length, u32 info
+//	section : u16 type, u16 reserved, u32 length, payload padded to 8 bytes
+//	...
+//
+// header.length covers the header and all sections, the last section may
+// end unpadded. Unknown section types are skipped, so sections can be added
+// without a new version. Any other change needs a new WireVersion and an
+// explicit decoder below.
+const (
+	WireMagic   = 0x57415443
+	WireVersion = 1
+)
+
+// WireTrackOnly is set in header.type for a CREATE, DELETE or UNLINK the
+// event mask of the file leaves out (TRACK_ONLY in src/mtypes.h), see
+// FileChangeEvent.TrackOnly.
+const WireTrackOnly = 0x100
+
+// Section types
+const (
+	SectionFile      = 0x1
+	SectionProcess   = 0x2
+	SectionName      = 0x3
+	SectionXattrName = 0x4
+	SectionCounters  = 0x5
+)
+
+// Sizes and offsets of wire version 1, checked against the bpf2go generated
+// types by TestWireLayout.
+const (
+	wireHeaderSize  = 16
+	sectionHdrSize  = 8
+	fileSectionSize = 56
+	procSectionSize = 16
+	countersSize    = 32
+
+	offHeaderMagic   = 0
+	offHeaderVersion = 4
+	offHeaderType    = 6
+	offHeaderLength  = 8
+	offHeaderInfo    = 12
+
+	offSectionType   = 0
+	offSectionLength = 4
+
+	offFileInodeNumber       = 0
+	offFileDev               = 8
+	offFileParentInodeNumber = 16
+	offFileParentDev         = 24
+	offFileBeforeSize        = 32
+	offFileAfterSize         = 40
+	offFileOldFlags          = 48
+	offFileNewFlags          = 52
+
+	offProcUid      = 0
+	offProcPid      = 4
+	offProcTtyIndex = 8
+	offProcTtyMajor = 12
+
+	offCountersSeq         = 0
+	offCountersEvents      = 8
+	offCountersLost        = 16
+	offCountersRateLimited = 24
+)
+
+var (
+	// ErrUnknownWireVersion is returned for events of a wire version this
+	// watchd has no decoder for, the eBPF objects and watchd are out of sync.
+	ErrUnknownWireVersion = errors.New("unknown event wire version")
+
+	// ErrMalformedEvent is returned for samples that don't follow the wire format.
+	ErrMalformedEvent = errors.New("malformed event")
+)
+
+// DecodeEvent decodes a raw ring buffer sample into event.
+//
+// It neither reflects nor allocates. Unknown versions are rejected with
+// ErrUnknownWireVersion, broken samples with ErrMalformedEvent.
+func DecodeEvent(raw []byte, event *FileChangeEvent) error {
+
+	if len(raw) < wireHeaderSize {
+		return fmt.Errorf("%w: %d bytes, header needs %d", ErrMalformedEvent, len(raw), wireHeaderSize)
+	}
+
+	le := binary.LittleEndian
+
+	if magic := le.Uint32(raw[offHeaderMagic:]); magic != WireMagic {
+		return fmt.Errorf("%w: bad magic %#x", ErrMalformedEvent, magic)
+	}
+
+	switch version := le.Uint16(raw[offHeaderVersion:]); version {
+	case 1:
+		return decodeV1(raw, event)
+	default:
+		return fmt.Errorf("%w: version %d, this watchd decodes version %d", ErrUnknownWireVersion, version, WireVersion)
+	}
+}
+
+// decodeV1 decodes wire version 1
+func decodeV1(raw []byte, event *FileChangeEvent) error {
+
+	le := binary.LittleEndian
+
+	typ := uint32(le.Uint16(raw[offHeaderType:]))
+	length := int(le.Uint32(raw[offHeaderLength:]))
+	info := le.Uint32(raw[offHeaderInfo:])
+
+	if length < wireHeaderSize || length > len(raw) {
+		return fmt.Errorf("%w: length %d of %d byte sample", ErrMalformedEvent, length, len(raw))
+	}
+	raw = raw[:length]
+
+	*event = FileChangeEvent{}
+	event.ChangeType = typ&0xF | info<<4
+	event.TrackOnly = typ&WireTrackOnly != 0
+
+	var haveFile bool
+
+	for off := wireHeaderSize; off < length; {
+
+		if off+sectionHdrSize > length {
+			return fmt.Errorf("%w: truncated section header at %d", ErrMalformedEvent, off)
+		}
+		stype := le.Uint16(raw[off+offSectionType:])
+		slen := int(le.Uint32(raw[off+offSectionLength:]))
+
+		start := off + sectionHdrSize
+		if slen > length-start {
+			return fmt.Errorf("%w: section %d of %d bytes at %d", ErrMalformedEvent, stype, slen, off)
+		}
+		payload := raw[start : start+slen]
+
+		switch stype {
+		case SectionFile:
+			if slen < fileSectionSize {
+				return fmt.Errorf("%w: file section of %d bytes", ErrMalformedEvent, slen)
+			}
+			event.InodeNumber = le.Uint64(payload[offFileInodeNumber:])
+			event.Dev = le.Uint64(payload[offFileDev:])
+			event.ParentInodeNumber = le.Uint64(payload[offFileParentInodeNumber:])
+			event.ParentDev = le.Uint64(payload[offFileParentDev:])
+			event.BeforeSize = int64(le.Uint64(payload[offFileBeforeSize:]))
+			event.AfterSize = int64(le.Uint64(payload[offFileAfterSize:]))
+			event.OldFlags = le.Uint32(payload[offFileOldFlags:])
+			event.NewFlags = le.Uint32(payload[offFileNewFlags:])
+			haveFile = true
+
+		case SectionProcess:
+			if slen < procSectionSize {
+				return fmt.Errorf("%w: process section of %d bytes", ErrMalformedEvent, slen)
+			}
+			event.Uid = le.Uint32(payload[offProcUid:])
+			event.Pid = le.Uint32(payload[offProcPid:])
+			event.TtyIndex = le.Uint32(payload[offProcTtyIndex:])
+			event.TtyMajor = int32(le.Uint32(payload[offProcTtyMajor:]))
+
+		case SectionName:
+			copy(event.Filename[:], payload)
+
+		case SectionXattrName:
+			copy(event.XattrName[:], payload)
+
+		case SectionCounters:
+			if slen < countersSize {
+				return fmt.Errorf("%w: counters section of %d bytes", ErrMalformedEvent, slen)
+			}
+			event.Counters.Seq = le.Uint64(payload[offCountersSeq:])
+			event.Counters.Events = le.Uint64(payload[offCountersEvents:])
+			event.Counters.Lost = le.Uint64(payload[offCountersLost:])
+			event.Counters.RateLimited = le.Uint64(payload[offCountersRateLimited:])
+		}
+
+		// sections are padded to 8 bytes
+		off = start + (slen+7)&^7
+	}
+
+	// a HEARTBEAT is about no file
+	if !haveFile && typ&0xF != ChangeHeartbeat {
+		return fmt.Errorf("%w: no file section", ErrMalformedEvent)
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package bpfloader
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"unsafe"
+)
+
+// TestWireLayout checks the sizes and offsets the decoder uses against the
+// structs bpf2go generated from the BTF of the eBPF object.
+func TestWireLayout(t *testing.T) {
+
+	var h fimWIRE_HEADER
+	var s fimSECTION
+	var f fimFILE_SECTION
+	var p fimPROCESS_SECTION
+	var c fimCOUNTERS_SECTION
+
+	layout := []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"sizeof(WIRE_HEADER)", unsafe.Sizeof(h), wireHeaderSize},
+		{"WIRE_HEADER.magic", unsafe.Offsetof(h.Magic), offHeaderMagic},
+		{"WIRE_HEADER.version", unsafe.Offsetof(h.Version), offHeaderVersion},
+		{"WIRE_HEADER.type", unsafe.Offsetof(h.Type), offHeaderType},
+		{"WIRE_HEADER.length", unsafe.Offsetof(h.Length), offHeaderLength},
+		{"WIRE_HEADER.info", unsafe.Offsetof(h.Info), offHeaderInfo},
+
+		{"sizeof(SECTION)", unsafe.Sizeof(s), sectionHdrSize},
+		{"SECTION.type", unsafe.Offsetof(s.Type), offSectionType},
+		{"SECTION.length", unsafe.Offsetof(s.Length), offSectionLength},
+
+		{"sizeof(FILE_SECTION)", unsafe.Sizeof(f), fileSectionSize},
+		{"FILE_SECTION.inode_number", unsafe.Offsetof(f.InodeNumber), offFileInodeNumber},
+		{"FILE_SECTION.dev", unsafe.Offsetof(f.Dev), offFileDev},
+		{"FILE_SECTION.parent_inode_number", unsafe.Offsetof(f.ParentInodeNumber), offFileParentInodeNumber},
+		{"FILE_SECTION.parent_dev", unsafe.Offsetof(f.ParentDev), offFileParentDev},
+		{"FILE_SECTION.before_size", unsafe.Offsetof(f.BeforeSize), offFileBeforeSize},
+		{"FILE_SECTION.after_size", unsafe.Offsetof(f.AfterSize), offFileAfterSize},
+		{"FILE_SECTION.old_flags", unsafe.Offsetof(f.OldFlags), offFileOldFlags},
+		{"FILE_SECTION.new_flags", unsafe.Offsetof(f.NewFlags), offFileNewFlags},
+
+		{"sizeof(PROCESS_SECTION)", unsafe.Sizeof(p), procSectionSize},
+		{"PROCESS_SECTION.uid", unsafe.Offsetof(p.Uid), offProcUid},
+		{"PROCESS_SECTION.pid", unsafe.Offsetof(p.Pid), offProcPid},
+		{"PROCESS_SECTION.tty_index", unsafe.Offsetof(p.TtyIndex), offProcTtyIndex},
+		{"PROCESS_SECTION.tty_major", unsafe.Offsetof(p.TtyMajor), offProcTtyMajor},
+
+		{"sizeof(COUNTERS_SECTION)", unsafe.Sizeof(c), countersSize},
+		{"COUNTERS_SECTION.seq", unsafe.Offsetof(c.Seq), offCountersSeq},
+		{"COUNTERS_SECTION.events", unsafe.Offsetof(c.Events), offCountersEvents},
+		{"COUNTERS_SECTION.lost", unsafe.Offsetof(c.Lost), offCountersLost},
+		{"COUNTERS_SECTION.rate_limited", unsafe.Offsetof(c.RateLimited), offCountersRateLimited},
+	}
+	for _, l := range layout {
+		if l.got != l.want {
+			t.Errorf("%s is %d in the eBPF object, decoder expects %d", l.name, l.got, l.want)
+		}
+	}
+}
+
+func testEvent() FileChangeEvent {
+
+	event := FileChangeEvent{
+		ParentInodeNumber: 2,
+		ParentDev:         8<<20 | 1,
+		InodeNumber:       131,
+		Dev:               8<<20 | 1,
+		Uid:               1000,
+		ChangeType:        2 | (17 << 4),
+		TtyIndex:          3,
+		TtyMajor:          -1,
+		BeforeSize:        100,
+		AfterSize:         117,
+		OldFlags:          1 << 3,
+		NewFlags:          0x10,
+		Pid:               4242,
+	}
+	copy(event.Filename[:], "passwd")
+
+	return event
+}
+
+func TestDecodeEvent(t *testing.T) {
+
+	want := testEvent()
+	raw := EncodeEvent(&want)
+
+	var got FileChangeEvent
+	if err := DecodeEvent(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// xattr section in the middle
+	copy(want.XattrName[:], "security.ima")
+	if err := DecodeEvent(EncodeEvent(&want), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// a DELETE the mask leaves out
+	want = testEvent()
+	want.ChangeType, want.TrackOnly = 3, true
+	if err := DecodeEvent(EncodeEvent(&want), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// heartbeat counters
+	want = FileChangeEvent{ChangeType: 8, Counters: Counters{Seq: 7, Events: 1200, Lost: 3, RateLimited: 40}}
+	if err := DecodeEvent(EncodeEvent(&want), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if n := testing.AllocsPerRun(100, func() { DecodeEvent(raw, &got) }); n != 0 {
+		t.Errorf("DecodeEvent allocates %v times per event", n)
+	}
+}
+
+func TestDecodeEventRejects(t *testing.T) {
+
+	event := testEvent()
+	var got FileChangeEvent
+
+	raw := EncodeEvent(&event)
+	binary.LittleEndian.PutUint16(raw[offHeaderVersion:], WireVersion+1)
+	if err := DecodeEvent(raw, &got); !errors.Is(err, ErrUnknownWireVersion) {
+		t.Errorf("unknown version: got %v", err)
+	}
+
+	raw = EncodeEvent(&event)
+	binary.LittleEndian.PutUint32(raw[offHeaderMagic:], 0)
+	if err := DecodeEvent(raw, &got); !errors.Is(err, ErrMalformedEvent) {
+		t.Errorf("bad magic: got %v", err)
+	}
+
+	raw = EncodeEvent(&event)
+	if err := DecodeEvent(raw[:len(raw)-1], &got); !errors.Is(err, ErrMalformedEvent) {
+		t.Errorf("truncated: got %v", err)
+	}
+
+	if err := DecodeEvent(raw[:wireHeaderSize-1], &got); !errors.Is(err, ErrMalformedEvent) {
+		t.Errorf("short header: got %v", err)
+	}
+
+	// only a HEARTBEAT goes without a file section
+	raw = EncodeEvent(&FileChangeEvent{ChangeType: ChangeHeartbeat, Counters: Counters{Seq: 1}})
+	binary.LittleEndian.PutUint16(raw[offHeaderType:], 0x2)
+	if err := DecodeEvent(raw, &got); !errors.Is(err, ErrMalformedEvent) {
+		t.Errorf("no file section: got %v", err)
+	}
+}
+
+func TestDecodeEventSkipsUnknownSections(t *testing.T) {
+
+	want := testEvent()
+	raw := EncodeEvent(&want)
+
+	// retag the process section as an unknown type
+	off := wireHeaderSize + sectionHdrSize + fileSectionSize
+	binary.LittleEndian.PutUint16(raw[off+offSectionType:], 0x7f)
+
+	var got FileChangeEvent
+	if err := DecodeEvent(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Uid != 0 || got.InodeNumber != want.InodeNumber || got.Filename != want.Filename {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func BenchmarkDecodeEvent(b *testing.B) {
+
+	event := testEvent()
+	raw := EncodeEvent(&event)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := DecodeEvent(raw, &event); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+}
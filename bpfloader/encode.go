@@ -0,0 +1,100 @@
+package bpfloader
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// EncodeEvent encodes event in the current wire format, as the eBPF
+// programs would have sent it. It is the inverse of DecodeEvent and is
+// used to record events of other sources and in tests.
+func EncodeEvent(event *FileChangeEvent) []byte {
+
+	name := cstring(event.Filename[:])
+	xattr := cstring(event.XattrName[:])
+
+	// a HEARTBEAT carries the counters only, like the heartbeat program sends it
+	heartbeat := event.ChangeType&0xF == ChangeHeartbeat
+
+	size := wireHeaderSize
+	if !heartbeat {
+		size += sectionHdrSize + fileSectionSize +
+			sectionHdrSize + procSectionSize +
+			sectionHdrSize + len(name)
+	}
+	if len(xattr) > 0 {
+		size += sectionHdrSize + (len(xattr)+7)&^7
+	}
+	if event.Counters != (Counters{}) {
+		size += sectionHdrSize + countersSize
+	}
+
+	le := binary.LittleEndian
+	buf := make([]byte, size)
+
+	le.PutUint32(buf[offHeaderMagic:], WireMagic)
+	le.PutUint16(buf[offHeaderVersion:], WireVersion)
+	typ := uint16(event.ChangeType & 0xF)
+	if event.TrackOnly {
+		typ |= WireTrackOnly
+	}
+	le.PutUint16(buf[offHeaderType:], typ)
+	le.PutUint32(buf[offHeaderLength:], uint32(size))
+	le.PutUint32(buf[offHeaderInfo:], event.ChangeType>>4)
+
+	off := wireHeaderSize
+	section := func(stype uint16, length int) []byte {
+		le.PutUint16(buf[off+offSectionType:], stype)
+		le.PutUint32(buf[off+offSectionLength:], uint32(length))
+		payload := buf[off+sectionHdrSize : off+sectionHdrSize+length]
+		off += sectionHdrSize + (length+7)&^7
+		return payload
+	}
+
+	if !heartbeat {
+		file := section(SectionFile, fileSectionSize)
+		le.PutUint64(file[offFileInodeNumber:], event.InodeNumber)
+		le.PutUint64(file[offFileDev:], event.Dev)
+		le.PutUint64(file[offFileParentInodeNumber:], event.ParentInodeNumber)
+		le.PutUint64(file[offFileParentDev:], event.ParentDev)
+		le.PutUint64(file[offFileBeforeSize:], uint64(event.BeforeSize))
+		le.PutUint64(file[offFileAfterSize:], uint64(event.AfterSize))
+		le.PutUint32(file[offFileOldFlags:], event.OldFlags)
+		le.PutUint32(file[offFileNewFlags:], event.NewFlags)
+
+		proc := section(SectionProcess, procSectionSize)
+		le.PutUint32(proc[offProcUid:], event.Uid)
+		le.PutUint32(proc[offProcPid:], event.Pid)
+		le.PutUint32(proc[offProcTtyIndex:], event.TtyIndex)
+		le.PutUint32(proc[offProcTtyMajor:], uint32(event.TtyMajor))
+	}
+
+	if len(xattr) > 0 {
+		copy(section(SectionXattrName, len(xattr)), xattr)
+	}
+
+	if event.Counters != (Counters{}) {
+		counters := section(SectionCounters, countersSize)
+		le.PutUint64(counters[offCountersSeq:], event.Counters.Seq)
+		le.PutUint64(counters[offCountersEvents:], event.Counters.Events)
+		le.PutUint64(counters[offCountersLost:], event.Counters.Lost)
+		le.PutUint64(counters[offCountersRateLimited:], event.Counters.RateLimited)
+	}
+
+	// name goes last, unpadded like the kernel sends it
+	if !heartbeat {
+		le.PutUint16(buf[off+offSectionType:], SectionName)
+		le.PutUint32(buf[off+offSectionLength:], uint32(len(name)))
+		copy(buf[off+sectionHdrSize:], name)
+	}
+
+	return buf
+}
+
+// cstring returns b up to the first NUL
+func cstring(b []byte) []byte {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i]
+	}
+	return b
+}
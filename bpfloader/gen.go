@@ -1,3 +1,3 @@
 package bpfloader
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -target amd64 -output-dir . -tags linux fim ../src/fim.bpf.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -target amd64 -output-dir . -tags linux -type WIRE_HEADER -type SECTION -type FILE_SECTION -type PROCESS_SECTION -type COUNTERS_SECTION fim ../src/fim.bpf.c
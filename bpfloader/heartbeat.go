@@ -0,0 +1,38 @@
+package bpfloader
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// ChangeHeartbeat is the change type of HEARTBEAT events (src/mtypes.h),
+// their counters are in FileChangeEvent.Counters.
+const ChangeHeartbeat = 0x8
+
+// LoadHeartbeat loads the heartbeat program. Loading and running syscall
+// programs needs Linux 5.14, on older kernels it fails and watchd runs
+// without heartbeats.
+func (b *BPF) LoadHeartbeat() error {
+
+	if b.Objects.WatchdHeartbeat != nil {
+		return nil
+	}
+	_, err := b.loadProgram("watchd_heartbeat")
+	return err
+}
+
+// Heartbeat runs the heartbeat program, which sends a HEARTBEAT with the
+// counters since the previous one through the priority ring buffer. See
+// LoadHeartbeat.
+func (b *BPF) Heartbeat() error {
+
+	if b.Objects.WatchdHeartbeat == nil {
+		return errors.New("heartbeat program not loaded")
+	}
+	if _, err := b.Objects.WatchdHeartbeat.Run(&ebpf.RunOptions{}); err != nil {
+		return fmt.Errorf("running heartbeat program: %w", err)
+	}
+	return nil
+}
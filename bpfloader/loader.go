@@ -8,6 +8,7 @@ package bpfloader
 import (
 	"errors"
 	"fmt"
+	"reflect"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
@@ -23,7 +24,28 @@ type TrackedFileKey struct {
 
 // TrackedFileValue represents the value stored in the tracked file map.
 type TrackedFileValue struct {
-	FileSize int64 // Val indicates whether the file is being tracked (1 = tracked).
+	FileSize  int64  // Val indicates whether the file is being tracked (1 = tracked).
+	EventMask uint32 // EventMask holds the Event bits of the types reported, 0 reports all.
+	_         [4]byte
+}
+
+// Event bits of TrackedFileValue.EventMask, 1 << change type as in
+// src/mtypes.h. UNLINK is reported with EventDelete.
+const (
+	EventCreate uint32 = 1 << 0x1
+	EventModify uint32 = 1 << 0x2
+	EventDelete uint32 = 1 << 0x3
+	EventFlags  uint32 = 1 << 0x4
+)
+
+// Reports tells whether the entry reports events of changeType, the change
+// type of a FileChangeEvent
+func (v TrackedFileValue) Reports(changeType uint32) bool {
+	typ := changeType & 0xF
+	if typ == 0x7 {
+		typ = 0x3
+	}
+	return v.EventMask == 0 || v.EventMask&(1<<typ) != 0
 }
 
 // TrackedFile represents a single key-value pair in the tracked file map.
@@ -39,8 +61,26 @@ type TrackedFile struct {
 // Files are uniquely identified by inode number and device ID.
 type TrackedFileMap map[TrackedFileKey]TrackedFileValue
 
-// Event represents the go equivalent of event struct od eBPF C program.
-// It should have same memory layout as of it.
+// PolicyMaxEntries is POLICY_MAX_ENTRIES of src/maps.h, the size of the
+// policy table.
+const PolicyMaxEntries = 4000
+
+// PolicyCapacity returns the size of the policy table compiled into the eBPF
+// object, without loading it. It falls back to PolicyMaxEntries.
+func PolicyCapacity() int {
+
+	spec, err := loadFim()
+	if err != nil {
+		return PolicyMaxEntries
+	}
+	if m, ok := spec.Maps["policy_table"]; ok && m.MaxEntries > 0 {
+		return int(m.MaxEntries)
+	}
+	return PolicyMaxEntries
+}
+
+// FileChangeEvent is the decoded form of an event of the eBPF programs,
+// see DecodeEvent for the wire format.
 //
 // It stores all the metadata which seemed to important for the application.
 // It should be further processed to a friendly format
@@ -52,7 +92,7 @@ type FileChangeEvent struct {
 	Dev         uint64
 
 	Uid        uint32
-	ChangeType uint32
+	ChangeType uint32 // [31:4] header info (bytes written, kind) ,[3:0] event type
 
 	TtyIndex uint32
 	TtyMajor int32
@@ -60,7 +100,28 @@ type FileChangeEvent struct {
 	BeforeSize int64
 	AfterSize  int64
 
-	Filename [255]byte
+	OldFlags uint32 // inode->i_flags (S_*) before a FLAGS_CHANGED ioctl, a different bit set than NewFlags
+	NewFlags uint32 // flags requested by a FLAGS_CHANGED ioctl
+
+	Pid uint32 // Pid is the tgid of the process causing the event.
+
+	// TrackOnly is set for a CREATE, DELETE or UNLINK the event mask leaves
+	// out. It keeps what userspace tracks in sync and isn't reported.
+	TrackOnly bool
+
+	Counters Counters // Counters is set for HEARTBEAT events.
+
+	Filename  [255]byte
+	XattrName [255]byte // XattrName is set for events on extended attributes.
+}
+
+// Counters are the kernel side counters a HEARTBEAT carries, each since the
+// previous heartbeat.
+type Counters struct {
+	Seq         uint64 // Seq numbers the heartbeats, starting at 1.
+	Events      uint64 // Events is the number of events sent to the ring buffers.
+	Lost        uint64 // Lost is the number of events the ring buffers had no room for.
+	RateLimited uint64 // RateLimited is the number of events dropped by the rate limits.
 }
 
 // BPF abstracts the generated Go bindings for the compiled eBPF programs
@@ -69,27 +130,192 @@ type FileChangeEvent struct {
 type BPF struct {
 	Objects *fimObjects
 	Load    func(interface{}, *ebpf.CollectionOptions) error
+
+	// Sizes in bytes of the bulk and priority ring buffers, zero keeps the
+	// size compiled into the object. Set them before Load, see
+	// ParseRingBufferSize.
+	EventsSize         uint32
+	PriorityEventsSize uint32
+
+	// spec and opts the objects were loaded with, to load the programs of
+	// optionalPrograms later
+	spec *ebpf.CollectionSpec
+	opts *ebpf.CollectionOptions
+}
+
+// optionalPrograms are left out when loading the objects, they load on
+// their own when needed. A kernel lacking what one of them needs then only
+// loses that program, not watchd.
+var optionalPrograms = map[string]bool{
+	"watchd_heartbeat":         true, // syscall program, Linux 5.14+
+	"watchd_file_ioctl_compat": true, // LSM hook of Linux 6.8+
+
+	// tracing fallbacks, see fallbackPrograms
+	"vfs_create_exit_hook":          true,
+	"vfs_mkdir_exit_hook":           true,
+	"vfs_unlink_entry_hook":         true,
+	"vfs_rmdir_entry_hook":          true,
+	"vfs_create_exit_hook_noidmap":  true,
+	"vfs_mkdir_exit_hook_noidmap":   true,
+	"vfs_unlink_entry_hook_noidmap": true,
+	"vfs_rmdir_entry_hook_noidmap":  true,
+}
+
+// fallbackPrograms are the tracing programs standing in for the LSM hooks,
+// by the vfs_* function they trace. Each has a _noidmap variant for the
+// prototypes before 5.12, which have no idmap argument.
+var fallbackPrograms = map[string]string{
+	"vfs_create": "vfs_create_exit_hook",
+	"vfs_mkdir":  "vfs_mkdir_exit_hook",
+	"vfs_unlink": "vfs_unlink_entry_hook",
+	"vfs_rmdir":  "vfs_rmdir_entry_hook",
+}
+
+// loadFallback loads the variant of the fallback program tracing fn that
+// matches the prototype of fn in the kernel BTF
+func (b *BPF) loadFallback(fn string) (*ebpf.Program, error) {
+
+	name := fallbackPrograms[fn]
+	idmap, err := b.vfsHasIdmap(fn)
+	if err != nil {
+		return nil, err
+	}
+	if !idmap {
+		name += "_noidmap"
+	}
+	return b.loadProgram(name)
 }
 
 // InitBPF initializes and returns a new BPF instance.
 //
-// It prepares the object container and assigns the generated loader
-// function used to load eBPF programs and maps into the kernel
+// It prepares the object container and assigns the loader function used to
+// load eBPF programs and maps into the kernel
 func InitBPF() *BPF {
-	return &BPF{
+	b := &BPF{
 		Objects: &fimObjects{},
-		Load:    loadFimObjects,
 	}
+	b.Load = b.load
+	return b
+}
+
+// load is loadFimObjects with the ring buffers resized to the sizes of b,
+// and without optionalPrograms, whose fields in obj stay nil
+func (b *BPF) load(obj interface{}, opts *ebpf.CollectionOptions) error {
+
+	objs, ok := obj.(*fimObjects)
+	if !ok {
+		return fmt.Errorf("loading eBPF objects into %T", obj)
+	}
+
+	spec, err := loadFim()
+	if err != nil {
+		return err
+	}
+
+	resize := map[string]uint32{
+		"events":          b.EventsSize,
+		"priority_events": b.PriorityEventsSize,
+	}
+	for name, size := range resize {
+		if size == 0 {
+			continue
+		}
+		m, ok := spec.Maps[name]
+		if !ok {
+			return fmt.Errorf("resizing ring buffer: no map %s in the eBPF object", name)
+		}
+		m.MaxEntries = size
+	}
+	b.spec, b.opts = spec, opts
+
+	required := spec.Copy()
+	for name := range optionalPrograms {
+		delete(required.Programs, name)
+	}
+	var collOpts ebpf.CollectionOptions
+	if opts != nil {
+		collOpts = *opts
+	}
+	coll, err := ebpf.NewCollectionWithOptions(required, collOpts)
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+
+	programs := reflect.ValueOf(&objs.fimPrograms).Elem()
+	for i := 0; i < programs.NumField(); i++ {
+		if prog := coll.DetachProgram(programs.Type().Field(i).Tag.Get("ebpf")); prog != nil {
+			programs.Field(i).Set(reflect.ValueOf(prog))
+		}
+	}
+	maps := reflect.ValueOf(&objs.fimMaps).Elem()
+	for i := 0; i < maps.NumField(); i++ {
+		name := maps.Type().Field(i).Tag.Get("ebpf")
+		m := coll.DetachMap(name)
+		if m == nil {
+			return fmt.Errorf("no map %s in the eBPF object", name)
+		}
+		maps.Field(i).Set(reflect.ValueOf(m))
+	}
+	return nil
+}
+
+// loadProgram loads one of optionalPrograms into the program field of
+// b.Objects tagged name, sharing the maps of b.Objects
+func (b *BPF) loadProgram(name string) (*ebpf.Program, error) {
+
+	if b.spec == nil {
+		return nil, errors.New("eBPF objects not loaded")
+	}
+	spec := b.spec.Copy()
+	ps, ok := spec.Programs[name]
+	if !ok {
+		return nil, fmt.Errorf("no program %s in the eBPF object", name)
+	}
+	spec.Programs = map[string]*ebpf.ProgramSpec{name: ps}
+
+	var opts ebpf.CollectionOptions
+	if b.opts != nil {
+		opts = *b.opts
+	}
+	opts.MapReplacements = make(map[string]*ebpf.Map)
+	maps := reflect.ValueOf(&b.Objects.fimMaps).Elem()
+	for i := 0; i < maps.NumField(); i++ {
+		opts.MapReplacements[maps.Type().Field(i).Tag.Get("ebpf")] = maps.Field(i).Interface().(*ebpf.Map)
+	}
+
+	coll, err := ebpf.NewCollectionWithOptions(spec, opts)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %w", name, err)
+	}
+	defer coll.Close()
+	prog := coll.DetachProgram(name)
+
+	// in b.Objects so closing the objects closes it
+	programs := reflect.ValueOf(&b.Objects.fimPrograms).Elem()
+	for i := 0; i < programs.NumField(); i++ {
+		if programs.Type().Field(i).Tag.Get("ebpf") == name {
+			programs.Field(i).Set(reflect.ValueOf(prog))
+		}
+	}
+	return prog, nil
 }
 
 // UpdateLookupTable updates the eBPF policy table based on a file change event.
 //
 // If the event indicates file creation (ChangeType == 1), the corresponding
-// inode and device ID are inserted into the policy table.
+// inode and device ID are inserted into the policy table with mask, the
+// event mask of the directory it was created in.
 //
-// If the event indicates file deletion (ChangeType == 3), the corresponding
-// entry is removed from the policy table.
-func (b *BPF) UpdateLookupTable(event *FileChangeEvent) {
+// Deletions need nothing here, the eBPF hooks remove the entry themselves.
+//
+// It does nothing on a nil BPF, which is the case when events come from a
+// backend that doesn't use eBPF.
+func (b *BPF) UpdateLookupTable(event *FileChangeEvent, mask uint32) {
+
+	if b == nil {
+		return
+	}
 
 	key := TrackedFileKey{
 		InodeNumber: event.InodeNumber,
@@ -97,7 +323,8 @@ func (b *BPF) UpdateLookupTable(event *FileChangeEvent) {
 	}
 
 	value := TrackedFileValue{
-		FileSize: event.AfterSize,
+		FileSize:  event.AfterSize,
+		EventMask: mask,
 	}
 
 	// create
@@ -110,55 +337,125 @@ func (b *BPF) UpdateLookupTable(event *FileChangeEvent) {
 // AttachPrograms attaches all required LSM and tracing eBPF programs
 // to their respective kernel hook points.
 //
-// It returns a slice of successfully attached links. If no programs
-// are successfully attached, an aggregated error describing all
-// attachment failures is returned.
-func (b *BPF) AttachPrograms() ([]link.Link, error) {
-	links := make([]link.Link, 0, 5)
+// If BPF LSM is not enabled, the create and delete hooks fall back to
+// fentry/fexit programs on the matching vfs_* functions. Hooks without a
+// fallback are skipped.
+//
+// It returns a slice of successfully attached links and a per-hook report of
+// what was attached and how. If no programs are successfully attached, an
+// aggregated error describing all attachment failures is returned.
+func (b *BPF) AttachPrograms() ([]link.Link, AttachReport, error) {
+	links := make([]link.Link, 0, 9)
 	var err string
 
-	attachLSM := func(prog *ebpf.Program, name string) {
+	report := AttachReport{}
+	report.BPFLSM, report.ProbeErr = BPFLSMEnabled()
+	// if the LSM list can't be read, try LSM first and fall back on failure
+	tryLSM := report.BPFLSM || report.ProbeErr != nil
 
-		l, linkErr := link.AttachLSM(link.LSMOptions{
-			Program: prog,
-		})
+	record := func(hook string, method string, prog *ebpf.Program, l link.Link, linkErr error) {
+		status := HookStatus{
+			Hook:   hook,
+			Method: method,
+			Link:   l,
+			Err:    linkErr,
+			prog:   prog,
+		}
+		if linkErr == nil {
+			status.target = linkTarget(l)
+		}
+		report.Hooks = append(report.Hooks, status)
 		if linkErr != nil {
-			err += fmt.Sprintf("ERROR attaching %s: %v \n", name, linkErr)
+			err += fmt.Sprintf("ERROR attaching %s hook: %v\n", hook, linkErr)
 			return
 		}
 		links = append(links, l)
 	}
 
-	attachTracing := func(prog *ebpf.Program, name string) {
-		l, linkErr := link.AttachTracing(link.TracingOptions{
+	attachLSM := func(prog *ebpf.Program) (link.Link, error) {
+		return link.AttachLSM(link.LSMOptions{
 			Program: prog,
 		})
+	}
+
+	attachTracing := func(prog *ebpf.Program) (link.Link, error) {
+		return link.AttachTracing(link.TracingOptions{
+			Program: prog,
+		})
+	}
+
+	// lsmHook attaches an LSM program, or the tracing fallback on the
+	// kernel function fallbackFn if BPF LSM is unavailable. The fallback is
+	// only loaded then, fallbackFn may be empty.
+	lsmHook := func(hook string, prog *ebpf.Program, fallbackMethod string, fallbackFn string) {
+		var linkErr error = errBPFLSMDisabled
+		if tryLSM {
+			var l link.Link
+			l, linkErr = attachLSM(prog)
+			if linkErr == nil {
+				record(hook, MethodLSM, prog, l, nil)
+				return
+			}
+		}
+		if fallbackFn == "" {
+			record(hook, "", nil, nil, linkErr)
+			return
+		}
+		fallback, fallbackErr := b.loadFallback(fallbackFn)
+		if fallbackErr != nil {
+			record(hook, "", nil, nil, fmt.Errorf("%v, %s fallback: %w", linkErr, fallbackMethod, fallbackErr))
+			return
+		}
+		l, fallbackErr := attachTracing(fallback)
+		if fallbackErr != nil {
+			record(hook, "", nil, nil, fmt.Errorf("%v, %s fallback: %w", linkErr, fallbackMethod, fallbackErr))
+			return
+		}
+		record(hook, fallbackMethod, fallback, l, nil)
+	}
+
+	tracingHook := func(hook string, method string, prog *ebpf.Program) {
+		l, linkErr := attachTracing(prog)
 		if linkErr != nil {
-			err += fmt.Sprintf("ERROR attaching %s: %v\n", name, linkErr)
+			record(hook, "", nil, nil, linkErr)
 			return
 		}
-		links = append(links, l)
+		record(hook, method, prog, l, nil)
 	}
 
 	// LSM Hooks
 	// create
-	attachLSM(b.Objects.WatchdInodeCreate, "inode_create hook")
-	attachLSM(b.Objects.WatchdInodeMkdir, "inode_mkdir hook")
+	lsmHook("inode_create", b.Objects.WatchdInodeCreate, MethodFexit, "vfs_create")
+	lsmHook("inode_mkdir", b.Objects.WatchdInodeMkdir, MethodFexit, "vfs_mkdir")
 
 	// delete
-	attachLSM(b.Objects.WatchdInodeUnlink, "inode_unlink hook")
-	attachLSM(b.Objects.WatchdInodeRmdir, "inode_rmdir hook")
+	lsmHook("inode_unlink", b.Objects.WatchdInodeUnlink, MethodFentry, "vfs_unlink")
+	lsmHook("inode_rmdir", b.Objects.WatchdInodeRmdir, MethodFentry, "vfs_rmdir")
+
+	// inode flags (chattr)
+	lsmHook("file_ioctl", b.Objects.WatchdFileIoctl, "", "")
+	// 32-bit chattr, before 6.8 it goes through file_ioctl
+	if prog, loadErr := b.loadProgram("watchd_file_ioctl_compat"); loadErr != nil {
+		record("file_ioctl_compat", "", nil, nil, loadErr)
+	} else {
+		lsmHook("file_ioctl_compat", prog, "", "")
+	}
+
+	// mounts
+	lsmHook("sb_mount", b.Objects.WatchdSbMount, "", "")
+	lsmHook("sb_umount", b.Objects.WatchdSbUmount, "", "")
+	lsmHook("move_mount", b.Objects.WatchdMoveMount, "", "")
 
 	// Tracing Hooks
 	// write
-	attachTracing(b.Objects.VfsWriteExitHook, "vfs_write exit hook")
+	tracingHook("vfs_write", MethodFexit, b.Objects.VfsWriteExitHook)
 
 	// If None is loaded then error
 	for _, link := range links {
 		if link != nil {
-			return links, nil
+			return links, report, nil
 		}
 	}
 
-	return nil, errors.New(err)
+	return nil, report, errors.New(err)
 }
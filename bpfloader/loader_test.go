@@ -2,6 +2,7 @@ package bpfloader
 
 import (
 	"context"
+	"encoding/binary"
 	"os"
 	"os/signal"
 	"syscall"
@@ -32,3 +33,51 @@ func TestInitBPF(t *testing.T) {
 
 	t.Log("Signal received, cleaning up")
 }
+
+func TestTrackedFileValueReports(t *testing.T) {
+
+	// struct VALUE of src/mtypes.h
+	if size := binary.Size(TrackedFileValue{}); size != 16 {
+		t.Errorf("TrackedFileValue is %d bytes, want 16", size)
+	}
+
+	all := TrackedFileValue{}
+	for _, typ := range []uint32{0x1, 0x2, 0x3, 0x4, 0x7} {
+		if !all.Reports(typ) {
+			t.Errorf("mask 0 doesn't report type %d", typ)
+		}
+	}
+
+	v := TrackedFileValue{EventMask: EventCreate | EventDelete}
+	for typ, want := range map[uint32]bool{
+		0x1:           true,
+		0x2:           false,
+		0x3:           true,
+		0x4:           false,
+		0x7 | 2<<4:    true, // UNLINK with two links left goes with delete
+		0x2 | 4096<<4: false,
+	} {
+		if got := v.Reports(typ); got != want {
+			t.Errorf("Reports(%#x) = %v, want %v", typ, got, want)
+		}
+	}
+}
+
+func TestVfsHasIdmap(t *testing.T) {
+
+	if _, err := os.Stat(builtinBTF); err != nil {
+		t.Skip("no kernel BTF")
+	}
+
+	// assumes a kernel of 5.12 or later
+	b := InitBPF()
+	for fn := range fallbackPrograms {
+		idmap, err := b.vfsHasIdmap(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !idmap {
+			t.Errorf("%s has no idmap argument", fn)
+		}
+	}
+}
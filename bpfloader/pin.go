@@ -0,0 +1,69 @@
+package bpfloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+)
+
+// PinDir is the bpffs directory a running watchd pins its maps in, for the
+// other watchd commands to read.
+const PinDir = "/sys/fs/bpf/watchd"
+
+// PolicyPinPath is where the policy table of a running watchd is pinned.
+var PolicyPinPath = filepath.Join(PinDir, "policy_table")
+
+// PinPolicy pins the policy table at PolicyPinPath. A pin left behind by a
+// watchd that didn't exit cleanly is replaced.
+func (b *BPF) PinPolicy() error {
+
+	if err := os.MkdirAll(PinDir, 0o700); err != nil {
+		return fmt.Errorf("pinning policy table: %w", err)
+	}
+	if err := os.Remove(PolicyPinPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing stale pin: %w", err)
+	}
+	if err := b.Objects.PolicyTable.Pin(PolicyPinPath); err != nil {
+		return fmt.Errorf("pinning policy table: %w", err)
+	}
+	return nil
+}
+
+// UnpinPolicy removes the pin of PinPolicy.
+func (b *BPF) UnpinPolicy() error {
+	return b.Objects.PolicyTable.Unpin()
+}
+
+// PinnedPolicy is the policy table of a running watchd, opened read-only.
+type PinnedPolicy struct {
+	m *ebpf.Map
+}
+
+// OpenPinnedPolicy opens the policy table pinned at PolicyPinPath. The error
+// wraps os.ErrNotExist if no watchd with the ebpf backend is running.
+func OpenPinnedPolicy() (*PinnedPolicy, error) {
+
+	m, err := ebpf.LoadPinnedMap(PolicyPinPath, &ebpf.LoadPinOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return &PinnedPolicy{m: m}, nil
+}
+
+// Lookup returns the entry of key, ok is false if there is none.
+func (p *PinnedPolicy) Lookup(key TrackedFileKey) (value TrackedFileValue, ok bool, err error) {
+
+	err = p.m.Lookup(key, &value)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return value, false, nil
+	}
+	return value, err == nil, err
+}
+
+// Close closes the map, the pin stays.
+func (p *PinnedPolicy) Close() error {
+	return p.m.Close()
+}
@@ -0,0 +1,193 @@
+package bpfloader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+)
+
+// ChangeRateLimited is the change type of the events RateLimitTracker builds
+// from the drop counters (RATE_LIMITED in src/mtypes.h). The number of
+// dropped events is carried in ChangeType[31:4].
+const ChangeRateLimited = 0x6
+
+// RateMax caps the rate of a bucket, so the refill in the eBPF programs
+// can't overflow (see src/ratelimit.h).
+const RateMax = 1000000
+
+// RateLimit is a token bucket of Rate events per second, allowing bursts of
+// up to Burst events. A zero Rate disables the bucket.
+type RateLimit struct {
+	Rate  uint64
+	Burst uint64
+}
+
+// ParseRateLimit parses "rate[:burst]" in events per second. The burst
+// defaults to the rate. An empty string or "0" disables the limit.
+func ParseRateLimit(s string) (RateLimit, error) {
+
+	var limit RateLimit
+
+	if s == "" {
+		return limit, nil
+	}
+
+	rate, burst, hasBurst := strings.Cut(s, ":")
+
+	r, err := strconv.ParseUint(rate, 10, 64)
+	if err != nil {
+		return limit, fmt.Errorf("invalid rate %q, want rate[:burst]", s)
+	}
+	if r > RateMax {
+		return limit, fmt.Errorf("rate %d is above the maximum of %d", r, RateMax)
+	}
+	limit.Rate = r
+	limit.Burst = r
+
+	if hasBurst {
+		b, err := strconv.ParseUint(burst, 10, 64)
+		if err != nil || b == 0 {
+			return limit, fmt.Errorf("invalid burst %q, want rate[:burst]", s)
+		}
+		if b > RateMax {
+			return limit, fmt.Errorf("burst %d is above the maximum of %d", b, RateMax)
+		}
+		limit.Burst = b
+	}
+
+	if limit.Rate == 0 {
+		return RateLimit{}, nil
+	}
+
+	return limit, nil
+}
+
+func (l RateLimit) String() string {
+	if l.Rate == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d/s, burst %d", l.Rate, l.Burst)
+}
+
+// rateConfig mirrors struct RATE_CONFIG
+type rateConfig struct {
+	PidRate  uint64
+	PidBurst uint64
+	UidRate  uint64
+	UidBurst uint64
+}
+
+// rateBucket mirrors struct BUCKET
+type rateBucket struct {
+	Tokens  uint64
+	LastNs  uint64
+	Dropped uint64
+	Uid     uint32
+	_       uint32
+}
+
+// SetRateLimits writes the per-process and per-user limits to the
+// rate_config map. Events over either limit are dropped in the kernel and
+// only counted.
+func (b *BPF) SetRateLimits(pid, uid RateLimit) error {
+	cfg := rateConfig{
+		PidRate:  pid.Rate,
+		PidBurst: pid.Burst,
+		UidRate:  uid.Rate,
+		UidBurst: uid.Burst,
+	}
+	return b.Objects.RateConfig.Put(uint32(0), cfg)
+}
+
+// RateLimitTracker turns the drop counters of the rate limit buckets into
+// RATE_LIMITED events.
+//
+// The kernel only ever increments the counters, the tracker remembers what
+// it reported per bucket and reports the difference.
+type RateLimitTracker struct {
+	bpf         *BPF
+	pidReported map[uint32]uint64
+	uidReported map[uint32]uint64
+}
+
+// NewRateLimitTracker returns a tracker for the buckets of bpf.
+func NewRateLimitTracker(bpf *BPF) *RateLimitTracker {
+	return &RateLimitTracker{
+		bpf:         bpf,
+		pidReported: make(map[uint32]uint64),
+		uidReported: make(map[uint32]uint64),
+	}
+}
+
+// Collect returns one RATE_LIMITED event per process and per user that had
+// events dropped since the last call. Events of a process carry its Pid,
+// events of a user have a zero Pid.
+func (t *RateLimitTracker) Collect() ([]FileChangeEvent, error) {
+
+	var events []FileChangeEvent
+
+	pid, err := collectBuckets(t.bpf.Objects.PidBuckets, t.pidReported, func(id uint32, b *rateBucket) FileChangeEvent {
+		return FileChangeEvent{Pid: id, Uid: b.Uid}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading process buckets: %w", err)
+	}
+	events = append(events, pid...)
+
+	uid, err := collectBuckets(t.bpf.Objects.UidBuckets, t.uidReported, func(id uint32, b *rateBucket) FileChangeEvent {
+		return FileChangeEvent{Uid: id}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading user buckets: %w", err)
+	}
+	events = append(events, uid...)
+
+	return events, nil
+}
+
+// collectBuckets reports the drops of every bucket of m above what was
+// reported before. Buckets evicted from the LRU map are forgotten, a bucket
+// with fewer drops than reported was evicted and re-created.
+func collectBuckets(m *ebpf.Map, reported map[uint32]uint64, event func(uint32, *rateBucket) FileChangeEvent) ([]FileChangeEvent, error) {
+
+	var events []FileChangeEvent
+	var id uint32
+	var bucket rateBucket
+
+	seen := make(map[uint32]uint8)
+
+	iter := m.Iterate()
+	for iter.Next(&id, &bucket) {
+		seen[id] = 1
+
+		last := reported[id]
+		if bucket.Dropped < last {
+			last = 0
+		}
+		if bucket.Dropped == last {
+			continue
+		}
+
+		// ChangeType has 28 bits for the count
+		dropped := min(bucket.Dropped-last, 1<<28-1)
+
+		e := event(id, &bucket)
+		e.ChangeType = ChangeRateLimited | uint32(dropped)<<4
+		events = append(events, e)
+
+		reported[id] = bucket.Dropped
+	}
+	if err := iter.Err(); err != nil {
+		return events, err
+	}
+
+	for id := range reported {
+		if _, ok := seen[id]; !ok {
+			delete(reported, id)
+		}
+	}
+
+	return events, nil
+}
@@ -0,0 +1,33 @@
+package bpfloader
+
+import "testing"
+
+func TestParseRateLimit(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want RateLimit
+		err  bool
+	}{
+		{"", RateLimit{}, false},
+		{"0", RateLimit{}, false},
+		{"0:10", RateLimit{}, false},
+		{"100", RateLimit{Rate: 100, Burst: 100}, false},
+		{"100:500", RateLimit{Rate: 100, Burst: 500}, false},
+		{"100:0", RateLimit{}, true},
+		{"-1", RateLimit{}, true},
+		{"fast", RateLimit{}, true},
+		{"10:x", RateLimit{}, true},
+		{"2000000", RateLimit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRateLimit(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseRateLimit(%q): err %v", tt.in, err)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("ParseRateLimit(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package bpfloader
+
+import (
+	"fmt"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ringBufferMaxSize is the largest ring buffer the kernel accepts
+const ringBufferMaxSize = 1 << 30
+
+// ParseRingBufferSize parses a ring buffer size in bytes with an optional
+// K, M or G suffix (powers of 1024), e.g. "16M". The kernel wants a power
+// of two that is a multiple of the page size.
+func ParseRingBufferSize(s string) (uint32, error) {
+
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	shift := 0
+	switch {
+	case strings.HasSuffix(num, "K"):
+		shift = 10
+	case strings.HasSuffix(num, "M"):
+		shift = 20
+	case strings.HasSuffix(num, "G"):
+		shift = 30
+	}
+	if shift != 0 {
+		num = num[:len(num)-1]
+	}
+
+	n, err := strconv.ParseUint(num, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > ringBufferMaxSize>>shift {
+		return 0, fmt.Errorf("size %q is above the maximum of 1G", s)
+	}
+	size := uint32(n << shift)
+
+	page := uint32(os.Getpagesize())
+	if bits.OnesCount32(size) != 1 || size < page {
+		return 0, fmt.Errorf("size %q must be a power of two and at least the page size (%d bytes)", s, page)
+	}
+
+	return size, nil
+}
@@ -0,0 +1,34 @@
+package bpfloader
+
+import "testing"
+
+func TestParseRingBufferSize(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want uint32
+		err  bool
+	}{
+		{"4096", 4096, false},
+		{"64K", 64 << 10, false},
+		{"16M", 16 << 20, false},
+		{"16MB", 16 << 20, false},
+		{"1g", 1 << 30, false},
+		{"2G", 0, true},
+		{"3M", 0, true},
+		{"1K", 0, true},
+		{"0", 0, true},
+		{"M", 0, true},
+		{"big", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRingBufferSize(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseRingBufferSize(%q): err %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRingBufferSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package bpfloader
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// ErrLinkDetached is returned by VerifyLinks for links that no longer run
+// the program they were created with.
+var ErrLinkDetached = errors.New("link detached")
+
+// linkTarget returns the BTF ID of the kernel function or LSM hook l is
+// attached to, zero if the kernel doesn't report it
+func linkTarget(l link.Link) uint32 {
+	info, err := l.Info()
+	if err != nil {
+		return 0
+	}
+	if tracing := info.Tracing(); tracing != nil {
+		return uint32(tracing.TargetBtfId)
+	}
+	return 0
+}
+
+// VerifyLinks checks every hook attached by AttachPrograms and returns the
+// ones whose link was detached behind watchd's back, e.g. with bpftool link
+// detach, with Err set to why.
+//
+// A link counts as detached if the kernel no longer answers for it, or
+// reports another program or attach target than at attach time.
+func (r *AttachReport) VerifyLinks() []*HookStatus {
+
+	var detached []*HookStatus
+
+	for i := range r.Hooks {
+		h := &r.Hooks[i]
+		if h.Link == nil || h.prog == nil {
+			continue
+		}
+		if err := verifyLink(h); err != nil {
+			h.Err = fmt.Errorf("%w: %v", ErrLinkDetached, err)
+			detached = append(detached, h)
+		}
+	}
+
+	return detached
+}
+
+func verifyLink(h *HookStatus) error {
+
+	info, err := h.Link.Info()
+	if err != nil {
+		return err
+	}
+
+	progInfo, err := h.prog.Info()
+	if err != nil {
+		return fmt.Errorf("program info: %w", err)
+	}
+	if id, ok := progInfo.ID(); ok && info.Program != id {
+		return fmt.Errorf("runs program %d instead of %d", info.Program, id)
+	}
+
+	if tracing := info.Tracing(); tracing != nil && h.target != 0 && uint32(tracing.TargetBtfId) != h.target {
+		return fmt.Errorf("attach target changed from BTF ID %d to %d", h.target, tracing.TargetBtfId)
+	}
+
+	return nil
+}
+
+// Reattach closes the link of h and attaches its program again with the
+// same method. The returned link replaces the old one in h.
+func (h *HookStatus) Reattach() error {
+
+	if h.prog == nil {
+		return fmt.Errorf("%s: was never attached", h.Hook)
+	}
+	if h.Link != nil {
+		h.Link.Close()
+		h.Link = nil
+	}
+
+	var l link.Link
+	var err error
+	if h.Method == MethodLSM {
+		l, err = link.AttachLSM(link.LSMOptions{Program: h.prog})
+	} else {
+		l, err = link.AttachTracing(link.TracingOptions{Program: h.prog})
+	}
+	if err != nil {
+		h.Err = err
+		return fmt.Errorf("re-attaching %s: %w", h.Hook, err)
+	}
+
+	h.Link = l
+	h.Err = nil
+	h.target = linkTarget(l)
+	return nil
+}
+
+// PolicyEntries counts the entries of the policy table.
+func (b *BPF) PolicyEntries() (int, error) {
+
+	var key TrackedFileKey
+	var value TrackedFileValue
+	var count int
+
+	iter := b.Objects.PolicyTable.Iterate()
+	for iter.Next(&key, &value) {
+		count++
+	}
+	return count, iter.Err()
+}
+
+// HasPolicyEntry reports whether key is in the policy table.
+func (b *BPF) HasPolicyEntry(key TrackedFileKey) (bool, error) {
+
+	var value TrackedFileValue
+	err := b.Objects.PolicyTable.Lookup(key, &value)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
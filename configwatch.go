@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+	"watchd/preprocess"
+
+	"golang.org/x/sys/unix"
+)
+
+// configDebounce is how long the config directory has to stay quiet before
+// a change is applied. Editors and configuration management write a
+// temporary file, rename it over the config and touch backups, a reload
+// should only see the result.
+const configDebounce = 500 * time.Millisecond
+
+// configWatchMask covers files written in place and files renamed over the
+// config, its directories are watched so the watches survive the rename
+const configWatchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+	unix.IN_CREATE | unix.IN_DELETE | unix.IN_ATTRIB
+
+// watchConfig reloads the policy whenever the config changes on disk.
+//
+// Any event in the directory of the config or of a file it includes starts
+// the debounce timer, the reload then only happens if the hash of the config
+// and the included files differs from the one last applied or rejected.
+// This also catches symlink swaps, as done for Kubernetes ConfigMaps.
+func (r *reloader) watchConfig() error {
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(config), configWatchMask); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	watchIncludes(fd)
+
+	debounce := time.AfterFunc(configDebounce, func() {
+		r.logReload("config changed", true)
+		// an INCLUDE may name a new directory
+		watchIncludes(fd)
+	})
+	debounce.Stop()
+
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			// the events themselves don't matter, only that there were some
+			if _, err := unix.Read(fd, buf); err != nil {
+				if err == unix.EINTR {
+					continue
+				}
+				log.Printf("ERROR: watching %s for changes: %v", config, err)
+				return
+			}
+			// the self check waits for the reload
+			if r.checker != nil {
+				r.checker.ReloadPending(config)
+			}
+			debounce.Reset(configDebounce)
+		}
+	}()
+
+	return nil
+}
+
+// watchIncludes adds watches for the directories of the included files and
+// INCLUDE patterns, adding a watch twice only updates it. A directory that
+// doesn't exist yet is skipped until a later change of the config.
+func watchIncludes(fd int) {
+	for _, dir := range preprocess.ConfigDirs(config) {
+		if _, err := unix.InotifyAddWatch(fd, dir, configWatchMask); err != nil && err != unix.ENOENT {
+			log.Printf("WARN: watching %s for changes: %v", dir, err)
+		}
+	}
+}
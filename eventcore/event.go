@@ -15,13 +15,63 @@ import (
 	"watchd/preprocess"
 )
 
+// TimeFormat is the layout of Payload.TimeStamp
+const TimeFormat = "2006-01-02 03:04:05 PM"
+
 func ProcessEvent(event *bpfloader.FileChangeEvent, bpf *bpfloader.BPF, policy *preprocess.Cache) (netlog.Payload, bool) {
 
+	if event.ChangeType&0xF == bpfloader.ChangeHeartbeat {
+		return processHeartbeatEvent(event)
+	}
+
+	// reported by ScanMounts, once the mount table shows the change
+	if event.ChangeType&0xF == 5 {
+		queueMountScan(event)
+		return netlog.Payload{}, false
+	}
+
+	// the events of the file waiting for its hash go first
+	if t := event.ChangeType & 0xF; t == 3 || t == 7 {
+		flushHash(bpfloader.TrackedFileKey{InodeNumber: event.InodeNumber, Dev: event.Dev})
+	}
+
+	payload, hash, ok := processEvent(event, bpf, policy)
+	if !ok {
+		processed.filtered++
+		return payload, false
+	}
+	processed.reported++
+	if hash != "" {
+		return hashLater(bpfloader.TrackedFileKey{InodeNumber: event.InodeNumber, Dev: event.Dev}, hash, payload)
+	}
+	return payload, true
+}
+
+// ReplayEvent is ProcessEvent for an event recorded elsewhere or earlier.
+// Mount events are reported as recorded, the mount table of this machine
+// has nothing to do with them.
+func ReplayEvent(event *bpfloader.FileChangeEvent, policy *preprocess.Cache) (netlog.Payload, bool) {
+	if event.ChangeType&0xF == 5 {
+		return mountPayload(event), true
+	}
+	return ProcessEvent(event, nil, policy)
+}
+
+// processEvent builds the payload of event, and returns the path of its
+// file if the rule asks for its hash
+func processEvent(event *bpfloader.FileChangeEvent, bpf *bpfloader.BPF, policy *preprocess.Cache) (netlog.Payload, string, bool) {
+
 	var payload netlog.Payload
 
+	// summaries of dropped events have no file to filter on
+	if event.ChangeType&0xF == bpfloader.ChangeRateLimited {
+		payload, ok := processRateLimitedEvent(event)
+		return payload, "", ok
+	}
+
 	// if Filter returns false then only process the event
 	if Filter(event, policy.FilterList) {
-		return payload, false
+		return payload, "", false
 	}
 
 	payload.AfterSize = event.AfterSize
@@ -31,7 +81,7 @@ func ProcessEvent(event *bpfloader.FileChangeEvent, bpf *bpfloader.BPF, policy *
 	payload.CheckSum = "dummy"
 	payload.Username = resolveUsername(event.Uid)
 	payload.FromIp = getHostIP().String()
-	payload.TimeStamp = time.Now().Format("2006-01-02 03:04:05 PM")
+	payload.TimeStamp = time.Now().Format(TimeFormat)
 	payload.Tty = resolveTtyName(event.TtyMajor, event.TtyIndex)
 
 	chngType := event.ChangeType & 0xF
@@ -39,28 +89,81 @@ func ProcessEvent(event *bpfloader.FileChangeEvent, bpf *bpfloader.BPF, policy *
 
 	if chngType == 1 {
 		payload.ChangeType = "CREATE"
-		bpf.UpdateLookupTable(event)
 		updatePathCache(event, &policy.PathCache)
+		if excludedCreate(event, policy) {
+			return payload, "", false
+		}
+		// a created file reports the events of its directory
+		parent := policy.LookupTable[bpfloader.TrackedFileKey{InodeNumber: event.ParentInodeNumber, Dev: event.ParentDev}]
+		bpf.UpdateLookupTable(event, parent.EventMask)
+		policy.Track(bpfloader.TrackedFileKey{InodeNumber: event.InodeNumber, Dev: event.Dev},
+			bpfloader.TrackedFileValue{FileSize: event.AfterSize, EventMask: parent.EventMask})
 	} else if chngType == 3 {
 		payload.ChangeType = "DELETE"
+		policy.Untrack(bpfloader.TrackedFileKey{InodeNumber: event.InodeNumber, Dev: event.Dev})
+	} else if chngType == 7 {
+		payload.ChangeType = fmt.Sprintf("UNLINK [%d links left]", bytes)
+		unlinkPathCache(event, &policy.PathCache)
 	} else if chngType == 2 {
 		payload.ChangeType = fmt.Sprintf("MODIFY [%d bytes]", bytes)
+	} else if chngType == 4 {
+		payload.ChangeType = "FLAGS_CHANGED"
+		payload.OldFlags, payload.NewFlags = decodeFlagsChange(bytes, event.OldFlags, event.NewFlags)
 	} else {
 		payload.ChangeType = "UNKNOWN"
 	}
 
+	// masked out, only what is tracked changes
+	if event.TrackOnly {
+		if chngType == 3 {
+			deletePathCache(event, &policy.PathCache)
+		}
+		return payload, "", false
+	}
+
 	// payload.FilePath = constructPath(event, &policy.PathCache)
 	payload.FilePath = preprocess.CString(event.Filename[:])
 
-	return payload, true
+	// the surviving names for UNLINK
+	paths := knownPaths(event, &policy.PathCache)
+	if len(paths) > 1 || chngType == 7 {
+		payload.Paths = paths
+	}
+
+	setMount(&payload, policy, event.Dev, mountHint(event, paths, &policy.PathCache))
+	hash := setRuleOptions(&payload, policy, paths, chngType)
+
+	if chngType == 3 {
+		deletePathCache(event, &policy.PathCache)
+	}
+
+	return payload, hash, true
 }
 
 func PrintPayload(payload netlog.Payload) {
+	if hb := payload.Heartbeat; hb != nil {
+		log.Printf("\n EventType: %s #%d , Kernel events : %d , Lost : %d , Rate limited : %d , Reported : %d , Filtered : %d , TimeStamp : %s \n",
+			payload.ChangeType, hb.Seq,
+			hb.Events, hb.Lost, hb.RateLimited,
+			hb.Reported, hb.Filtered, payload.TimeStamp)
+		return
+	}
+	if payload.ChangeType == "FLAGS_CHANGED" {
+		log.Printf("\n EventType: %s ,Filename: %s ,  Username %s, TTY : %s ,  Flags : %v->%v , FromIP : %s , TimeStamp : %s \n",
+			payload.ChangeType, payload.FilePath,
+			payload.Username,
+			payload.Tty, payload.OldFlags, payload.NewFlags,
+			payload.FromIp, payload.TimeStamp)
+		return
+	}
 	log.Printf("\n EventType: %s ,Filename: %s ,  Username %s, TTY : %s ,  Size : %d->%d , FromIP : %s , TimeStamp : %s \n",
 		payload.ChangeType, payload.FilePath,
 		payload.Username,
 		payload.Tty, payload.BeforeSize, payload.AfterSize,
 		payload.FromIp, payload.TimeStamp)
+	if len(payload.Paths) > 0 {
+		log.Printf(" Paths : %s \n", strings.Join(payload.Paths, ", "))
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,18 @@
+package eventcore
+
+import (
+	"watchd/bpfloader"
+	"watchd/preprocess"
+)
+
+// excludedCreate reports whether the file a CREATE event is about is left
+// out by an E rule, patterns included, the same way the initial walk would
+// have left it out. It is not added to the policy table then.
+func excludedCreate(event *bpfloader.FileChangeEvent, policy *preprocess.Cache) bool {
+	for _, path := range knownPaths(event, &policy.PathCache) {
+		if policy.Excluded(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package eventcore
+
+// Decoding of inode flags carried by FLAGS_CHANGED events.
+//
+// The new flags are reported exactly as passed to the ioctl, FS_*_FL bits
+// for FS_IOC_SETFLAGS and FS_XFLAG_* bits for FS_IOC_FSSETXATTR. The old
+// flags are inode->i_flags, S_* bits mirroring the VFS relevant flags only.
+// Both are decoded to chattr style names, so chattr -i shows immutable
+// going away.
+
+// ioctl kinds carried in ChangeType[31:4] (see FLAGS_KIND_* in src/mtypes.h)
+const (
+	flagsKindSetFlags   = 0x0
+	flagsKindFsSetXattr = 0x1
+)
+
+type flagName struct {
+	bit  uint32
+	name string
+}
+
+// FS_*_FL flags of FS_IOC_SETFLAGS
+var fsFlagNames = []flagName{
+	{0x00000001, "secrm"},
+	{0x00000002, "undelete"},
+	{0x00000004, "compress"},
+	{0x00000008, "sync"},
+	{0x00000010, "immutable"},
+	{0x00000020, "append"},
+	{0x00000040, "nodump"},
+	{0x00000080, "noatime"},
+	{0x00000400, "nocompress"},
+	{0x00000800, "encrypted"},
+	{0x00001000, "indexed"},
+	{0x00004000, "journal_data"},
+	{0x00008000, "notail"},
+	{0x00010000, "dirsync"},
+	{0x00020000, "topdir"},
+	{0x00040000, "huge_file"},
+	{0x00080000, "extents"},
+	{0x00100000, "verity"},
+	{0x00800000, "nocow"},
+	{0x02000000, "dax"},
+	{0x10000000, "inline_data"},
+	{0x20000000, "projinherit"},
+	{0x40000000, "casefold"},
+}
+
+// FS_XFLAG_* flags of FS_IOC_FSSETXATTR
+var xFlagNames = []flagName{
+	{0x00000001, "realtime"},
+	{0x00000002, "prealloc"},
+	{0x00000008, "immutable"},
+	{0x00000010, "append"},
+	{0x00000020, "sync"},
+	{0x00000040, "noatime"},
+	{0x00000080, "nodump"},
+	{0x00000100, "rtinherit"},
+	{0x00000200, "projinherit"},
+	{0x00000400, "nosymlinks"},
+	{0x00000800, "extsize"},
+	{0x00001000, "extszinherit"},
+	{0x00002000, "nodefrag"},
+	{0x00004000, "filestream"},
+	{0x00008000, "dax"},
+	{0x00010000, "cowextsize"},
+}
+
+// S_* inode flags of inode->i_flags that mirror a chattr flag
+var inodeFlagNames = []flagName{
+	{0x00000001, "sync"},      // S_SYNC
+	{0x00000002, "noatime"},   // S_NOATIME
+	{0x00000004, "append"},    // S_APPEND
+	{0x00000008, "immutable"}, // S_IMMUTABLE
+	{0x00000040, "dirsync"},   // S_DIRSYNC
+}
+
+// decodeFlags returns the names of all bits of flags known to table,
+// in table order. Unknown bits are dropped.
+func decodeFlags(flags uint32, table []flagName) []string {
+	names := make([]string, 0)
+	for _, f := range table {
+		if flags&f.bit != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// decodeFlagsChange decodes the old and new flags of a FLAGS_CHANGED event,
+// kind selects how the new ones are interpreted
+func decodeFlagsChange(kind uint32, oldFlags uint32, newFlags uint32) ([]string, []string) {
+	old := decodeFlags(oldFlags, inodeFlagNames)
+	if kind == flagsKindFsSetXattr {
+		return old, decodeFlags(newFlags, xFlagNames)
+	}
+	return old, decodeFlags(newFlags, fsFlagNames)
+}
@@ -0,0 +1,36 @@
+package eventcore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFlagsChange(t *testing.T) {
+
+	// chattr +i on a file that already had +a
+	before, after := decodeFlagsChange(flagsKindSetFlags, 0x4, 0x10|0x20|0x80000)
+	if !reflect.DeepEqual(before, []string{"append"}) {
+		t.Errorf("old flags: got %v", before)
+	}
+	if !reflect.DeepEqual(after, []string{"immutable", "append", "extents"}) {
+		t.Errorf("new flags: got %v", after)
+	}
+
+	// chattr -i, immutable goes away
+	before, after = decodeFlagsChange(flagsKindSetFlags, 0x8, 0x80000)
+	if !reflect.DeepEqual(before, []string{"immutable"}) {
+		t.Errorf("old flags: got %v", before)
+	}
+	if !reflect.DeepEqual(after, []string{"extents"}) {
+		t.Errorf("new flags: got %v", after)
+	}
+
+	// xfs_io chattr +d via FS_IOC_FSSETXATTR on a noatime file
+	before, after = decodeFlagsChange(flagsKindFsSetXattr, 0x2, 0x40|0x80)
+	if !reflect.DeepEqual(before, []string{"noatime"}) {
+		t.Errorf("old flags: got %v", before)
+	}
+	if !reflect.DeepEqual(after, []string{"noatime", "nodump"}) {
+		t.Errorf("new flags: got %v", after)
+	}
+}
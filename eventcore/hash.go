@@ -0,0 +1,144 @@
+package eventcore
+
+import (
+	"sync"
+	"watchd/bpfloader"
+	"watchd/netlog"
+)
+
+// hashQueueSize is how many files can wait for HashFiles, the events of
+// further files are reported without their hash
+const hashQueueSize = 64
+
+// hashJob is an event waiting for the hash of its file
+type hashJob struct {
+	path    string
+	payload netlog.Payload
+
+	flushed bool          // reported without hash by flushHash, HashFiles drops it
+	claimed bool          // HashFiles is reporting it
+	done    chan struct{} // closed once HashFiles is done with it
+}
+
+// hashes hands the events of files to hash to HashFiles, one per file. A
+// file written again while it waits takes the later event, the content
+// hashed is the latest anyway.
+var hashes = struct {
+	mu         sync.Mutex
+	report     func(netlog.Payload) // of HashFiles, nil if not started
+	pending    map[bpfloader.TrackedFileKey]*hashJob
+	queue      chan bpfloader.TrackedFileKey
+	current    *hashJob // being hashed
+	currentKey bpfloader.TrackedFileKey
+}{
+	pending: make(map[bpfloader.TrackedFileKey]*hashJob),
+	queue:   make(chan bpfloader.TrackedFileKey, hashQueueSize),
+}
+
+// HashFiles hashes the files of the events of rules with the hash option,
+// off the event reader, and hands the events to report with their hash. It
+// doesn't return.
+func HashFiles(report func(netlog.Payload)) {
+
+	hashes.mu.Lock()
+	hashes.report = report
+	hashes.mu.Unlock()
+
+	for key := range hashes.queue {
+		hashes.mu.Lock()
+		job := hashes.pending[key]
+		delete(hashes.pending, key)
+		if job == nil {
+			// flushed while it waited
+			hashes.mu.Unlock()
+			continue
+		}
+		hashes.current, hashes.currentKey = job, key
+		hashes.mu.Unlock()
+
+		sum, err := hashFile(job.path)
+
+		hashes.mu.Lock()
+		flushed := job.flushed
+		job.claimed = !flushed
+		hashes.mu.Unlock()
+
+		if !flushed {
+			job.payload.CheckSum = sum
+			if err != nil {
+				job.payload.CheckSum = ""
+			}
+			report(job.payload)
+		}
+
+		hashes.mu.Lock()
+		hashes.current = nil
+		hashes.mu.Unlock()
+		close(job.done)
+	}
+}
+
+// hashLater queues payload for the hash of the file at path, key is its
+// inode. It returns what to report now: nothing if payload was queued, the
+// event it replaced if the file was waiting already, payload itself without
+// hash if the queue is full. Without HashFiles the file is hashed here.
+func hashLater(key bpfloader.TrackedFileKey, path string, payload netlog.Payload) (netlog.Payload, bool) {
+
+	hashes.mu.Lock()
+	defer hashes.mu.Unlock()
+
+	if hashes.report == nil {
+		sum, err := hashFile(path)
+		payload.CheckSum = sum
+		if err != nil {
+			payload.CheckSum = ""
+		}
+		return payload, true
+	}
+
+	// the earlier event goes out without hash, its content is gone
+	if job, ok := hashes.pending[key]; ok {
+		earlier := job.payload
+		earlier.CheckSum = ""
+		job.path, job.payload = path, payload
+		return earlier, true
+	}
+
+	select {
+	case hashes.queue <- key:
+		hashes.pending[key] = &hashJob{path: path, payload: payload, done: make(chan struct{})}
+		return netlog.Payload{}, false
+	default:
+		payload.CheckSum = ""
+		return payload, true
+	}
+}
+
+// flushHash reports the event of the file key waiting for its hash right
+// away, without hash. It is called before a DELETE or UNLINK of the file is
+// reported, which has to come after the events before it. If HashFiles is
+// reporting the event already, it waits for that.
+func flushHash(key bpfloader.TrackedFileKey) {
+
+	hashes.mu.Lock()
+	job, ok := hashes.pending[key]
+	if ok {
+		delete(hashes.pending, key)
+	} else if hashes.current != nil && hashes.currentKey == key {
+		job = hashes.current
+		if job.claimed {
+			hashes.mu.Unlock()
+			<-job.done
+			return
+		}
+		job.flushed = true
+	} else {
+		hashes.mu.Unlock()
+		return
+	}
+	report := hashes.report
+	hashes.mu.Unlock()
+
+	job.payload.CheckSum = ""
+	report(job.payload)
+}
@@ -0,0 +1,73 @@
+package eventcore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"watchd/bpfloader"
+	"watchd/netlog"
+)
+
+func TestHashLater(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	key := bpfloader.TrackedFileKey{InodeNumber: 1, Dev: 1}
+
+	// without HashFiles the event is hashed right away
+	payload, ok := hashLater(key, path, netlog.Payload{ChangeType: "CREATE", CheckSum: "dummy"})
+	if !ok || payload.CheckSum == "" || payload.CheckSum == "dummy" {
+		t.Fatalf("got %v %q, want the event with its hash", ok, payload.CheckSum)
+	}
+	payload, _ = hashLater(key, path+".gone", netlog.Payload{ChangeType: "CREATE", CheckSum: "dummy"})
+	if payload.CheckSum != "" {
+		t.Errorf("unreadable file hashed to %q, want none", payload.CheckSum)
+	}
+
+	var reported []netlog.Payload
+	hashes.mu.Lock()
+	hashes.report = func(p netlog.Payload) { reported = append(reported, p) }
+	hashes.mu.Unlock()
+	defer func() {
+		hashes.mu.Lock()
+		hashes.report = nil
+		hashes.mu.Unlock()
+	}()
+
+	if _, ok := hashLater(key, path, netlog.Payload{ChangeType: "MODIFY [1 bytes]", CheckSum: "dummy"}); ok {
+		t.Fatal("queued event reported right away")
+	}
+	// a second write takes the place of the first, which goes out unhashed
+	payload, ok = hashLater(key, path, netlog.Payload{ChangeType: "MODIFY [2 bytes]", CheckSum: "dummy"})
+	if !ok || payload.ChangeType != "MODIFY [1 bytes]" || payload.CheckSum != "" {
+		t.Errorf("got %v %s %q, want the first MODIFY without hash", ok, payload.ChangeType, payload.CheckSum)
+	}
+	if len(hashes.queue) != 1 || hashes.pending[key].payload.ChangeType != "MODIFY [2 bytes]" {
+		t.Errorf("%d queued, want the second MODIFY only", len(hashes.queue))
+	}
+
+	// a DELETE sends the waiting MODIFY first
+	flushHash(key)
+	if len(reported) != 1 || reported[0].ChangeType != "MODIFY [2 bytes]" || reported[0].CheckSum != "" {
+		t.Errorf("flushed %v, want the second MODIFY without hash", reported)
+	}
+	if _, ok := hashes.pending[key]; ok {
+		t.Error("flushed event still waiting")
+	}
+	<-hashes.queue
+
+	// a full queue doesn't hold up the event
+	for i := 2; len(hashes.queue) < hashQueueSize; i++ {
+		hashLater(bpfloader.TrackedFileKey{InodeNumber: uint64(i)}, path, netlog.Payload{})
+	}
+	payload, ok = hashLater(bpfloader.TrackedFileKey{InodeNumber: 0}, path, netlog.Payload{ChangeType: "CREATE", CheckSum: "dummy"})
+	if !ok || payload.ChangeType != "CREATE" || payload.CheckSum != "" {
+		t.Errorf("got %v %s %q, want the CREATE without hash", ok, payload.ChangeType, payload.CheckSum)
+	}
+
+	for len(hashes.queue) > 0 {
+		delete(hashes.pending, <-hashes.queue)
+	}
+}
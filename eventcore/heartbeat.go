@@ -0,0 +1,41 @@
+package eventcore
+
+import (
+	"time"
+	"watchd/bpfloader"
+	"watchd/netlog"
+)
+
+// processed counts the events since the last heartbeat. Events are
+// processed by a single goroutine.
+var processed struct {
+	reported uint64
+	filtered uint64
+}
+
+// processHeartbeatEvent forwards a HEARTBEAT with the kernel counters and
+// what the daemon did with the events since the previous one.
+func processHeartbeatEvent(event *bpfloader.FileChangeEvent) (netlog.Payload, bool) {
+
+	var payload netlog.Payload
+
+	payload.ChangeType = "HEARTBEAT"
+	payload.Heartbeat = &netlog.Heartbeat{
+		Seq:         event.Counters.Seq,
+		Events:      event.Counters.Events,
+		Lost:        event.Counters.Lost,
+		RateLimited: event.Counters.RateLimited,
+		Reported:    processed.reported,
+		Filtered:    processed.filtered,
+	}
+	processed.reported = 0
+	processed.filtered = 0
+
+	payload.CheckSum = "dummy"
+	payload.Username = resolveUsername(event.Uid)
+	payload.FromIp = getHostIP().String()
+	payload.TimeStamp = time.Now().Format(TimeFormat)
+	payload.Tty = "None"
+
+	return payload, true
+}
@@ -0,0 +1,56 @@
+package eventcore
+
+import (
+	"path/filepath"
+	"watchd/bpfloader"
+	"watchd/preprocess"
+)
+
+// unlinkPathCache forgets the name an UNLINK event removed, the other names
+// of the file stay.
+func unlinkPathCache(event *bpfloader.FileChangeEvent, p *preprocess.PathCache) {
+
+	key := preprocess.CacheKey{
+		Inode_number: event.InodeNumber,
+		Dev_id:       event.Dev,
+	}
+	parent := preprocess.CacheKey{
+		Inode_number: event.ParentInodeNumber,
+		Dev_id:       event.ParentDev,
+	}
+
+	p.Unlink(key, parent, preprocess.CString(event.Filename[:]))
+}
+
+// deletePathCache forgets every name of the file a DELETE removed, its
+// inode number may be reused.
+func deletePathCache(event *bpfloader.FileChangeEvent, p *preprocess.PathCache) {
+
+	p.Delete(preprocess.CacheKey{
+		Inode_number: event.InodeNumber,
+		Dev_id:       event.Dev,
+	})
+}
+
+// knownPaths returns the full paths of every name of the file of event the
+// path cache knows, more than one for hard linked files.
+func knownPaths(event *bpfloader.FileChangeEvent, p *preprocess.PathCache) []string {
+
+	key := preprocess.CacheKey{
+		Inode_number: event.InodeNumber,
+		Dev_id:       event.Dev,
+	}
+
+	var paths []string
+	for _, name := range p.Names(key) {
+		path := name.Filename
+		if name.Parent != nil {
+			if parent, ok := p.Get(*name.Parent); ok {
+				path = filepath.Join(pfs(&parent, p), name.Filename)
+			}
+		}
+		paths = append(paths, filepath.Clean(path))
+	}
+
+	return paths
+}
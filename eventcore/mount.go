@@ -0,0 +1,165 @@
+package eventcore
+
+import (
+	"log"
+	"strings"
+	"time"
+	"watchd/bpfloader"
+	"watchd/netlog"
+	"watchd/preprocess"
+)
+
+// mount kinds carried in ChangeType[31:4] (see MOUNT_KIND_* in src/mtypes.h)
+const (
+	mountKindMount  = 0x0
+	mountKindUmount = 0x1
+	mountKindMove   = 0x2
+)
+
+// The LSM hooks run before the mount table changes, so ScanMounts polls
+// the table a few times before giving up on a change.
+const (
+	mountScanRetries  = 5
+	mountScanInterval = 50 * time.Millisecond
+)
+
+// mountScans hands mount events to ScanMounts. It holds the latest one, a
+// single rescan sees every change since.
+var mountScans = make(chan bpfloader.FileChangeEvent, 1)
+
+// queueMountScan asks ScanMounts for a rescan after event, without waiting
+func queueMountScan(event *bpfloader.FileChangeEvent) {
+	for {
+		select {
+		case mountScans <- *event:
+			return
+		default:
+			// replace the pending event, its rescan sees this change too
+			select {
+			case <-mountScans:
+			default:
+			}
+		}
+	}
+}
+
+// ScanMounts rescans the mount table after each mount event, off the event
+// reader, and hands the changes touching tracked directories to report. It
+// doesn't return.
+//
+// with runs its function with the policy in effect, holding whatever keeps
+// events and reloads away from it. The waits between polls are outside.
+func ScanMounts(bpf *bpfloader.BPF, with func(func(policy *preprocess.Cache)), report func(netlog.Payload)) {
+
+	for event := range mountScans {
+		for i := 0; i < mountScanRetries; i++ {
+			var payload netlog.Payload
+			done, ok := false, false
+			with(func(policy *preprocess.Cache) {
+				changed, err := policy.RefreshMounts()
+				if err != nil {
+					log.Printf("reading mount table: %v", err)
+					done = true
+					return
+				}
+				if len(changed) > 0 {
+					done = true
+					payload, ok = processMountEvent(&event, changed, bpf, policy)
+				}
+			})
+			if done {
+				if ok {
+					report(payload)
+				}
+				break
+			}
+			time.Sleep(mountScanInterval)
+		}
+	}
+}
+
+// processMountEvent re-walks the D rules affected by the mount points
+// changed and reports the ones that touch tracked directories.
+//
+// Mounts elsewhere on the system are dropped.
+func processMountEvent(event *bpfloader.FileChangeEvent, changed []string, bpf *bpfloader.BPF, policy *preprocess.Cache) (netlog.Payload, bool) {
+
+	tracked := policy.TrackedMountPoints(changed)
+	if len(tracked) == 0 {
+		return netlog.Payload{}, false
+	}
+
+	count, err := policy.RewalkMounts(tracked, bpf)
+	if err != nil {
+		log.Printf("re-walking policy after mount change: %v", err)
+	}
+	log.Printf("mount change on %v, %d new entries in policy table", tracked, count)
+
+	payload := mountPayload(event)
+	payload.FilePath = strings.Join(tracked, ", ")
+
+	// the new mount, or what the old one uncovered
+	if m, ok := policy.MountContaining(tracked[0]); ok {
+		payload.MountPoint = m.MountPoint
+		payload.FSType = m.FSType
+		payload.Source = m.Source
+	}
+
+	return payload, true
+}
+
+// mountPayload returns the payload of a mount event with what the event
+// itself carries, the mount point is the name of its directory
+func mountPayload(event *bpfloader.FileChangeEvent) netlog.Payload {
+
+	var payload netlog.Payload
+
+	switch event.ChangeType >> 4 {
+	case mountKindUmount:
+		payload.ChangeType = "UMOUNT"
+	case mountKindMove:
+		payload.ChangeType = "MOVE_MOUNT"
+	default:
+		payload.ChangeType = "MOUNT"
+	}
+
+	payload.CheckSum = "dummy"
+	payload.Username = resolveUsername(event.Uid)
+	payload.FromIp = getHostIP().String()
+	payload.TimeStamp = time.Now().Format(TimeFormat)
+	payload.Tty = resolveTtyName(event.TtyMajor, event.TtyIndex)
+	payload.FilePath = preprocess.CString(event.Filename[:])
+
+	return payload
+}
+
+// setMount fills in the mount a file of dev was reached through, path is a
+// hint to pick among several mounts of a filesystem
+func setMount(payload *netlog.Payload, policy *preprocess.Cache, dev uint64, path string) {
+
+	m, ok := policy.Mount(dev, path)
+	if !ok {
+		return
+	}
+	payload.MountPoint = m.MountPoint
+	payload.FSType = m.FSType
+	payload.Source = m.Source
+}
+
+// mountHint returns a path of the file of event to tell apart mounts of
+// the same filesystem: a known path of it, else the path of its parent.
+func mountHint(event *bpfloader.FileChangeEvent, paths []string, p *preprocess.PathCache) string {
+
+	if len(paths) > 0 {
+		return paths[0]
+	}
+
+	parent, ok := p.Get(preprocess.CacheKey{
+		Inode_number: event.ParentInodeNumber,
+		Dev_id:       event.ParentDev,
+	})
+	if !ok {
+		return ""
+	}
+	return pfs(&parent, p)
+}
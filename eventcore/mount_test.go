@@ -0,0 +1,29 @@
+package eventcore
+
+import (
+	"testing"
+	"watchd/bpfloader"
+	"watchd/preprocess"
+)
+
+func TestReplayMountEvent(t *testing.T) {
+
+	event := bpfloader.FileChangeEvent{ChangeType: 5 | mountKindUmount<<4}
+	copy(event.Filename[:], "data")
+
+	// the policy has no mount table, a rescan would fill one in
+	var policy preprocess.Cache
+	payload, ok := ReplayEvent(&event, &policy)
+	if !ok {
+		t.Fatal("mount event not reported")
+	}
+	if payload.ChangeType != "UMOUNT" || payload.FilePath != "data" {
+		t.Errorf("got %s %q, want UMOUNT %q", payload.ChangeType, payload.FilePath, "data")
+	}
+	if _, ok := policy.MountContaining("/"); ok {
+		t.Error("replay read the mount table")
+	}
+	if len(mountScans) != 0 {
+		t.Error("replay queued a mount rescan")
+	}
+}
@@ -0,0 +1,52 @@
+package eventcore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"watchd/netlog"
+	"watchd/preprocess"
+)
+
+// setRuleOptions applies the options of the rule including the file of the
+// event: its severity and labels. For CREATE and MODIFY it returns the path
+// to hash if the rule asks for hashing, "" otherwise, see hashLater. paths
+// are the known paths of the file, the first one is checked against the
+// policy.
+func setRuleOptions(payload *netlog.Payload, policy *preprocess.Cache, paths []string, chngType uint32) string {
+
+	if len(paths) == 0 {
+		return ""
+	}
+	opts, ok := policy.RuleOptions(paths[0])
+	if !ok {
+		return ""
+	}
+
+	payload.Severity = opts.Severity
+	payload.Labels = opts.Labels
+	if opts.Hash && (chngType == 1 || chngType == 2) {
+		return paths[0]
+	}
+	return ""
+}
+
+// hashFile returns the sha256 of the regular file at path in hex
+func hashFile(path string) (string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return "", os.ErrInvalid
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
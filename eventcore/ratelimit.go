@@ -0,0 +1,30 @@
+package eventcore
+
+import (
+	"fmt"
+	"time"
+	"watchd/bpfloader"
+	"watchd/netlog"
+)
+
+// processRateLimitedEvent reports the events the kernel dropped for a
+// process (Pid set) or a user over its rate limit. There is no file, the
+// count is in ChangeType[31:4].
+func processRateLimitedEvent(event *bpfloader.FileChangeEvent) (netlog.Payload, bool) {
+
+	var payload netlog.Payload
+
+	dropped := event.ChangeType >> 4
+	if event.Pid != 0 {
+		payload.ChangeType = fmt.Sprintf("RATE_LIMITED [pid %d, %d events]", event.Pid, dropped)
+	} else {
+		payload.ChangeType = fmt.Sprintf("RATE_LIMITED [uid %d, %d events]", event.Uid, dropped)
+	}
+
+	payload.CheckSum = "dummy"
+	payload.Username = resolveUsername(event.Uid)
+	payload.FromIp = getHostIP().String()
+	payload.TimeStamp = time.Now().Format(TimeFormat)
+
+	return payload, true
+}
@@ -0,0 +1,29 @@
+package eventcore
+
+import (
+	"fmt"
+	"time"
+	"watchd/netlog"
+)
+
+// SeverityHigh marks payloads about watchd itself being tampered with
+const SeverityHigh = "high"
+
+// TamperPayload builds the SELF_TAMPER payload for a sign of tampering
+// with watchd, target is the hook, map or file and reason what happened.
+func TamperPayload(target string, reason string) netlog.Payload {
+
+	var payload netlog.Payload
+
+	payload.ChangeType = fmt.Sprintf("SELF_TAMPER [%s]", reason)
+	payload.Severity = SeverityHigh
+	payload.FilePath = target
+
+	payload.CheckSum = "dummy"
+	payload.Username = "Unknown"
+	payload.FromIp = getHostIP().String()
+	payload.TimeStamp = time.Now().Format(TimeFormat)
+	payload.Tty = "None"
+
+	return payload
+}
@@ -0,0 +1,47 @@
+package eventsource
+
+import (
+	"context"
+	"io"
+	"sync"
+	"watchd/bpfloader"
+)
+
+// Channel yields the events sent on a channel. It is meant for tests and
+// for programs embedding watchd that produce events themselves.
+type Channel struct {
+	events <-chan bpfloader.FileChangeEvent
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewChannel returns a source reading from events. Read returns io.EOF
+// once events is closed.
+func NewChannel(events <-chan bpfloader.FileChangeEvent) *Channel {
+	return &Channel{
+		events: events,
+		done:   make(chan struct{}),
+	}
+}
+
+// Read returns the next event sent on the channel.
+func (c *Channel) Read() (bpfloader.FileChangeEvent, error) {
+	select {
+	case <-c.done:
+		return bpfloader.FileChangeEvent{}, ErrClosed
+	case event, ok := <-c.events:
+		if !ok {
+			return bpfloader.FileChangeEvent{}, io.EOF
+		}
+		return event, nil
+	}
+}
+
+// Close unblocks a pending Read. The channel itself is owned by the sender
+// and is not closed.
+func (c *Channel) Close(ctx context.Context) error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
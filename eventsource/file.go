@@ -0,0 +1,129 @@
+package eventsource
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"watchd/bpfloader"
+)
+
+// Recorded event files hold raw ring buffer samples as the kernel
+// produced them, so they can be decoded again by newer versions.
+//
+//	header : "WATCHDR2"
+//	record : int64  timestamp, unix nanoseconds
+//	         uint32 length of the sample
+//	         [length]byte raw sample
+//
+// All integers are little endian.
+// Samples of "WATCHDR1" files are fixed struct EVENT layouts from before
+// the versioned wire format, they can't be decoded anymore.
+var (
+	fileMagic   = [8]byte{'W', 'A', 'T', 'C', 'H', 'D', 'R', '2'}
+	fileMagicV1 = [8]byte{'W', 'A', 'T', 'C', 'H', 'D', 'R', '1'}
+)
+
+// maxRecordSize guards against reading garbage as a huge sample
+const maxRecordSize = 1 << 16
+
+// Record is a single raw sample of a recorded event file.
+type Record struct {
+	Time      time.Time
+	RawSample []byte
+}
+
+// File reads events from a recorded event file.
+type File struct {
+	f  *os.File
+	rd *bufio.Reader
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// OpenFile opens a recorded event file and checks its header.
+func OpenFile(path string) (*File, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rd := bufio.NewReader(f)
+
+	var magic [8]byte
+	if _, err := io.ReadFull(rd, magic[:]); err != nil || magic != fileMagic {
+		f.Close()
+		if magic == fileMagicV1 {
+			return nil, fmt.Errorf("%s was recorded before the versioned event format and can't be replayed", path)
+		}
+		return nil, fmt.Errorf("%s is not a watchd event recording", path)
+	}
+
+	return &File{f: f, rd: rd}, nil
+}
+
+// ReadRecord returns the next raw sample with the time it was recorded.
+// It returns io.EOF at the end of the file.
+func (r *File) ReadRecord() (Record, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return Record{}, ErrClosed
+	}
+
+	var head struct {
+		Timestamp int64
+		Length    uint32
+	}
+	if err := binary.Read(r.rd, binary.LittleEndian, &head); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Record{}, io.EOF
+		}
+		return Record{}, fmt.Errorf("reading record header: %w", err)
+	}
+	if head.Length > maxRecordSize {
+		return Record{}, fmt.Errorf("record of %d bytes exceeds %d", head.Length, maxRecordSize)
+	}
+
+	raw := make([]byte, head.Length)
+	if _, err := io.ReadFull(r.rd, raw); err != nil {
+		return Record{}, fmt.Errorf("reading record: %w", err)
+	}
+
+	return Record{
+		Time:      time.Unix(0, head.Timestamp),
+		RawSample: raw,
+	}, nil
+}
+
+// Read returns the next decoded event of the file. It returns io.EOF at
+// the end of the file.
+func (r *File) Read() (bpfloader.FileChangeEvent, error) {
+	record, err := r.ReadRecord()
+	if err != nil {
+		return bpfloader.FileChangeEvent{}, err
+	}
+	return Decode(record.RawSample)
+}
+
+// Close closes the file.
+func (r *File) Close(ctx context.Context) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.f.Close()
+}
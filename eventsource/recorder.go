@@ -0,0 +1,58 @@
+package eventsource
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Recorder writes raw ring buffer samples to a recorded event file, to be
+// read back with OpenFile.
+type Recorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// CreateRecorder creates or truncates the file at path and writes the header.
+func CreateRecorder(path string) (*Recorder, error) {
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(fileMagic[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Recorder{f: f}, nil
+}
+
+// Write appends a raw sample received at t. Each record is written with a
+// single write, so a crash loses at most the record being written.
+func (r *Recorder) Write(t time.Time, raw []byte) error {
+
+	if len(raw) > maxRecordSize {
+		return errors.New("sample too large to record")
+	}
+
+	buf := make([]byte, 12+len(raw))
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(t.UnixNano()))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(raw)))
+	copy(buf[12:], raw)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.f.Write(buf)
+	return err
+}
+
+// Close closes the file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
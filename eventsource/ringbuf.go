@@ -0,0 +1,194 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+	"watchd/bpfloader"
+
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// RingBuffer reads events from the ring buffers of the eBPF programs.
+//
+// Deletes, creates and the other rare events come through a priority ring
+// buffer, writes through a bulk one. Read always returns a waiting priority
+// event before a bulk one.
+type RingBuffer struct {
+	priority *ringbuf.Reader
+	bulk     *ringbuf.Reader
+	rec      *Recorder
+
+	// samples of the readers, filled by one goroutine per reader
+	prioritySamples chan sample
+	bulkSamples     chan sample
+	done            chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+
+	// RATE_LIMITED summaries
+	limits  *bpfloader.RateLimitTracker
+	ticker  *time.Ticker
+	pending []bpfloader.FileChangeEvent
+}
+
+// sample is a raw ring buffer sample or the error reading it
+type sample struct {
+	raw []byte
+	err error
+}
+
+// NewRingBuffer opens readers on the priority_events and events maps of bpf.
+func NewRingBuffer(bpf *bpfloader.BPF) (*RingBuffer, error) {
+
+	priority, err := ringbuf.NewReader(bpf.Objects.PriorityEvents)
+	if err != nil {
+		return nil, err
+	}
+	bulk, err := ringbuf.NewReader(bpf.Objects.Events)
+	if err != nil {
+		priority.Close()
+		return nil, err
+	}
+
+	r := &RingBuffer{
+		priority:        priority,
+		bulk:            bulk,
+		prioritySamples: make(chan sample),
+		bulkSamples:     make(chan sample),
+		done:            make(chan struct{}),
+	}
+	go r.readSamples(priority, r.prioritySamples)
+	go r.readSamples(bulk, r.bulkSamples)
+
+	return r, nil
+}
+
+// readSamples hands the samples of rd to out until rd is closed. The
+// channels are unbuffered, so at most one sample per buffer is taken out
+// of the kernel ahead of Read.
+func (r *RingBuffer) readSamples(rd *ringbuf.Reader, out chan<- sample) {
+	for {
+		record, err := rd.Read()
+
+		select {
+		case out <- sample{raw: record.RawSample, err: err}:
+		case <-r.done:
+			return
+		}
+
+		if errors.Is(err, ringbuf.ErrClosed) {
+			return
+		}
+	}
+}
+
+// Record makes Read write every raw sample to rec before decoding it.
+// It must be called before the first Read.
+func (r *RingBuffer) Record(rec *Recorder) {
+	r.rec = rec
+}
+
+// SummarizeRateLimits makes Read return the RATE_LIMITED events of t every
+// interval, between the events of the ring buffers. It must be called
+// before the first Read.
+func (r *RingBuffer) SummarizeRateLimits(t *bpfloader.RateLimitTracker, every time.Duration) {
+	r.limits = t
+	r.ticker = time.NewTicker(every)
+}
+
+// Read returns the next event, priority events first. Samples that cannot
+// be decoded are logged and skipped.
+func (r *RingBuffer) Read() (bpfloader.FileChangeEvent, error) {
+
+	var tick <-chan time.Time
+	if r.ticker != nil {
+		tick = r.ticker.C
+	}
+
+	for {
+		if len(r.pending) > 0 {
+			event := r.pending[0]
+			r.pending = r.pending[1:]
+			return event, nil
+		}
+
+		var s sample
+
+		select {
+		case s = <-r.prioritySamples:
+		default:
+			select {
+			case s = <-r.prioritySamples:
+			case s = <-r.bulkSamples:
+			case <-tick:
+				r.collectRateLimits()
+				continue
+			case <-r.done:
+				return bpfloader.FileChangeEvent{}, ErrClosed
+			}
+		}
+
+		if s.err != nil {
+			if errors.Is(s.err, ringbuf.ErrClosed) {
+				return bpfloader.FileChangeEvent{}, ErrClosed
+			}
+			return bpfloader.FileChangeEvent{}, s.err
+		}
+
+		if r.rec != nil {
+			if err := r.rec.Write(time.Now(), s.raw); err != nil {
+				log.Printf("recording event: %v", err)
+			}
+		}
+
+		event, err := Decode(s.raw)
+		if errors.Is(err, bpfloader.ErrUnknownWireVersion) {
+			log.Printf("ERROR: dropping event: %v, the loaded eBPF objects don't match this watchd", err)
+			continue
+		}
+		if err != nil {
+			log.Printf("parsing event: %v", err)
+			continue
+		}
+		return event, nil
+	}
+}
+
+// collectRateLimits queues the RATE_LIMITED events since the last call. The
+// events are recorded like ring buffer samples, so a replay shows them too.
+func (r *RingBuffer) collectRateLimits() {
+
+	events, err := r.limits.Collect()
+	if err != nil {
+		log.Printf("collecting rate limited events: %v", err)
+	}
+
+	now := time.Now()
+	for i := range events {
+		if r.rec != nil {
+			if err := r.rec.Write(now, bpfloader.EncodeEvent(&events[i])); err != nil {
+				log.Printf("recording event: %v", err)
+			}
+		}
+	}
+	r.pending = append(r.pending, events...)
+}
+
+// Close closes both ring buffer readers. Calls after the first return its
+// result.
+func (r *RingBuffer) Close(ctx context.Context) error {
+	return closeWithContext(ctx, func() error {
+		r.closeOnce.Do(func() {
+			close(r.done)
+			if r.ticker != nil {
+				r.ticker.Stop()
+			}
+			r.closeErr = errors.Join(r.priority.Close(), r.bulk.Close())
+		})
+		return r.closeErr
+	})
+}
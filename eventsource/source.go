@@ -0,0 +1,51 @@
+// Package eventsource decouples the event pipeline from where events come from.
+//
+// A Source yields decoded bpfloader.FileChangeEvent values. watchd ships
+// sources for the eBPF ring buffer, for recorded event files and for an
+// in-memory channel. Programs embedding watchd can provide their own.
+package eventsource
+
+import (
+	"context"
+	"errors"
+	"watchd/bpfloader"
+)
+
+// ErrClosed is returned by Read once the source is closed.
+var ErrClosed = errors.New("event source closed")
+
+// Source yields decoded file change events.
+type Source interface {
+	// Read blocks until the next event is available.
+	//
+	// It returns ErrClosed once Close was called, and io.EOF when a finite
+	// source has no more events.
+	Read() (bpfloader.FileChangeEvent, error)
+
+	// Close stops the source and unblocks a pending Read. It returns
+	// ctx.Err() if ctx is done before the source is released.
+	Close(ctx context.Context) error
+}
+
+// Decode parses a raw ring buffer sample, see bpfloader.DecodeEvent.
+func Decode(raw []byte) (bpfloader.FileChangeEvent, error) {
+	var event bpfloader.FileChangeEvent
+	err := bpfloader.DecodeEvent(raw, &event)
+	return event, err
+}
+
+// closeWithContext runs closeFn and waits for it as long as ctx allows.
+func closeWithContext(ctx context.Context, closeFn func() error) error {
+
+	done := make(chan error, 1)
+	go func() {
+		done <- closeFn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,153 @@
+package eventsource
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"watchd/bpfloader"
+)
+
+func testEvent(name string, changeType uint32) bpfloader.FileChangeEvent {
+	var event bpfloader.FileChangeEvent
+	event.InodeNumber = 42
+	event.Dev = 8<<20 | 1
+	event.ChangeType = changeType
+	copy(event.Filename[:], name)
+	return event
+}
+
+func TestChannel(t *testing.T) {
+
+	ch := make(chan bpfloader.FileChangeEvent, 1)
+	src := NewChannel(ch)
+
+	ch <- testEvent("a.txt", 1)
+	event, err := src.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.InodeNumber != 42 || event.ChangeType != 1 {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	// Close unblocks a pending Read
+	done := make(chan error)
+	go func() {
+		_, err := src.Read()
+		done <- err
+	}()
+	src.Close(context.Background())
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read not unblocked by Close")
+	}
+
+	// closed channel is the end of the source
+	close(ch)
+	if _, err := NewChannel(ch).Read(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+
+	event := testEvent("b.txt", 3)
+	raw := bpfloader.EncodeEvent(&event)
+
+	var buf bytes.Buffer
+	buf.Write(fileMagic[:])
+	binary.Write(&buf, binary.LittleEndian, int64(1700000000000000000))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(raw)))
+	buf.Write(raw)
+
+	path := filepath.Join(t.TempDir(), "events.bin")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close(context.Background())
+
+	got, err := src.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != event {
+		t.Errorf("got %+v, want %+v", got, event)
+	}
+
+	if _, err := src.Read(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestOpenFileRejectsGarbage(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "garbage.bin")
+	if err := os.WriteFile(path, []byte("not a recording"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(path); err == nil {
+		t.Error("expected error for a file without header")
+	}
+}
+
+func TestRecorder(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "events.bin")
+	rec, err := CreateRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []bpfloader.FileChangeEvent{
+		testEvent("c.txt", 1),
+		testEvent("c.txt", 2|(12<<4)),
+	}
+	when := time.Unix(1700000000, 500)
+	for _, event := range events {
+		if err := rec.Write(when, bpfloader.EncodeEvent(&event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close(context.Background())
+
+	for _, want := range events {
+		record, err := src.ReadRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !record.Time.Equal(when) {
+			t.Errorf("time: got %v, want %v", record.Time, when)
+		}
+		got, err := Decode(record.RawSample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
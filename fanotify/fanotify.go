@@ -0,0 +1,470 @@
+// Package fanotify provides a file monitoring backend built on fanotify(7)
+// for hosts where loading eBPF programs is not allowed.
+//
+// It marks every filesystem holding a D or IF rule and turns the fanotify
+// events back into bpfloader.FileChangeEvent values, so they go through the
+// same eventcore pipeline as the events of the eBPF programs.
+//
+// fanotify does not report the number of bytes written, so MODIFY events
+// carry 0 bytes. A rename is reported as DELETE of the old name followed by
+// CREATE of the new one.
+package fanotify
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"watchd/bpfloader"
+	"watchd/eventsource"
+	"watchd/preprocess"
+
+	"golang.org/x/sys/unix"
+)
+
+// change types, same values as in src/mtypes.h
+const (
+	changeCreate = 0x1
+	changeModify = 0x2
+	changeDelete = 0x3
+)
+
+// dirSize is reported as the size of new directories, DIR_SIZE in src/maps.h
+const dirSize = 4096
+
+const markMask = unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_MODIFY |
+	unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO | unix.FAN_ONDIR
+
+// Watcher reads fanotify events for the filesystems of a policy. It is an
+// eventsource.Source.
+type Watcher struct {
+	fd   int
+	file *os.File
+
+	// mounts holds an fd per marked filesystem, keyed by fsid, to resolve
+	// the directory handles of the events with open_by_handle_at
+	mounts map[[2]int32]int
+
+	// tracked plays the role of the kernel policy_table, it is updated on
+	// create, delete and modify like the eBPF programs do. mu guards it and
+	// paths against Reload.
+	mu      sync.Mutex
+	tracked bpfloader.TrackedFileMap
+	paths   *preprocess.PathCache
+
+	buf     []byte
+	pending []bpfloader.FileChangeEvent
+
+	closeOnce sync.Once
+	closed    chan struct{} // closed once Close released everything
+	closeErr  error
+}
+
+// NewWatcher creates a fanotify group and marks the filesystem of every D
+// and IF rule of policy. It requires CAP_SYS_ADMIN.
+func NewWatcher(policy *preprocess.Cache) (*Watcher, error) {
+
+	fd, err := unix.FanotifyInit(
+		unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_REPORT_DFID_NAME,
+		unix.O_RDONLY|unix.O_LARGEFILE,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("fanotify_init: %w", err)
+	}
+
+	w := &Watcher{
+		fd: fd,
+		// non blocking, so Read goes through the runtime poller and Close
+		// unblocks it
+		file:    os.NewFile(uintptr(fd), "fanotify"),
+		mounts:  make(map[[2]int32]int),
+		tracked: make(bpfloader.TrackedFileMap, len(policy.LookupTable)),
+		paths:   &policy.PathCache,
+		buf:     make([]byte, 64*1024),
+	}
+
+	for k, v := range policy.LookupTable {
+		w.tracked[k] = v
+	}
+
+	for _, root := range policy.WatchRoots() {
+		if err := w.mark(root); err != nil {
+			log.Printf("WARN: fanotify mark %s: %v", root, err)
+		}
+	}
+
+	if len(w.mounts) == 0 {
+		w.Close(context.Background())
+		return nil, errors.New("no filesystem could be marked")
+	}
+
+	return w, nil
+}
+
+// mark adds the filesystem holding path to the fanotify group
+func (w *Watcher) mark(path string) error {
+
+	if w.mounts == nil {
+		return eventsource.ErrClosed
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return err
+	}
+	fsid := [2]int32{st.Fsid.Val[0], st.Fsid.Val[1]}
+	if _, ok := w.mounts[fsid]; ok {
+		return nil
+	}
+
+	if err := unix.FanotifyMark(w.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, markMask, unix.AT_FDCWD, path); err != nil {
+		return err
+	}
+
+	mountFD, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	w.mounts[fsid] = mountFD
+
+	return nil
+}
+
+// Read blocks until the next event of a tracked file is available.
+//
+// It returns eventsource.ErrClosed once the watcher is closed.
+func (w *Watcher) Read() (bpfloader.FileChangeEvent, error) {
+
+	for len(w.pending) == 0 {
+		n, err := w.file.Read(w.buf)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return bpfloader.FileChangeEvent{}, eventsource.ErrClosed
+			}
+			return bpfloader.FileChangeEvent{}, err
+		}
+		w.mu.Lock()
+		w.parse(w.buf[:n])
+		w.mu.Unlock()
+	}
+
+	event := w.pending[0]
+	w.pending = w.pending[1:]
+	return event, nil
+}
+
+// Reload switches to the policy next, which replaces the current one by
+// diff. Filesystems of new D and IF rules are marked, the marks of the
+// current ones stay.
+func (w *Watcher) Reload(next *preprocess.Cache, diff preprocess.PolicyDiff) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for k, v := range diff.Added {
+		w.tracked[k] = v
+	}
+	for k := range diff.Removed {
+		delete(w.tracked, k)
+	}
+	for k, v := range diff.Changed {
+		if live, ok := w.tracked[k]; ok {
+			live.EventMask = v.EventMask
+			w.tracked[k] = live
+		}
+	}
+	w.paths = &next.PathCache
+
+	for _, root := range next.WatchRoots() {
+		if err := w.mark(root); err != nil {
+			log.Printf("WARN: fanotify mark %s: %v", root, err)
+		}
+	}
+}
+
+// Close releases the fanotify group and the mount fds. It returns ctx.Err()
+// if ctx is done first, the release goes on. Calls after the first return
+// its result.
+func (w *Watcher) Close(ctx context.Context) error {
+
+	w.closeOnce.Do(func() {
+		w.closed = make(chan struct{})
+		go func() {
+			defer close(w.closed)
+
+			w.mu.Lock()
+			for _, fd := range w.mounts {
+				unix.Close(fd)
+			}
+			w.mounts = nil
+			w.mu.Unlock()
+
+			w.closeErr = w.file.Close()
+		}()
+	})
+
+	select {
+	case <-w.closed:
+		return w.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parse decodes a buffer of fanotify_event_metadata records into pending
+func (w *Watcher) parse(buf []byte) {
+
+	for len(buf) >= unix.FAN_EVENT_METADATA_LEN {
+
+		eventLen := binary.NativeEndian.Uint32(buf[0:4])
+		vers := buf[4]
+		metaLen := binary.NativeEndian.Uint16(buf[6:8])
+		mask := binary.NativeEndian.Uint64(buf[8:16])
+		fd := int32(binary.NativeEndian.Uint32(buf[16:20]))
+		pid := int32(binary.NativeEndian.Uint32(buf[20:24]))
+
+		if vers != unix.FANOTIFY_METADATA_VERSION {
+			log.Printf("fanotify: unsupported metadata version %d", vers)
+			return
+		}
+		if uint32(metaLen) > eventLen || int(eventLen) > len(buf) {
+			log.Printf("fanotify: truncated event")
+			return
+		}
+
+		if fd >= 0 {
+			unix.Close(int(fd))
+		}
+
+		if mask&unix.FAN_Q_OVERFLOW != 0 {
+			log.Printf("fanotify: event queue overflow, events lost")
+		} else if event, ok := w.decode(mask, pid, buf[metaLen:eventLen]); ok {
+			w.pending = append(w.pending, event)
+		}
+
+		buf = buf[eventLen:]
+	}
+}
+
+// decode turns one event into a FileChangeEvent. It returns false for
+// events on files that are not tracked, and for MODIFY if their event mask
+// leaves it out. A CREATE or DELETE the mask leaves out is TrackOnly, like
+// the eBPF hooks send it.
+func (w *Watcher) decode(mask uint64, pid int32, info []byte) (bpfloader.FileChangeEvent, bool) {
+
+	var event bpfloader.FileChangeEvent
+
+	dir, name, ok := w.resolveDFIDName(info)
+	if !ok {
+		return event, false
+	}
+	path := filepath.Join(dir.path, name)
+
+	event.ParentInodeNumber = dir.key.InodeNumber
+	event.ParentDev = dir.key.Dev
+
+	switch {
+	case mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0:
+		parent, ok := w.tracked[dir.key]
+		if !ok {
+			return event, false
+		}
+		key, size, isDir, err := statKey(path)
+		if err != nil {
+			return event, false
+		}
+		if isDir {
+			size = dirSize
+		}
+		event.ChangeType = changeCreate
+		event.InodeNumber, event.Dev = key.InodeNumber, key.Dev
+		event.AfterSize = size
+		w.tracked[key] = bpfloader.TrackedFileValue{FileSize: size, EventMask: parent.EventMask}
+		event.TrackOnly = !parent.Reports(changeCreate)
+
+	case mask&(unix.FAN_DELETE|unix.FAN_MOVED_FROM) != 0:
+		child, ok := w.paths.Child(preprocess.CacheKey{
+			Inode_number: dir.key.InodeNumber,
+			Dev_id:       dir.key.Dev,
+		}, name)
+		if !ok {
+			return event, false
+		}
+		key := bpfloader.TrackedFileKey{
+			InodeNumber: child.Inode_number,
+			Dev:         child.Dev_id,
+		}
+		value, ok := w.tracked[key]
+		if !ok {
+			return event, false
+		}
+		event.ChangeType = changeDelete
+		event.InodeNumber, event.Dev = key.InodeNumber, key.Dev
+		event.BeforeSize = value.FileSize
+		delete(w.tracked, key)
+		w.paths.Delete(child)
+		event.TrackOnly = !value.Reports(changeDelete)
+
+	case mask&unix.FAN_MODIFY != 0:
+		key, size, _, err := statKey(path)
+		if err != nil {
+			return event, false
+		}
+		value, ok := w.tracked[key]
+		if !ok {
+			return event, false
+		}
+		event.ChangeType = changeModify
+		event.InodeNumber, event.Dev = key.InodeNumber, key.Dev
+		event.BeforeSize = value.FileSize
+		event.AfterSize = size
+		value.FileSize = size
+		w.tracked[key] = value
+		if !value.Reports(changeModify) {
+			return event, false
+		}
+
+	default:
+		return event, false
+	}
+
+	event.Pid = uint32(pid)
+	event.Uid, event.TtyMajor, event.TtyIndex = procInfo(pid)
+	copy(event.Filename[:len(event.Filename)-1], name)
+
+	return event, true
+}
+
+type resolvedDir struct {
+	path string
+	key  bpfloader.TrackedFileKey
+}
+
+// resolveDFIDName finds the FAN_EVENT_INFO_TYPE_DFID_NAME record in info and
+// resolves its directory handle to a path and a policy key.
+func (w *Watcher) resolveDFIDName(info []byte) (resolvedDir, string, bool) {
+
+	var dir resolvedDir
+
+	for len(info) >= 4 {
+		infoType := info[0]
+		infoLen := int(binary.NativeEndian.Uint16(info[2:4]))
+		if infoLen < 4 || infoLen > len(info) {
+			return dir, "", false
+		}
+		record := info[:infoLen]
+		info = info[infoLen:]
+
+		if infoType != unix.FAN_EVENT_INFO_TYPE_DFID_NAME || len(record) < 20 {
+			continue
+		}
+
+		// header, __kernel_fsid_t, struct file_handle, name
+		fsid := [2]int32{
+			int32(binary.NativeEndian.Uint32(record[4:8])),
+			int32(binary.NativeEndian.Uint32(record[8:12])),
+		}
+		handleBytes := int(binary.NativeEndian.Uint32(record[12:16]))
+		handleType := int32(binary.NativeEndian.Uint32(record[16:20]))
+		if 20+handleBytes > len(record) {
+			return dir, "", false
+		}
+		handle := record[20 : 20+handleBytes]
+		name := preprocess.CString(record[20+handleBytes:])
+
+		mountFD, ok := w.mounts[fsid]
+		if !ok {
+			return dir, "", false
+		}
+
+		fd, err := unix.OpenByHandleAt(mountFD, unix.NewFileHandle(handleType, handle), unix.O_PATH|unix.O_CLOEXEC)
+		if err != nil {
+			// directory is gone already
+			return dir, "", false
+		}
+		defer unix.Close(fd)
+
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			return dir, "", false
+		}
+		path, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+		if err != nil {
+			return dir, "", false
+		}
+
+		dir.path = path
+		dir.key = bpfloader.TrackedFileKey{
+			InodeNumber: st.Ino,
+			Dev:         preprocess.KernelDev(&st),
+		}
+		return dir, name, true
+	}
+
+	return dir, "", false
+}
+
+// statKey returns the policy key and size of path
+func statKey(path string) (bpfloader.TrackedFileKey, int64, bool, error) {
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return bpfloader.TrackedFileKey{}, 0, false, err
+	}
+	key := bpfloader.TrackedFileKey{
+		InodeNumber: st.Ino,
+		Dev:         preprocess.KernelDev(&st),
+	}
+	return key, st.Size, st.Mode&syscall.S_IFMT == syscall.S_IFDIR, nil
+}
+
+// procInfo returns the real uid and controlling tty of pid. The process may
+// be gone by the time the event is read, then uid is 0 and there is no tty.
+func procInfo(pid int32) (uint32, int32, uint32) {
+
+	var uid uint32
+	var ttyMajor int32 = -1
+	var ttyIndex uint32
+
+	proc := "/proc/" + strconv.Itoa(int(pid))
+
+	if f, err := os.Open(proc + "/status"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// Uid: <real> <effective> <saved> <fs>
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "Uid:" {
+				if v, err := strconv.ParseUint(fields[1], 10, 32); err == nil {
+					uid = uint32(v)
+				}
+				break
+			}
+		}
+		f.Close()
+	}
+
+	if data, err := os.ReadFile(proc + "/stat"); err == nil {
+		// pid (comm) state ppid pgrp session tty_nr ...
+		// comm may hold spaces and parentheses, so split after the last ')'
+		stat := string(data)
+		if i := strings.LastIndexByte(stat, ')'); i >= 0 {
+			fields := strings.Fields(stat[i+1:])
+			if len(fields) >= 5 {
+				if ttyNr, err := strconv.ParseUint(fields[4], 10, 32); err == nil && ttyNr != 0 {
+					ttyMajor = int32((ttyNr >> 8) & 0xfff)
+					ttyIndex = uint32((ttyNr & 0xff) | ((ttyNr >> 12) & 0xfff00))
+				}
+			}
+		}
+	}
+
+	return uid, ttyMajor, ttyIndex
+}
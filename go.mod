@@ -4,11 +4,13 @@ go 1.24.0
 
 toolchain go1.24.12
 
-require github.com/cilium/ebpf v0.20.0
+require (
+	github.com/cilium/ebpf v0.20.0
+	golang.org/x/sys v0.37.0
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/cobra v1.10.2 // indirect
 	github.com/spf13/pflag v1.0.9 // indirect
-	golang.org/x/sys v0.37.0 // indirect
 )
@@ -1,34 +1,57 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 	"watchd/bpfloader"
 	"watchd/eventcore"
+	"watchd/eventsource"
+	"watchd/fanotify"
 	"watchd/netlog"
 	"watchd/preprocess"
+	"watchd/selfcheck"
 
-	"github.com/cilium/ebpf/ringbuf"
 	"github.com/spf13/cobra"
 )
 
 var (
 	config  string
 	apifile string
+	btfPath string
+	backend string
+	record  string
+
+	pidRateLimit string
+	uidRateLimit string
+
+	ringbufSize         string
+	priorityRingbufSize string
+
+	selfCheckInterval time.Duration
+	reattach          bool
+	heartbeatInterval time.Duration
+	controlSocket     string
+	autoReload        bool
 
 	version   = "1.0.0"
 	buildDate = "2026-02-16"
 	gitCommit = "dev"
 )
 
+// how often the drop counters of the rate limits are summarized
+const rateSummaryInterval = 10 * time.Second
+
 func main() {
 
 	rootCmd := &cobra.Command{
@@ -51,6 +74,13 @@ func main() {
 		"Path to API JSON file",
 	)
 
+	rootCmd.PersistentFlags().StringVar(
+		&controlSocket,
+		"control-socket",
+		"/run/watchd.sock",
+		"Unix socket run listens on for watchd reload, empty disables",
+	)
+
 	// ---------------- RUN ----------------
 	runCmd := &cobra.Command{
 		Use:   "run",
@@ -63,6 +93,23 @@ func main() {
 			if os.Geteuid() != 0 {
 				log.Fatal("requires root")
 			}
+			if backend != "ebpf" && backend != "fanotify" {
+				log.Fatalf("unknown backend %q, use ebpf or fanotify", backend)
+			}
+			if record != "" && backend != "ebpf" {
+				log.Fatal("--record needs the ebpf backend")
+			}
+			pidLimit, err := bpfloader.ParseRateLimit(pidRateLimit)
+			if err != nil {
+				log.Fatalf("--pid-rate-limit: %v", err)
+			}
+			uidLimit, err := bpfloader.ParseRateLimit(uidRateLimit)
+			if err != nil {
+				log.Fatalf("--uid-rate-limit: %v", err)
+			}
+			if (pidLimit.Rate != 0 || uidLimit.Rate != 0) && backend != "ebpf" {
+				log.Fatal("rate limits need the ebpf backend")
+			}
 			// Vaidate command line arguments
 			if apifile != "" {
 				if err := netlog.InitApiAuth(apifile); err != nil {
@@ -81,92 +128,141 @@ func main() {
 				log.Fatalf("parsing policy: %v", err)
 			}
 
-			/* Load eBPF objects */
-			bpf := bpfloader.InitBPF()
-			if err := bpf.Load(bpf.Objects, nil); err != nil {
-				log.Fatalf("loading eBPF objects: %v", err)
-			}
-
-			/* Populate policy map */
-			count, err := policy.LoadTrackedFileMap(bpf)
-			if err != nil {
-				log.Printf("loading policy map: %v", err)
-			}
-			if count == 0 {
-				log.Printf("No policy loaded")
-				return
-			}
+			var src eventsource.Source
+			var bpf *bpfloader.BPF
+			var report *bpfloader.AttachReport
+			live := &livePolicy{policy: &policy}
+			reloads := &reloader{live: live}
+			reloads.hash, _ = preprocess.HashConfig(config)
+			log.Printf("Policy %s loaded from %s", shortHash(reloads.hash), config)
+
+			if backend == "fanotify" {
+				w, err := fanotify.NewWatcher(&policy)
+				if err != nil {
+					log.Fatalf("starting fanotify backend: %v", err)
+				}
+				src = w
+				reloads.watcher = w
+				log.Println("Successfully started fanotify backend. Monitoring VFS operations...")
+			} else {
+				bpf, report = loadBPF(&policy)
+				if bpf == nil {
+					return
+				}
+				reloads.bpf = bpf
 
-			/* Attach eBPF programs */
-			links, err := bpf.AttachPrograms()
-			if err != nil {
-				log.Printf("ERROR: Couldn't attach eBPF programs : %v", err)
-				return
-			}
+				/* Create ring buffer reader */
+				rb, err := eventsource.NewRingBuffer(bpf)
+				if err != nil {
+					log.Fatalf("opening ring buffer reader: %v", err)
+				}
+				src = rb
 
-			/* Create ring buffer reader */
-			rd, err := ringbuf.NewReader(bpf.Objects.Events)
-			if err != nil {
-				log.Fatalf("opening ring buffer reader: %v", err)
-			}
+				if pidLimit.Rate != 0 || uidLimit.Rate != 0 {
+					if err := bpf.SetRateLimits(pidLimit, uidLimit); err != nil {
+						log.Fatalf("setting rate limits: %v", err)
+					}
+					rb.SummarizeRateLimits(bpfloader.NewRateLimitTracker(bpf), rateSummaryInterval)
+					log.Printf("Rate limits: per process %s, per user %s", pidLimit, uidLimit)
+				}
 
-			// Cleanup
-			defer func() {
+				if record != "" {
+					rec, err := eventsource.CreateRecorder(record)
+					if err != nil {
+						log.Fatalf("creating recording: %v", err)
+					}
+					rb.Record(rec)
+					log.Printf("Recording raw events to %s", record)
 
-				// Cleanup ring buffer reader
-				if rd != nil {
-					rd.Close()
+					// runs after the source is closed
+					defer rec.Close()
 				}
 
-				// Cleanup attached programs
-				for _, link := range links {
-					if link != nil {
-						link.Close()
+				// Cleanup attached programs and loaded objects, after the
+				// source is closed
+				defer func() {
+					for _, h := range report.Hooks {
+						if h.Link != nil {
+							h.Link.Close()
+						}
 					}
-				}
-				// Cleanup loaded objects
-				bpf.Objects.Close()
+					bpf.UnpinPolicy()
+					bpf.Objects.Close()
+				}()
 
-			}()
+				log.Println("Successfully loaded eBPF program. Monitoring VFS operations...")
+			}
 
-			log.Println("Successfully loaded eBPF program. Monitoring VFS operations...")
+			// Cleanup event source
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := src.Close(ctx); err != nil {
+					log.Printf("closing event source: %v", err)
+				}
+			}()
 
 			/* Handle CTRL-C */
 			sig := make(chan os.Signal, 1)
 			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
-			/* Read events from ring buffer in a goroutine */
-			go func() {
-				for {
-					record, err := rd.Read()
-					if err != nil {
-						if errors.Is(err, ringbuf.ErrClosed) {
-							log.Println("Ring buffer closed, stopping event reader")
-							return
-						}
-						log.Printf("reading from ring buffer: %v", err)
-						continue
-					}
-					log.Printf("event occurred\n")
+			/* Watch for tampering with watchd, before events change the policy */
+			if selfCheckInterval > 0 {
+				self, err := os.Executable()
+				if err != nil {
+					log.Printf("WARN: self check can't find the watchd binary: %v", err)
+				}
+				checker := selfcheck.New(bpf, report, &policy, []string{self, config, apifile}, reattach)
+				reloads.checker = checker
+				go runSelfCheck(checker, enableNet)
 
-					// Pstringarse the event
-					var event bpfloader.FileChangeEvent
-					if err := binary.Read(bytes.NewReader(record.RawSample), binary.LittleEndian, &event); err != nil {
-						log.Printf("parsing event: %v", err)
-						continue
-					}
+				// runs before the hooks are closed, the checker re-attaches them
+				defer checker.Close()
+			}
 
-					// Process and display the event
-					payload, ok := eventcore.ProcessEvent(&event, bpf, &policy)
-					if ok {
-						eventcore.PrintPayload(payload)
-						if enableNet {
-							netlog.SendPOST(payload)
-						}
-					}
+			/* Prove the pipeline is alive */
+			if bpf != nil && heartbeatInterval > 0 {
+				if err := bpf.LoadHeartbeat(); err != nil {
+					log.Printf("WARN: %v, running without heartbeats", err)
+				} else {
+					go runHeartbeat(bpf)
+				}
+			}
+
+			/* Read events in a goroutine */
+			go processEvents(src, bpf, live, enableNet)
+			go eventcore.HashFiles(func(payload netlog.Payload) {
+				sendPayload(payload, enableNet)
+			})
+			if bpf != nil {
+				go eventcore.ScanMounts(bpf, live.with, func(payload netlog.Payload) {
+					sendPayload(payload, enableNet)
+				})
+			}
 
+			/* Reload the policy on SIGHUP and on watchd reload */
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			go func() {
+				for range hup {
+					reloads.logReload("SIGHUP", false)
 				}
 			}()
+			if autoReload {
+				if err := reloads.watchConfig(); err != nil {
+					log.Printf("WARN: watching %s for changes: %v", config, err)
+				}
+			}
+			if controlSocket != "" {
+				l, err := listenControl(controlSocket)
+				if err != nil {
+					log.Printf("WARN: control socket %s: %v, reload with SIGHUP only", controlSocket, err)
+				} else {
+					// closing removes the socket
+					defer l.Close()
+					go reloads.serveControl(l)
+				}
+			}
 
 			/* Wait for signal */
 			<-sig
@@ -177,6 +273,83 @@ func main() {
 		},
 	}
 
+	runCmd.Flags().StringVar(
+		&backend,
+		"backend",
+		"ebpf",
+		"Monitoring backend: ebpf or fanotify (for hosts without eBPF)",
+	)
+
+	runCmd.Flags().StringVar(
+		&record,
+		"record",
+		"",
+		"Write every raw ring buffer sample to this file, see replay",
+	)
+
+	runCmd.Flags().StringVar(
+		&pidRateLimit,
+		"pid-rate-limit",
+		"",
+		"Events per second per process as rate[:burst], excess events are summarized as RATE_LIMITED (ebpf backend)",
+	)
+
+	runCmd.Flags().StringVar(
+		&uidRateLimit,
+		"uid-rate-limit",
+		"",
+		"Events per second per user as rate[:burst], excess events are summarized as RATE_LIMITED (ebpf backend)",
+	)
+
+	runCmd.Flags().StringVar(
+		&ringbufSize,
+		"ringbuf-size",
+		"",
+		"Size of the bulk (MODIFY) ring buffer, a power of two like 16M (default 4M)",
+	)
+
+	runCmd.Flags().StringVar(
+		&priorityRingbufSize,
+		"priority-ringbuf-size",
+		"",
+		"Size of the ring buffer for all other events, a power of two like 4M (default 1M)",
+	)
+
+	runCmd.Flags().DurationVar(
+		&selfCheckInterval,
+		"self-check-interval",
+		30*time.Second,
+		"How often to check for detached hooks, policy table tampering and changes to watchd's own files, 0 disables",
+	)
+
+	runCmd.Flags().DurationVar(
+		&heartbeatInterval,
+		"heartbeat-interval",
+		time.Minute,
+		"How often the eBPF programs send a HEARTBEAT with event counters through the ring buffer, 0 disables",
+	)
+
+	runCmd.Flags().BoolVar(
+		&autoReload,
+		"auto-reload",
+		true,
+		"Reload the policy when the config file changes on disk",
+	)
+
+	runCmd.Flags().BoolVar(
+		&reattach,
+		"reattach",
+		false,
+		"Re-attach hooks found detached by the self check",
+	)
+
+	runCmd.Flags().StringVar(
+		&btfPath,
+		"btf",
+		"",
+		"Path to a kernel BTF file or a directory of BTFHub files (default: built-in BTF)",
+	)
+
 	// ---------------- VALIDATE ----------------
 	validateCmd := &cobra.Command{
 		Use:   "validate",
@@ -190,15 +363,194 @@ func main() {
 				return fmt.Errorf("config file path is required, use --config")
 			}
 
-			tokens, err := preprocess.ReadConfig(cfgPath)
+			// the error classes are the exit codes, see docs/parser.txt
+			warnings, err := preprocess.ValidateConfig(cfgPath)
+			for _, w := range warnings {
+				fmt.Println(w)
+			}
+			if err != nil {
+				return fmt.Errorf("error validating config file: %w", err)
+			}
+
+			fmt.Printf("Config file is valid (%d warnings)\n", len(warnings))
+			return nil
+		},
+	}
+
+	// ---------------- RELOAD ----------------
+	reloadCmd := &cobra.Command{
+		Use:   "reload",
+		Short: "Make the running watchd re-read its config, the current policy stays if the new one is broken",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return requestReload(controlSocket)
+		},
+	}
+
+	// ---------------- EXPLAIN ----------------
+	explainCmd := &cobra.Command{
+		Use:   "explain <path>",
+		Short: "Show which rule of the policy governs a path",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			policy, err := preprocess.LoadRules(config)
+			if err != nil {
+				return fmt.Errorf("error validating config file: %w", err)
+			}
+
+			path, err := filepath.Abs(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Print(policy.Explain(path))
+			fmt.Printf("  policy_table: %s\n", policyTableStatus(path))
+			return nil
+		},
+	}
+
+	// ---------------- PLAN ----------------
+	var planFormat string
+	planCmd := &cobra.Command{
+		Use:   "plan",
+		Short: "Walk the policy without loading eBPF and list what it would watch",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			if planFormat != "text" && planFormat != "json" {
+				return fmt.Errorf("--format must be text or json")
+			}
+
+			plan, err := preprocess.BuildPlan(config, bpfloader.PolicyCapacity())
+			if err != nil {
+				return fmt.Errorf("error validating config file: %w", err)
+			}
+
+			if planFormat == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				err = enc.Encode(plan)
+			} else {
+				err = plan.WriteText(os.Stdout)
+			}
+			if err != nil {
+				return err
+			}
+
+			if over := plan.Over(); over > 0 {
+				return &preprocess.PolicyError{
+					Code:    preprocess.ExitResource,
+					Message: fmt.Sprintf("policy needs %d entries, %d more than the policy table holds", plan.Entries, over),
+					Hint:    "narrow the D rules or exclude more",
+				}
+			}
+			return nil
+		},
+	}
+	planCmd.Flags().StringVar(&planFormat, "format", "text", "Output format, text or json")
+
+	// ---------------- POLICY ----------------
+	policyCmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Work with policy files",
+	}
+
+	var convertOutput string
+	convertCmd := &cobra.Command{
+		Use:   "convert [config.txt]",
+		Short: "Translate a policy from the line format to structured JSON, --config by default",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			src := config
+			if len(args) == 1 {
+				src = args[0]
+			}
+			policy, err := preprocess.ConvertConfig(src)
+			if err != nil {
+				return fmt.Errorf("converting %s: %w", src, err)
+			}
+
+			out := os.Stdout
+			if convertOutput != "" {
+				f, err := os.OpenFile(convertOutput, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(policy); err != nil {
+				return err
+			}
+			if convertOutput != "" {
+				fmt.Fprintf(os.Stderr, "%d rules written to %s\n", len(policy.Rules), convertOutput)
+			}
+			return nil
+		},
+	}
+	convertCmd.Flags().StringVarP(&convertOutput, "output", "o", "", "File to write, it must not exist (default: stdout)")
+	policyCmd.AddCommand(convertCmd)
+
+	// ---------------- REPLAY ----------------
+	replayCmd := &cobra.Command{
+		Use:   "replay <recording>",
+		Short: "Replay events recorded with run --record, without loading eBPF",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			var enableNet bool
+			if apifile != "" {
+				if err := netlog.InitApiAuth(apifile); err != nil {
+					return fmt.Errorf("initializing API auth: %w", err)
+				}
+				enableNet = true
+			}
+
+			// files of the policy don't have to exist here, the filters
+			// still apply
+			policy, err := preprocess.ParseConfig(config)
+			if errors.Is(err, preprocess.ErrEmptyPolicy) {
+				log.Printf("WARN: %v", err)
+			} else if err != nil {
+				return fmt.Errorf("parsing policy: %w", err)
+			}
+
+			src, err := eventsource.OpenFile(args[0])
 			if err != nil {
-				return fmt.Errorf("error reading config file: %s", err)
+				return err
 			}
-			if err := preprocess.SyntaxValidation(tokens); err != nil {
-				return fmt.Errorf("error validating config file: %s", err)
+			defer src.Close(context.Background())
+
+			var count int
+			for {
+				record, err := src.ReadRecord()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					return err
+				}
+
+				event, err := eventsource.Decode(record.RawSample)
+				if err != nil {
+					log.Printf("parsing event: %v", err)
+					continue
+				}
+				count++
+
+				payload, ok := eventcore.ReplayEvent(&event, &policy)
+				if ok {
+					payload.TimeStamp = record.Time.Format(eventcore.TimeFormat)
+					sendPayload(payload, enableNet)
+				}
 			}
 
-			fmt.Println("Config file is valid")
+			log.Printf("Replayed %d events from %s", count, args[0])
 			return nil
 		},
 	}
@@ -239,10 +591,162 @@ func main() {
 	// Add commands
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(reloadCmd)
+	rootCmd.AddCommand(explainCmd)
+	rootCmd.AddCommand(planCmd)
+	rootCmd.AddCommand(policyCmd)
+	rootCmd.AddCommand(replayCmd)
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(statusCmd)
 
 	if err := rootCmd.Execute(); err != nil {
-		os.Exit(1)
+		os.Exit(preprocess.ExitCode(err))
+	}
+}
+
+// loadBPF loads the eBPF objects, populates the policy map and attaches the
+// programs. It returns a nil BPF if nothing could be attached.
+func loadBPF(policy *preprocess.Cache) (*bpfloader.BPF, *bpfloader.AttachReport) {
+
+	/* Resolve kernel BTF */
+	opts, btfSource, err := bpfloader.CollectionOptions(btfPath)
+	if err != nil {
+		log.Fatalf("resolving kernel BTF: %v", err)
+	}
+	log.Printf("Using kernel BTF from %s", btfSource)
+
+	/* Load eBPF objects */
+	bpf := bpfloader.InitBPF()
+	if ringbufSize != "" {
+		size, err := bpfloader.ParseRingBufferSize(ringbufSize)
+		if err != nil {
+			log.Fatalf("--ringbuf-size: %v", err)
+		}
+		bpf.EventsSize = size
+	}
+	if priorityRingbufSize != "" {
+		size, err := bpfloader.ParseRingBufferSize(priorityRingbufSize)
+		if err != nil {
+			log.Fatalf("--priority-ringbuf-size: %v", err)
+		}
+		bpf.PriorityEventsSize = size
+	}
+	if err := bpf.Load(bpf.Objects, opts); err != nil {
+		log.Fatalf("loading eBPF objects: %v", err)
+	}
+
+	/* Populate policy map */
+	count, err := policy.LoadTrackedFileMap(bpf)
+	if err != nil {
+		log.Printf("loading policy map: %v", err)
+	}
+	if count == 0 {
+		log.Printf("No policy loaded")
+		bpf.Objects.Close()
+		return nil, nil
+	}
+
+	/* Attach eBPF programs */
+	_, report, err := bpf.AttachPrograms()
+	log.Printf("Attached hooks:\n%s", report)
+	if err != nil {
+		log.Printf("ERROR: Couldn't attach eBPF programs : %v", err)
+		bpf.Objects.Close()
+		return nil, nil
+	}
+
+	/* Let watchd explain look into the policy table */
+	if err := bpf.PinPolicy(); err != nil {
+		log.Printf("WARN: %v, explain can't check the policy table", err)
+	}
+
+	return bpf, &report
+}
+
+// processEvents runs every event of src through eventcore and the sinks
+// until src is closed or exhausted. bpf is nil for sources that don't use
+// eBPF.
+func processEvents(src eventsource.Source, bpf *bpfloader.BPF, live *livePolicy, enableNet bool) {
+	for {
+		event, err := src.Read()
+		if err != nil {
+			if errors.Is(err, eventsource.ErrClosed) || errors.Is(err, io.EOF) {
+				log.Println("Event source closed, stopping event reader")
+				return
+			}
+			log.Printf("reading events: %v", err)
+			continue
+		}
+		log.Printf("event occurred\n")
+
+		// Process and display the event
+		payload, ok := live.process(&event, bpf)
+		if ok {
+			sendPayload(payload, enableNet)
+		}
+	}
+}
+
+// runHeartbeat triggers a HEARTBEAT every heartbeatInterval, it comes back
+// through the ring buffer like any other event
+func runHeartbeat(bpf *bpfloader.BPF) {
+	for range time.Tick(heartbeatInterval) {
+		if err := bpf.Heartbeat(); err != nil {
+			log.Printf("ERROR: %v", err)
+		}
+	}
+}
+
+// runSelfCheck reports every sign of tampering found by checker as a
+// SELF_TAMPER event, every selfCheckInterval
+func runSelfCheck(checker *selfcheck.Checker, enableNet bool) {
+	for range time.Tick(selfCheckInterval) {
+		for _, f := range checker.Check() {
+			log.Printf("ERROR: SELF_TAMPER %s: %s", f.Target, f.Reason)
+			sendPayload(eventcore.TamperPayload(f.Target, f.Reason), enableNet)
+		}
+	}
+}
+
+// sendPayload hands a processed event to the sinks
+func sendPayload(payload netlog.Payload, enableNet bool) {
+	eventcore.PrintPayload(payload)
+	if enableNet {
+		if err := netlog.SendPOST(payload); err != nil {
+			log.Printf("sending event: %v", err)
+		}
+	}
+}
+
+// policyTableStatus tells whether the inode at path is in the policy table
+// of the running watchd
+func policyTableStatus(path string) string {
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return fmt.Sprintf("unknown, %v", err)
+	}
+	key := bpfloader.TrackedFileKey{
+		InodeNumber: st.Ino,
+		Dev:         preprocess.KernelDev(&st),
+	}
+
+	table, err := bpfloader.OpenPinnedPolicy()
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Sprintf("unknown, no watchd with the ebpf backend running (nothing pinned at %s)", bpfloader.PolicyPinPath)
+	}
+	if err != nil {
+		return fmt.Sprintf("unknown, %v", err)
+	}
+	defer table.Close()
+
+	value, ok, err := table.Lookup(key)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("unknown, %v", err)
+	case !ok:
+		return fmt.Sprintf("absent (inode %d, dev %d)", key.InodeNumber, key.Dev)
+	default:
+		return fmt.Sprintf("present (inode %d, dev %d, size %d, event mask %#x)", key.InodeNumber, key.Dev, value.FileSize, value.EventMask)
 	}
 }
@@ -28,9 +28,43 @@ type Payload struct {
 
 	CheckSum string `json:"checksum"`
 
+	// "high" for events about watchd itself, otherwise the severity of the
+	// rule including the file, if it has one
+	Severity string `json:"severity,omitempty"`
+
+	// labels of the rule including the file
+	Labels []string `json:"labels,omitempty"`
+
 	FileSize   int64 `json:"file_size"`
 	BeforeSize int64 `json:"before_size"`
 	AfterSize  int64 `json:"after_size"`
+
+	// flags of the file before and after a FLAGS_CHANGED, the old ones
+	// only cover sync, noatime, append, immutable and dirsync
+	OldFlags []string `json:"old_flags,omitempty"`
+	NewFlags []string `json:"new_flags,omitempty"`
+
+	// all known paths of a hard linked file
+	Paths []string `json:"paths,omitempty"`
+
+	// mount the file was reached through
+	MountPoint string `json:"mount_point,omitempty"`
+	FSType     string `json:"fs_type,omitempty"`
+	Source     string `json:"source,omitempty"`
+
+	Heartbeat *Heartbeat `json:"heartbeat,omitempty"`
+}
+
+// Heartbeat are the counters of a HEARTBEAT event, each since the previous
+// heartbeat. A collector missing heartbeats knows the agent is broken, not
+// idle.
+type Heartbeat struct {
+	Seq         uint64 `json:"seq"`
+	Events      uint64 `json:"kernel_events"` // sent by the eBPF programs
+	Lost        uint64 `json:"lost"`          // ring buffers full
+	RateLimited uint64 `json:"rate_limited"`
+	Reported    uint64 `json:"reported"` // events sent on by the daemon
+	Filtered    uint64 `json:"filtered"`
 }
 
 func InitApiAuth(path string) error {
@@ -0,0 +1,212 @@
+/** Which rules of the policy decide about a path */
+package preprocess
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// precedence of the commands, IF > E > EE > ES > D
+var precedence = map[string]int{
+	"IF": 5,
+	"E":  4,
+	"EE": 3,
+	"ES": 2,
+	"D":  1,
+}
+
+// RuleMatch is a rule matching a path
+type RuleMatch struct {
+	File     string // File is the included file of the rule, empty for the config itself.
+	Line     int
+	Command  string
+	Argument string
+	Via      string // Via is the parent directory the rule matched, empty if the path itself.
+	Options  RuleOptions
+}
+
+func (m RuleMatch) String() string {
+	s := fmt.Sprintf("line %-4d %s: %s", m.Line, m.Command, m.Argument)
+	if m.File != "" {
+		s = fmt.Sprintf("%s:%d %s: %s", m.File, m.Line, m.Command, m.Argument)
+	}
+	if m.Via != "" {
+		s += " (via " + m.Via + ")"
+	}
+	if !m.Options.empty() {
+		s += " [" + m.Options.String() + "]"
+	}
+	return s
+}
+
+// Explanation is how the policy decides about a path
+type Explanation struct {
+	Path     string
+	Included bool       // Included is whether the walk puts the path in the policy table.
+	Winner   *RuleMatch // Winner is the deciding rule, nil if no rule includes the path.
+	Matches  []RuleMatch
+}
+
+// Explain evaluates path against the rules the way the walk does. An IF
+// includes the path. Otherwise the most specific D includes it, unless an
+// E, EE or ES matches the path or a directory between it and the D, which
+// the walk skips. Among the rules excluding it the winner follows the precedence
+// IF > E > EE > ES > D.
+//
+// The path doesn't have to exist, E rules are compared by path although the
+// walk compares them by inode.
+func (p *Cache) Explain(path string) Explanation {
+
+	path = filepath.Clean(path)
+	ex := Explanation{Path: path}
+
+	for _, t := range p.tokens {
+		via, ok := "", false
+		switch t.command {
+		case "IF":
+			ok = matchRule(t.argument, path)
+		case "D", "E":
+			via, ok = coveringDir(t.argument, path)
+		case "EE":
+			via, ok = namedDir(path, func(name string) bool { return filepath.Ext(name) == t.argument })
+		case "ES":
+			via, ok = namedDir(path, func(name string) bool { return strings.HasSuffix(name, t.argument) })
+		}
+		if !ok {
+			continue
+		}
+		if via == path {
+			via = ""
+		}
+		ex.Matches = append(ex.Matches, RuleMatch{File: t.file, Line: t.lineNum, Command: t.command, Argument: t.argument, Via: via, Options: t.options})
+	}
+
+	for i, m := range ex.Matches {
+		if m.Command == "IF" {
+			ex.Included = true
+			ex.Winner = &ex.Matches[i]
+			return ex
+		}
+	}
+
+	// the most specific D first, like the walk
+	var dirs []int
+	for i, m := range ex.Matches {
+		if m.Command == "D" {
+			dirs = append(dirs, i)
+		}
+	}
+	root := func(m RuleMatch) string {
+		if m.Via == "" {
+			return path
+		}
+		return m.Via
+	}
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return len(splitPath(root(ex.Matches[dirs[i]]))) > len(splitPath(root(ex.Matches[dirs[j]])))
+	})
+
+	for _, i := range dirs {
+		blocker := p.blocked(root(ex.Matches[i]), path)
+		if blocker == nil {
+			ex.Included = true
+			ex.Winner = &ex.Matches[i]
+			return ex
+		}
+		if ex.Winner == nil || precedence[blocker.Command] > precedence[ex.Winner.Command] {
+			ex.Winner = blocker
+		}
+	}
+
+	return ex
+}
+
+// blocked returns the exclusion of highest precedence the walk from root
+// hits on its way down to path, nil if it reaches path
+func (p *Cache) blocked(root string, path string) *RuleMatch {
+
+	var best *RuleMatch
+
+	dir := root
+	for {
+		name := filepath.Base(dir)
+		for _, t := range p.tokens {
+			var hit bool
+			switch t.command {
+			case "E":
+				hit = matchRule(t.argument, dir)
+			case "EE":
+				hit = filepath.Ext(name) == t.argument
+			case "ES":
+				hit = strings.HasSuffix(name, t.argument)
+			}
+			if !hit || (best != nil && precedence[t.command] <= precedence[best.Command]) {
+				continue
+			}
+			best = &RuleMatch{File: t.file, Line: t.lineNum, Command: t.command, Argument: t.argument, Options: t.options}
+			if dir != path {
+				best.Via = dir
+			}
+		}
+
+		if dir == path {
+			return best
+		}
+		// one level further down towards path
+		rest := strings.TrimPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+		next, _, _ := strings.Cut(rest, "/")
+		dir = filepath.Join(dir, next)
+	}
+}
+
+// coveringDir returns the deepest of path and its parents matching argument
+func coveringDir(argument string, path string) (string, bool) {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if matchRule(argument, dir) {
+			return dir, true
+		}
+		if dir == "/" || dir == "." {
+			return "", false
+		}
+	}
+}
+
+// namedDir returns the deepest of path and its parents whose name matches
+func namedDir(path string, match func(name string) bool) (string, bool) {
+	for dir := path; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if match(filepath.Base(dir)) {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// String formats the decision, then every matching rule one per line
+func (e Explanation) String() string {
+
+	var b strings.Builder
+
+	switch {
+	case e.Included:
+		fmt.Fprintf(&b, "%s: monitored\n", e.Path)
+	case e.Winner != nil:
+		fmt.Fprintf(&b, "%s: excluded\n", e.Path)
+	default:
+		fmt.Fprintf(&b, "%s: not monitored, no D or IF rule includes it\n", e.Path)
+	}
+	if e.Winner != nil {
+		fmt.Fprintf(&b, "  rule:    %s\n", e.Winner)
+	}
+
+	b.WriteString("  matches:\n")
+	if len(e.Matches) == 0 {
+		b.WriteString("    none\n")
+	}
+	for _, m := range e.Matches {
+		fmt.Fprintf(&b, "    %s\n", m)
+	}
+
+	return b.String()
+}
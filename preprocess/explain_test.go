@@ -0,0 +1,51 @@
+package preprocess
+
+import "testing"
+
+func TestExplain(t *testing.T) {
+
+	policy := Cache{tokens: rules(
+		"D: /opt/app",
+		"E: /opt/app/cache",
+		"EE: .log",
+		"ES: _old",
+		"IF: /opt/app/cache/critical.log",
+		"D: /opt/app/cache/keep",
+		"E: /srv/**/tmp",
+		"D: /srv",
+	)}
+
+	tests := []struct {
+		path     string
+		included bool
+		winner   int // line of the winning rule, 0 for none
+		matches  int
+	}{
+		{"/opt/app/bin/run", true, 1, 1},
+		{"/opt/app/cache/page", false, 2, 2},
+		{"/opt/app/cache/critical.log", true, 5, 4},
+		{"/opt/app/logs/x.log", false, 3, 2},
+		{"/opt/app/conf_old/x", false, 4, 2},
+		{"/opt/app/cache/keep/x", true, 6, 3},
+		{"/srv/a/b/tmp/x", false, 7, 2},
+		{"/srv/a/b/x", true, 8, 1},
+		{"/etc/passwd", false, 0, 0},
+	}
+
+	for _, tt := range tests {
+		ex := policy.Explain(tt.path)
+		if ex.Included != tt.included {
+			t.Errorf("%s: included %v, want %v", tt.path, ex.Included, tt.included)
+		}
+		winner := 0
+		if ex.Winner != nil {
+			winner = ex.Winner.Line
+		}
+		if winner != tt.winner {
+			t.Errorf("%s: winner line %d, want %d\n%s", tt.path, winner, tt.winner, ex)
+		}
+		if len(ex.Matches) != tt.matches {
+			t.Errorf("%s: %d matches, want %d\n%s", tt.path, len(ex.Matches), tt.matches, ex)
+		}
+	}
+}
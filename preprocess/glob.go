@@ -0,0 +1,191 @@
+/** Shell style globs in the path arguments of D, E and IF rules */
+package preprocess
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// globSpecial are the characters that make a path segment a pattern
+const globSpecial = "*?["
+
+// hasGlob reports whether path contains a pattern
+func hasGlob(path string) bool {
+	return strings.ContainsAny(path, globSpecial)
+}
+
+// splitPath splits an absolute path into its segments, "/" has none
+func splitPath(path string) []string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// validGlob checks the segments of pattern with filepath.Match, and that
+// "**" only appears as a whole segment
+func validGlob(pattern string) error {
+	for _, seg := range splitPath(pattern) {
+		if strings.Contains(seg, "**") && seg != "**" {
+			return fmt.Errorf("'**' must be a whole path segment: %s", seg)
+		}
+		if _, err := filepath.Match(seg, ""); err != nil {
+			return fmt.Errorf("bad pattern %s: %w", seg, err)
+		}
+	}
+	return nil
+}
+
+// matchGlob reports whether path matches pattern. Segments match like
+// filepath.Match, "**" matches any number of segments, none included.
+func matchGlob(pattern string, path string) bool {
+	return matchSegments(splitPath(pattern), splitPath(path))
+}
+
+func matchSegments(pattern []string, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(path); i++ {
+				if matchSegments(pattern, path[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 {
+			return false
+		}
+		if ok, err := filepath.Match(pattern[0], path[0]); err != nil || !ok {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
+
+// matchRule reports whether path is the path of a D, E or IF argument, or
+// matches it if it is a pattern. The walk and the runtime checks of created
+// files both go through it.
+func matchRule(argument string, path string) bool {
+	if hasGlob(argument) {
+		return matchGlob(argument, path)
+	}
+	return filepath.Clean(argument) == filepath.Clean(path)
+}
+
+// coveredBy reports whether path or one of its parents matches argument,
+// that is whether a recursive D or E rule reaches path
+func coveredBy(argument string, path string) bool {
+	_, ok := coveringDir(argument, filepath.Clean(path))
+	return ok
+}
+
+// globRoot returns the directory above the first pattern segment
+func globRoot(pattern string) string {
+	root := "/"
+	for _, seg := range splitPath(pattern) {
+		if hasGlob(seg) {
+			break
+		}
+		root = filepath.Join(root, seg)
+	}
+	return root
+}
+
+// expandGlob returns the existing paths matching pattern, sorted. "**"
+// doesn't follow symlinks to directories, to keep out of loops.
+func expandGlob(pattern string) []string {
+
+	found := make(map[string]uint8)
+	expandSegments("/", splitPath(pattern), found)
+
+	paths := make([]string, 0, len(found))
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func expandSegments(dir string, segs []string, found map[string]uint8) {
+
+	if len(segs) == 0 {
+		found[dir] = 1
+		return
+	}
+
+	seg := segs[0]
+	if !hasGlob(seg) {
+		path := filepath.Join(dir, seg)
+		if _, err := os.Stat(path); err == nil {
+			expandSegments(path, segs[1:], found)
+		}
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	if seg == "**" {
+		expandSegments(dir, segs[1:], found)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				expandSegments(filepath.Join(dir, entry.Name()), segs, found)
+			}
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if ok, _ := filepath.Match(seg, entry.Name()); ok {
+			expandSegments(filepath.Join(dir, entry.Name()), segs[1:], found)
+		}
+	}
+}
+
+// paths returns the path of the argument of a D, E or IF rule, or the
+// existing paths it matches if it is a pattern
+func (t token) paths() []string {
+
+	if !hasGlob(t.argument) {
+		return []string{t.argument}
+	}
+
+	paths := expandGlob(t.argument)
+	if len(paths) == 0 {
+		log.Printf("WARN: %s matches nothing", t.argument)
+	}
+	return paths
+}
+
+// Excluded reports whether a file created at path is left out of the policy
+// by an E rule the way the walk would have, unless an IF rule includes it.
+// EE and ES are checked by the event filter.
+func (p *Cache) Excluded(path string) bool {
+
+	excluded := false
+	for _, token := range p.tokens {
+		switch token.command {
+		case "IF":
+			if matchRule(token.argument, path) {
+				return false
+			}
+		case "E":
+			if matchRule(token.argument, path) {
+				excluded = true
+			}
+		}
+	}
+	return excluded
+}
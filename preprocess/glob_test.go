@@ -0,0 +1,178 @@
+package preprocess
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"watchd/bpfloader"
+)
+
+func TestMatchGlob(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/home/*/.ssh", "/home/alice/.ssh", true},
+		{"/home/*/.ssh", "/home/alice/x/.ssh", false},
+		{"/home/*/.ssh", "/home/.ssh", false},
+		{"/var/www/**/cache", "/var/www/cache", true},
+		{"/var/www/**/cache", "/var/www/a/b/cache", true},
+		{"/var/www/**/cache", "/var/www/a/b/cache/x", false},
+		{"/var/www/**", "/var/www", true},
+		{"/var/www/**", "/var/www/a/b", true},
+		{"/etc/*.conf", "/etc/ssh/sshd.conf", false},
+		{"/etc/[ab]?.conf", "/etc/a1.conf", true},
+		{"/etc/[ab]?.conf", "/etc/c1.conf", false},
+		{"/**/id_rsa", "/root/.ssh/id_rsa", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValidGlob(t *testing.T) {
+
+	for _, pattern := range []string{"/a/**/b", "/a/*.conf", "/a/[0-9]*"} {
+		if err := validGlob(pattern); err != nil {
+			t.Errorf("validGlob(%q) = %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"/a/b**", "/a/**x/b", "/a/[b"} {
+		if err := validGlob(pattern); err == nil {
+			t.Errorf("validGlob(%q) accepted", pattern)
+		}
+	}
+
+	tokens := []token{{lineNum: 3, command: "E", argument: "/var/www/**cache"}}
+	if err := SyntaxValidation(tokens); err == nil {
+		t.Error("SyntaxValidation accepted a partial '**' segment")
+	}
+}
+
+func TestGlobRoot(t *testing.T) {
+
+	for pattern, want := range map[string]string{
+		"/home/*/.ssh":      "/home",
+		"/var/www/**/cache": "/var/www",
+		"/*":                "/",
+		"/etc/passwd":       "/etc/passwd",
+	} {
+		if got := globRoot(pattern); got != want {
+			t.Errorf("globRoot(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+// mkTree creates the files below root, directories end with "/"
+func mkTree(t *testing.T, root string, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		full := filepath.Join(root, p)
+		if p[len(p)-1] == '/' {
+			if err := os.MkdirAll(full, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+
+	root := t.TempDir()
+	mkTree(t, root,
+		"home/alice/.ssh/authorized_keys",
+		"home/bob/.ssh/",
+		"home/carol/",
+		"www/cache/",
+		"www/a/b/cache/",
+		"www/a/notcache/",
+	)
+	// "**" must not loop through symlinks
+	if err := os.Symlink(filepath.Join(root, "www"), filepath.Join(root, "www/a/loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := expandGlob(root + "/home/*/.ssh")
+	want := []string{root + "/home/alice/.ssh", root + "/home/bob/.ssh"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("home/*/.ssh: got %v, want %v", got, want)
+	}
+
+	got = expandGlob(root + "/www/**/cache")
+	want = []string{root + "/www/a/b/cache", root + "/www/cache"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("www/**/cache: got %v, want %v", got, want)
+	}
+
+	if got := expandGlob(root + "/nothing/*"); len(got) != 0 {
+		t.Errorf("nothing/*: got %v", got)
+	}
+}
+
+func inodeKey(t *testing.T, path string) bpfloader.TrackedFileKey {
+	t.Helper()
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	return bpfloader.TrackedFileKey{InodeNumber: st.Ino, Dev: rawDev(&st)}
+}
+
+func TestGlobPolicy(t *testing.T) {
+
+	root := t.TempDir()
+	mkTree(t, root,
+		"www/index.html",
+		"www/cache/page",
+		"www/a/b/cache/page",
+		"www/a/b/cache/keep",
+		"www/a/data",
+	)
+
+	tokens := []token{
+		{lineNum: 1, command: "D", argument: root + "/www"},
+		{lineNum: 2, command: "E", argument: root + "/www/**/cache"},
+		{lineNum: 3, command: "IF", argument: root + "/www/*/*/cache/keep"},
+	}
+	policyMap, err := constructPolicyMap(tokens, parseExcludePolicy(tokens), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"www", "www/index.html", "www/a/data", "www/a/b/cache/keep"} {
+		if _, ok := policyMap[inodeKey(t, filepath.Join(root, p))]; !ok {
+			t.Errorf("%s not in the policy", p)
+		}
+	}
+	for _, p := range []string{"www/cache", "www/cache/page", "www/a/b/cache", "www/a/b/cache/page"} {
+		if _, ok := policyMap[inodeKey(t, filepath.Join(root, p))]; ok {
+			t.Errorf("%s in the policy", p)
+		}
+	}
+
+	// files created later are judged the same way
+	cache := Cache{tokens: tokens}
+	if !cache.Excluded(root + "/www/x/cache") {
+		t.Error("created cache directory not excluded")
+	}
+	if cache.Excluded(root + "/www/x/data") {
+		t.Error("created data file excluded")
+	}
+	if cache.Excluded(root + "/www/x/y/cache/keep") {
+		t.Error("IF pattern doesn't override E")
+	}
+}
@@ -0,0 +1,170 @@
+/** Version 2 of the rule grammar: quoting, inline comments and lists */
+package preprocess
+
+import (
+	"strings"
+)
+
+// Grammar versions a policy file can select with its "version:" header,
+// files without one use version 1
+const (
+	grammarV1 = 1 // "CMD: argument", the argument taken verbatim after trimming
+	grammarV2 = 2 // quoted arguments, inline # comments, lists for E, EE and ES
+)
+
+// item is one argument of a rule, col is where it starts in the line
+type item struct {
+	text string
+	col  int
+}
+
+// parseVersion reads the value of a "version:" header, an inline comment
+// after it is allowed in either grammar
+func parseVersion(value string) (int, bool) {
+	value, _, _ = strings.Cut(value, "#")
+	switch strings.TrimSpace(value) {
+	case "1":
+		return grammarV1, true
+	case "2":
+		return grammarV2, true
+	}
+	return 0, false
+}
+
+// isComment reports whether a version 2 line holds no rule
+func isComment(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "" || strings.HasPrefix(line, "#")
+}
+
+// lexRule splits a version 2 line into its command, arguments and inline
+// comment.
+//
+// An argument is quoted with double quotes, where \" \\ \t and \n are the
+// only escapes, or bare, running to the next comma or # with the blanks
+// around it trimmed. A # outside quotes starts a comment. The returned
+// error has the caret at the offending character.
+func lexRule(line string) (string, []item, string, *PolicyError) {
+
+	fail := func(col int, hint string, message string) *PolicyError {
+		return &PolicyError{Code: ExitSyntax, Text: line, Col: col, Message: message, Hint: hint}
+	}
+
+	colon := strings.IndexAny(line, ":#")
+	if colon < 0 || line[colon] != ':' {
+		return "", nil, "", fail(0, "use 'Command: Argument' format", "colon missing")
+	}
+	command := strings.TrimSpace(line[:colon])
+	comment := func(i int) string {
+		if i < len(line) && line[i] == '#' {
+			return strings.TrimSpace(line[i+1:])
+		}
+		return ""
+	}
+
+	var items []item
+	i := colon + 1
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		start := i
+
+		switch {
+		case i == len(line) || line[i] == '#':
+			if len(items) > 0 {
+				return "", nil, "", fail(i, "remove the trailing comma", "empty list item")
+			}
+			return command, []item{{col: i}}, comment(i), nil
+
+		case line[i] == ',':
+			return "", nil, "", fail(i, "remove the extra comma", "empty list item")
+
+		case line[i] == '"':
+			var b strings.Builder
+			i++
+			for {
+				if i == len(line) {
+					return "", nil, "", fail(start, `close the argument with "`, "unterminated quote")
+				}
+				c := line[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' {
+					if i+1 == len(line) {
+						return "", nil, "", fail(i, `close the argument with "`, "unterminated quote")
+					}
+					switch line[i+1] {
+					case '"', '\\':
+						b.WriteByte(line[i+1])
+					case 't':
+						b.WriteByte('\t')
+					case 'n':
+						b.WriteByte('\n')
+					default:
+						return "", nil, "", fail(i, `valid escapes: \" \\ \t \n`, "unknown escape \\"+string(line[i+1]))
+					}
+					i += 2
+					continue
+				}
+				b.WriteByte(c)
+				i++
+			}
+			items = append(items, item{text: b.String(), col: start})
+			for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+				i++
+			}
+			if i < len(line) && line[i] != ',' && line[i] != '#' {
+				return "", nil, "", fail(i, "separate list items with a comma", "unexpected text after quoted argument")
+			}
+
+		default:
+			end := i
+			for end < len(line) && line[end] != ',' && line[end] != '#' {
+				if line[end] == '"' {
+					return "", nil, "", fail(end, "quote the whole argument", "quote inside an argument")
+				}
+				end++
+			}
+			items = append(items, item{text: strings.TrimRight(line[i:end], " \t"), col: start})
+			i = end
+		}
+
+		if i == len(line) || line[i] == '#' {
+			break
+		}
+		i++ // the comma
+	}
+
+	if len(items) > 1 && command != "E" && command != "EE" && command != "ES" {
+		return "", nil, "", fail(items[1].col, "write one rule per path", "only E, EE and ES take a list")
+	}
+	return command, items, comment(i), nil
+}
+
+// splitEvents splits the event types off a command, D[create,delete] gives
+// D and create, delete. It works the same in both grammars, line is for
+// the error.
+func splitEvents(command string, line string) (string, []string, *PolicyError) {
+
+	open := strings.IndexByte(command, '[')
+	if open < 0 {
+		return command, nil, nil
+	}
+	col := strings.IndexByte(line, '[')
+	if !strings.HasSuffix(command, "]") {
+		return "", nil, &PolicyError{Code: ExitSyntax, Text: line, Col: col, Message: "event list not closed", Hint: "example: D[create,delete]: /var/www"}
+	}
+
+	var events []string
+	for _, name := range strings.Split(command[open+1:len(command)-1], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return "", nil, &PolicyError{Code: ExitSyntax, Text: line, Col: col, Message: "empty event in the list", Hint: "example: D[create,delete]: /var/www"}
+		}
+		events = append(events, name)
+	}
+	return strings.TrimSpace(command[:open]), events, nil
+}
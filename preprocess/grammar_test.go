@@ -0,0 +1,109 @@
+package preprocess
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLexRule(t *testing.T) {
+
+	tests := []struct {
+		line    string
+		command string
+		args    []string
+	}{
+		{"D: /etc", "D", []string{"/etc"}},
+		{"  D:/etc   # system config", "D", []string{"/etc"}},
+		{`D: "/srv/my files"`, "D", []string{"/srv/my files"}},
+		{`D: "/srv/#1/ x "`, "D", []string{"/srv/#1/ x "}},
+		{`IF: "/a/\"q\"\\b\tc"`, "IF", []string{"/a/\"q\"\\b\tc"}},
+		{"EE: .log, .tmp,.bak", "EE", []string{".log", ".tmp", ".bak"}},
+		{`E: /var/cache, "/var/my tmp" # both`, "E", []string{"/var/cache", "/var/my tmp"}},
+		{"ES: _old", "ES", []string{"_old"}},
+		{"D:", "D", []string{""}},
+	}
+
+	for _, tt := range tests {
+		command, items, _, err := lexRule(tt.line)
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		var args []string
+		for _, it := range items {
+			args = append(args, it.text)
+		}
+		if command != tt.command || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%q: got %s %q, want %s %q", tt.line, command, args, tt.command, tt.args)
+		}
+	}
+}
+
+func TestLexRuleErrors(t *testing.T) {
+
+	tests := []struct {
+		line    string
+		message string
+		col     int
+	}{
+		{"D /etc # no colon: here", "colon missing", 0},
+		{`D: "/etc`, "unterminated quote", 3},
+		{`D: "/etc\q"`, "unknown escape", 8},
+		{`D: "/etc" x`, "unexpected text", 10},
+		{`D: /et"c`, "quote inside", 6},
+		{"EE: .log,", "empty list item", 9},
+		{"EE: .log,,.tmp", "empty list item", 9},
+		{"D: /etc, /srv", "only E, EE and ES", 9},
+	}
+
+	for _, tt := range tests {
+		_, _, _, err := lexRule(tt.line)
+		if err == nil {
+			t.Errorf("%q: accepted", tt.line)
+			continue
+		}
+		if !strings.Contains(err.Message, tt.message) || err.Col != tt.col {
+			t.Errorf("%q: got %q at %d, want %q at %d", tt.line, err.Message, err.Col, tt.message, tt.col)
+		}
+	}
+}
+
+func TestTokenizeVersion(t *testing.T) {
+
+	// version 1 keeps the argument verbatim
+	v1 := "# legacy\nD: /srv/a # b\nEE: .log,.tmp\n"
+	tokens, err := tokenize(strings.NewReader(v1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].argument != "/srv/a # b" || tokens[1].argument != ".log,.tmp" {
+		t.Errorf("version 1: %+v", tokens)
+	}
+
+	v2 := "# new grammar\nversion: 2\n\n  # indented comment\nD: \"/srv/a b\" # b\nEE: .log, .tmp\n"
+	tokens, err = tokenize(strings.NewReader(v2), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []token{
+		{lineNum: 5, command: "D", argument: "/srv/a b", text: `D: "/srv/a b" # b`, col: 3, comment: "new grammar\nindented comment\nb"},
+		{lineNum: 6, command: "EE", argument: ".log", text: "EE: .log, .tmp", col: 4},
+		{lineNum: 6, command: "EE", argument: ".tmp", text: "EE: .log, .tmp", col: 10},
+	}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Errorf("version 2: got %+v, want %+v", tokens, want)
+	}
+
+	for _, config := range []string{"D: /etc\nversion: 2\n", "version: 3\n"} {
+		if _, err := tokenize(strings.NewReader(config), ""); err == nil {
+			t.Errorf("%q accepted", config)
+		}
+	}
+
+	// errors point into the original line
+	_, err = tokenize(strings.NewReader("version: 2\nD: /etc, /srv\n"), "")
+	if err == nil || !strings.Contains(err.Error(), "[Line 2]") || !strings.Contains(err.Error(), "\n  D: /etc, /srv\n           ^") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+/** INCLUDE rules, splitting a policy over several files */
+package preprocess
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configReader reads a policy file and the files its INCLUDE rules name.
+//
+// The rules of an included file take the place of the INCLUDE rule, files
+// matching a pattern are read in lexical order. The order of the rules, and
+// so which of two rules a message names first, doesn't depend on the order
+// of directory entries.
+type configReader struct {
+	stack []string         // files being read, outermost first, to find cycles
+	done  map[string]uint8 // files already read, a second INCLUDE of one is skipped
+	files []string         // files read, in order
+	dirs  []string         // directories holding them or INCLUDE patterns
+
+	missing []string // INCLUDE rules naming a file that doesn't exist, skipped
+}
+
+func newConfigReader() *configReader {
+	return &configReader{done: make(map[string]uint8)}
+}
+
+// read returns the rules of the file at path, the INCLUDE rule naming it is
+// nil for the config itself
+func (r *configReader) read(path string, include *token) ([]token, error) {
+
+	id := canonicalPath(path)
+	for i, open := range r.stack {
+		if open == id {
+			chain := append(append([]string{}, r.stack[i:]...), id)
+			return nil, ruleError(ExitSemantic, *include, true, "remove one of the INCLUDE rules",
+				"include cycle: %s", strings.Join(chain, " -> "))
+		}
+	}
+	if _, ok := r.done[id]; ok {
+		return nil, nil
+	}
+
+	file := ""
+	if include != nil {
+		file = path
+	}
+	if isYAML(path) {
+		return nil, &PolicyError{Code: ExitSyntax, File: file, Message: path + ": YAML policies aren't supported",
+			Hint: "write the structured policy as JSON, with the extension .json"}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if include == nil {
+			return nil, fsError(err, nil)
+		}
+		return nil, fsError(err, include)
+	}
+	defer f.Close()
+
+	r.done[id] = 1
+	r.files = append(r.files, path)
+	r.addDir(filepath.Dir(path))
+
+	var tokens []token
+	if isStructured(path) {
+		var data []byte
+		data, err = io.ReadAll(f)
+		if err != nil {
+			return nil, fsError(err, include)
+		}
+		tokens, _, err = decodeStructured(data, file)
+	} else {
+		tokens, err = tokenize(f, file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.stack = append(r.stack, id)
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+
+	var rules []token
+	for _, t := range tokens {
+		if t.command != "INCLUDE" {
+			rules = append(rules, t)
+			continue
+		}
+		included, err := r.include(t, filepath.Dir(path))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, included...)
+	}
+	return rules, nil
+}
+
+// include returns the rules of the files the INCLUDE rule t matches,
+// relative paths are relative to dir, the directory of the including file
+func (r *configReader) include(t token, dir string) ([]token, error) {
+
+	if t.argument == "" {
+		return nil, ruleError(ExitSyntax, t, true, "example: INCLUDE: /etc/watchd/conf.d/*.conf", "missing path")
+	}
+	pattern := t.argument
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	if abs, err := filepath.Abs(pattern); err == nil {
+		pattern = abs
+	}
+
+	var matches []string
+	if hasGlob(pattern) {
+		if err := validGlob(pattern); err != nil {
+			return nil, ruleError(ExitSyntax, t, true, "", "%v", err)
+		}
+		r.addDir(globRoot(pattern))
+		matches = expandGlob(pattern)
+	} else {
+		r.addDir(filepath.Dir(pattern))
+		if _, err := os.Stat(pattern); errors.Is(err, os.ErrNotExist) {
+			r.missing = append(r.missing, fmt.Sprintf("INCLUDE %s (%s)", pattern, t.location()))
+			return nil, nil
+		}
+		matches = []string{pattern}
+	}
+	sort.Strings(matches)
+
+	var rules []token
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			continue
+		}
+		included, err := r.read(path, &t)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, included...)
+	}
+	return rules, nil
+}
+
+// addDir records dir as holding policy files, once
+func (r *configReader) addDir(dir string) {
+	for _, d := range r.dirs {
+		if d == dir {
+			return
+		}
+	}
+	r.dirs = append(r.dirs, dir)
+}
+
+// canonicalPath resolves symlinks so two names of a file compare equal,
+// path itself if it can't be resolved
+func canonicalPath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// location names the rule t in messages: "line N" for the config itself,
+// "<file> line N" for an included file
+func (t token) location() string {
+	if t.file != "" {
+		return fmt.Sprintf("%s line %d", t.file, t.lineNum)
+	}
+	return fmt.Sprintf("line %d", t.lineNum)
+}
+
+// ConfigDirs returns the directories holding the policy at configPath and the
+// files it includes, the ones a change of the policy shows up in
+func ConfigDirs(configPath string) []string {
+	r := newConfigReader()
+	r.read(configPath, nil)
+	if len(r.dirs) == 0 {
+		return []string{filepath.Dir(configPath)}
+	}
+	return r.dirs
+}
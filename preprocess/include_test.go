@@ -0,0 +1,109 @@
+package preprocess
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes the policy files below root, name -> lines
+func writeConfig(t *testing.T, root string, files map[string][]string) {
+	t.Helper()
+	for name, lines := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadConfigInclude(t *testing.T) {
+
+	root := t.TempDir()
+	writeConfig(t, root, map[string][]string{
+		"config.txt": {
+			"D: /etc",
+			"INCLUDE: conf.d/*.conf",
+			"EE: .log",
+			"INCLUDE: " + root + "/conf.d/10-web.conf", // read once
+			"INCLUDE: missing.conf",
+		},
+		"conf.d/20-db.conf":  {"D: /var/lib/db"},
+		"conf.d/10-web.conf": {"# web", "D: /var/www", "INCLUDE: ../extra/*.conf"},
+		"conf.d/notes.txt":   {"D: /ignored"},
+		"extra/a.conf":       {"E: /var/www/cache"},
+	})
+
+	tokens, err := ReadConfig(filepath.Join(root, "config.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"D: /etc", "D: /var/www", "E: /var/www/cache", "D: /var/lib/db", "EE: .log"}
+	if len(tokens) != len(want) {
+		t.Fatalf("got %v, want %v", tokens, want)
+	}
+	for i, tok := range tokens {
+		if got := tok.command + ": " + tok.argument; got != want[i] {
+			t.Errorf("rule %d: got %q, want %q", i, got, want[i])
+		}
+	}
+
+	if tokens[0].file != "" || tokens[0].lineNum != 1 {
+		t.Errorf("rule of the config: file %q line %d", tokens[0].file, tokens[0].lineNum)
+	}
+	if tokens[1].file != filepath.Join(root, "conf.d/10-web.conf") || tokens[1].lineNum != 2 {
+		t.Errorf("included rule: file %q line %d", tokens[1].file, tokens[1].lineNum)
+	}
+}
+
+func TestReadConfigIncludeCycle(t *testing.T) {
+
+	root := t.TempDir()
+	writeConfig(t, root, map[string][]string{
+		"config.txt": {"D: /etc", "INCLUDE: a.conf"},
+		"a.conf":     {"INCLUDE: b.conf"},
+		"b.conf":     {"D: /srv", "INCLUDE: a.conf"},
+	})
+
+	_, err := ReadConfig(filepath.Join(root, "config.txt"))
+	var pe *PolicyError
+	if !errors.As(err, &pe) {
+		t.Fatalf("got %v, want a PolicyError", err)
+	}
+	if pe.Code != ExitSemantic || pe.File != filepath.Join(root, "b.conf") || pe.Line != 2 {
+		t.Errorf("got class %d at %s line %d", pe.Code, pe.File, pe.Line)
+	}
+	if !strings.Contains(pe.Message, "a.conf -> "+root+"/b.conf -> "+root+"/a.conf") {
+		t.Errorf("message doesn't name the chain: %s", pe.Message)
+	}
+}
+
+func TestIncludedRuleErrors(t *testing.T) {
+
+	root := t.TempDir()
+	writeConfig(t, root, map[string][]string{
+		"config.txt":       {"D: /etc", "INCLUDE: conf.d/*.conf"},
+		"conf.d/web.conf":  {"D: /var/www", "D: /etc/"},
+		"conf.d/typo.conf": {"X: /etc"},
+	})
+	config := filepath.Join(root, "config.txt")
+
+	// the syntax error is in the first file read, typo.conf
+	_, err := ValidateConfig(config)
+	if err == nil || !strings.Contains(err.Error(), "["+root+"/conf.d/typo.conf, Line 1]") {
+		t.Errorf("syntax error doesn't name the file: %v", err)
+	}
+
+	os.Remove(filepath.Join(root, "conf.d/typo.conf"))
+	_, err = ValidateConfig(config)
+	if err == nil || !strings.Contains(err.Error(), "["+root+"/conf.d/web.conf, Line 2]") ||
+		!strings.Contains(err.Error(), "same as line 1") {
+		t.Errorf("duplicate across files: %v", err)
+	}
+}
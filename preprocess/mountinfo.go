@@ -0,0 +1,212 @@
+package preprocess
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mount is one line of /proc/self/mountinfo
+type Mount struct {
+	ID       int
+	ParentID int
+
+	// Dev is the device of the superblock in the s_dev encoding of the
+	// kernel hooks, as in bpfloader.FileChangeEvent.Dev. All mounts of a
+	// filesystem share it: bind mounts and btrfs subvolumes.
+	Dev uint64
+
+	Root       string // directory of the filesystem mounted, "/" unless bind mount or subvolume
+	MountPoint string
+	FSType     string
+	Source     string // "overlay", "/dev/sda1", ...
+}
+
+// MountTable maps devices to the mounts of /proc/self/mountinfo
+type MountTable struct {
+	mounts []Mount          // in mount order, later mounts shadow earlier ones
+	byDev  map[uint64][]int // indexes into mounts
+}
+
+// NewMountTable indexes mounts by device
+func NewMountTable(mounts []Mount) *MountTable {
+
+	t := &MountTable{
+		mounts: mounts,
+		byDev:  make(map[uint64][]int),
+	}
+	for i, m := range mounts {
+		t.byDev[m.Dev] = append(t.byDev[m.Dev], i)
+	}
+	return t
+}
+
+// readMountTable parses the mountinfo file at path
+func readMountTable(path string) (*MountTable, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts, err := parseMountInfo(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewMountTable(mounts), nil
+}
+
+// parseMountInfo parses the format of proc(5) mountinfo:
+//
+//	<id> <parent id> <major:minor> <root> <mount point> <options> [<optional>...] - <fs type> <source> <super options>
+func parseMountInfo(r io.Reader) ([]Mount, error) {
+
+	var mounts []Mount
+	var lineNum int
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNum++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		// the optional fields end at a lone "-"
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+2 >= len(fields) {
+			return nil, fmt.Errorf("line %d: malformed mountinfo line", lineNum)
+		}
+
+		var m Mount
+		var err error
+
+		if m.ID, err = strconv.Atoi(fields[0]); err != nil {
+			return nil, fmt.Errorf("line %d: mount id: %w", lineNum, err)
+		}
+		if m.ParentID, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, fmt.Errorf("line %d: parent id: %w", lineNum, err)
+		}
+
+		major, minor, ok := strings.Cut(fields[2], ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: malformed device %q", lineNum, fields[2])
+		}
+		ma, err := strconv.ParseUint(major, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: device major: %w", lineNum, err)
+		}
+		mi, err := strconv.ParseUint(minor, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: device minor: %w", lineNum, err)
+		}
+		m.Dev = mkdev(ma, mi)
+
+		m.Root = unescapeMountPath(fields[3])
+		m.MountPoint = unescapeMountPath(fields[4])
+		m.FSType = fields[sep+1]
+		m.Source = unescapeMountPath(fields[sep+2])
+
+		mounts = append(mounts, m)
+	}
+
+	return mounts, scanner.Err()
+}
+
+// MountPoints returns the set of mount points of the table
+func (t *MountTable) MountPoints() map[string]uint8 {
+
+	points := make(map[string]uint8)
+	if t == nil {
+		return points
+	}
+	for _, m := range t.mounts {
+		points[m.MountPoint] = 1
+	}
+	return points
+}
+
+// Lookup returns the mount a file of dev was reached through.
+//
+// A filesystem can be mounted several times (bind mounts, btrfs
+// subvolumes), so path, if known, picks the mount of dev with the longest
+// mount point above it. Without a usable path the mount of the whole
+// filesystem is preferred, then the first one mounted.
+func (t *MountTable) Lookup(dev uint64, path string) (Mount, bool) {
+
+	if t == nil {
+		return Mount{}, false
+	}
+
+	candidates := t.byDev[dev]
+	if len(candidates) == 0 {
+		return Mount{}, false
+	}
+
+	best := -1
+	if filepath.IsAbs(path) {
+		path = filepath.Clean(path)
+		for _, i := range candidates {
+			mp := t.mounts[i].MountPoint
+			if !isUnder(path, mp) {
+				continue
+			}
+			// later mounts on the same point shadow earlier ones
+			if best < 0 || len(mp) >= len(t.mounts[best].MountPoint) {
+				best = i
+			}
+		}
+	}
+
+	if best < 0 {
+		for _, i := range candidates {
+			if t.mounts[i].Root == "/" {
+				best = i
+				break
+			}
+		}
+	}
+	if best < 0 {
+		best = candidates[0]
+	}
+
+	return t.mounts[best], true
+}
+
+// Containing returns the mount path lies on: the one with the longest mount
+// point above it, the last mounted if several are stacked.
+func (t *MountTable) Containing(path string) (Mount, bool) {
+
+	if t == nil || !filepath.IsAbs(path) {
+		return Mount{}, false
+	}
+	path = filepath.Clean(path)
+
+	best := -1
+	for i, m := range t.mounts {
+		if isUnder(path, m.MountPoint) && (best < 0 || len(m.MountPoint) >= len(t.mounts[best].MountPoint)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return Mount{}, false
+	}
+	return t.mounts[best], true
+}
+
+// mkdev encodes a device number like the kernel's MKDEV, which is what
+// the hooks report as s_dev
+func mkdev(major, minor uint64) uint64 {
+	return major<<20 | minor
+}
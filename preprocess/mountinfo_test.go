@@ -0,0 +1,112 @@
+package preprocess
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMountTableLookup(t *testing.T) {
+
+	tests := []struct {
+		file string
+		dev  uint64
+		path string
+		want string // mount point, "" for no mount
+		fs   string
+		src  string
+	}{
+		// bind mounts share the device of the filesystem
+		{"mountinfo.bind", mkdev(8, 1), "/etc/passwd", "/", "ext4", "/dev/sda1"},
+		{"mountinfo.bind", mkdev(8, 1), "/chroot/etc/passwd", "/chroot/etc", "ext4", "/dev/sda1"},
+		{"mountinfo.bind", mkdev(8, 1), "/mnt/my files/a", "/mnt/my files", "ext4", "/dev/sda1"},
+		{"mountinfo.bind", mkdev(8, 1), "", "/", "ext4", "/dev/sda1"},
+		{"mountinfo.bind", mkdev(8, 17), "/var/www/index.html", "/var/www", "xfs", "/dev/sdb1"},
+		{"mountinfo.bind", mkdev(8, 17), "/srv/x", "/srv", "xfs", "/dev/sdb1"},
+		// a path of another filesystem is no help
+		{"mountinfo.bind", mkdev(8, 17), "/etc/passwd", "/srv", "xfs", "/dev/sdb1"},
+		{"mountinfo.bind", mkdev(9, 9), "/etc/passwd", "", "", ""},
+
+		// btrfs subvolumes all report the superblock device
+		{"mountinfo.btrfs", mkdev(0, 26), "/home/alice/.bashrc", "/home", "btrfs", "/dev/nvme0n1p2"},
+		{"mountinfo.btrfs", mkdev(0, 26), "/var/log/syslog", "/var/log", "btrfs", "/dev/nvme0n1p2"},
+		{"mountinfo.btrfs", mkdev(0, 26), "/etc/shadow", "/", "btrfs", "/dev/nvme0n1p2"},
+		{"mountinfo.btrfs", mkdev(0, 26), "", "/", "btrfs", "/dev/nvme0n1p2"},
+		{"mountinfo.btrfs", mkdev(259, 1), "", "/boot/efi", "vfat", "/dev/nvme0n1p1"},
+
+		// every overlay gets its own anonymous device, minors above 255
+		{"mountinfo.overlay", mkdev(0, 412), "", "/var/lib/docker/overlay2/4f1c/merged", "overlay", "overlay"},
+		{"mountinfo.overlay", mkdev(0, 413), "/var/lib/docker/overlay2/9a2e/merged/etc/hosts", "/var/lib/docker/overlay2/9a2e/merged", "overlay", "overlay"},
+		{"mountinfo.overlay", mkdev(0, 46), "/tmp/x", "/tmp", "tmpfs", "scratch"},
+	}
+
+	for _, tt := range tests {
+		table, err := readMountTable("testdata/" + tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, ok := table.Lookup(tt.dev, tt.path)
+		if !ok {
+			if tt.want != "" {
+				t.Errorf("%s: Lookup(%#x, %q) found nothing, want %s", tt.file, tt.dev, tt.path, tt.want)
+			}
+			continue
+		}
+		if m.MountPoint != tt.want || m.FSType != tt.fs || m.Source != tt.src {
+			t.Errorf("%s: Lookup(%#x, %q) = %s %s %s, want %s %s %s", tt.file, tt.dev, tt.path,
+				m.MountPoint, m.FSType, m.Source, tt.want, tt.fs, tt.src)
+		}
+	}
+}
+
+func TestMountTableContaining(t *testing.T) {
+
+	table, err := readMountTable("testdata/mountinfo.overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tmpfs stacked last on /tmp shadows the first one
+	m, ok := table.Containing("/tmp/a/b")
+	if !ok || m.ID != 53 {
+		t.Errorf("Containing(/tmp/a/b) = %+v", m)
+	}
+
+	m, ok = table.Containing("/var/lib/docker")
+	if !ok || m.MountPoint != "/" {
+		t.Errorf("Containing(/var/lib/docker) = %+v", m)
+	}
+
+	if _, ok := table.Containing("relative"); ok {
+		t.Error("Containing accepted a relative path")
+	}
+}
+
+func TestParseMountInfoRejects(t *testing.T) {
+
+	for _, line := range []string{
+		"22 1 8:1 / / rw,relatime shared:1 ext4 /dev/sda1 rw",
+		"22 1 8-1 / / rw - ext4 /dev/sda1 rw",
+		"x 1 8:1 / / rw - ext4 /dev/sda1 rw",
+		"22 1 8:1 / / rw -",
+	} {
+		if _, err := parseMountInfo(strings.NewReader(line)); err == nil {
+			t.Errorf("parsed %q", line)
+		}
+	}
+}
+
+// rawDev has to agree with the devices of mountinfo, also for minors that
+// don't fit the old 8 bit encoding
+func TestRawDev(t *testing.T) {
+
+	for _, dev := range [][2]uint32{{8, 1}, {0, 412}, {259, 1}, {253, 300}} {
+		st := syscall.Stat_t{Dev: unix.Mkdev(dev[0], dev[1])}
+		if got, want := rawDev(&st), mkdev(uint64(dev[0]), uint64(dev[1])); got != want {
+			t.Errorf("rawDev(%d:%d) = %#x, want %#x", dev[0], dev[1], got, want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/** Keep the policy consistent with the mount table. A mount at or above a tracked
+directory shadows the tracked inodes, so the affected D rules are walked again */
+package preprocess
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"watchd/bpfloader"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// unescapeMountPath decodes the \NNN octal escapes the kernel uses for
+// space, tab, newline and backslash in mountinfo paths
+func unescapeMountPath(s string) string {
+
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// isUnder reports whether path is root or lies below it
+func isUnder(path string, root string) bool {
+	if root == "/" {
+		return true
+	}
+	return path == root || strings.HasPrefix(path, root+"/")
+}
+
+// RefreshMounts rescans the mount table and returns the mount points that
+// appeared or disappeared since the previous scan. Mount lookups use the
+// new table from then on.
+func (p *Cache) RefreshMounts() ([]string, error) {
+
+	table, err := readMountTable(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := table.MountPoints()
+	previous := p.mountTable.MountPoints()
+
+	var changed []string
+	for m := range mounts {
+		if _, ok := previous[m]; !ok {
+			changed = append(changed, m)
+		}
+	}
+	for m := range previous {
+		if _, ok := mounts[m]; !ok {
+			changed = append(changed, m)
+		}
+	}
+	sort.Strings(changed)
+
+	p.mountTable = table
+	return changed, nil
+}
+
+// Mount returns the mount a file of dev was reached through, path helps to
+// pick among several mounts of the same filesystem. See MountTable.Lookup.
+func (p *Cache) Mount(dev uint64, path string) (Mount, bool) {
+	return p.mountTable.Lookup(dev, path)
+}
+
+// MountContaining returns the mount path lies on, see MountTable.Containing
+func (p *Cache) MountContaining(path string) (Mount, bool) {
+	return p.mountTable.Containing(path)
+}
+
+// TrackedMountPoints filters mountPoints down to the ones at, above or below
+// a directory included by a D rule.
+func (p *Cache) TrackedMountPoints(mountPoints []string) []string {
+
+	var tracked []string
+	for _, m := range mountPoints {
+		for _, token := range p.tokens {
+			if token.command != "D" {
+				continue
+			}
+			// a pattern can match anything below its literal part
+			root := globRoot(token.argument)
+			if isUnder(root, m) || isUnder(m, root) {
+				tracked = append(tracked, m)
+				break
+			}
+		}
+	}
+	return tracked
+}
+
+// RewalkMounts walks again every D and IF rule overlapping one of mountPoints
+// and loads inodes not already tracked into the policy table.
+//
+// It returns the number of entries added. Entries of the shadowed filesystem
+// are kept, they become live again once it is unmounted.
+func (p *Cache) RewalkMounts(mountPoints []string, bpf *bpfloader.BPF) (int, error) {
+
+	// exclusions are keyed by inode, so they have to be resolved again as well
+	exlPol := parseExcludePolicy(p.tokens)
+	walked := make(bpfloader.TrackedFileMap)
+
+	// patterns are expanded again, the mount may bring new matches
+	order := walkOrder(p.tokens)
+
+	for _, m := range mountPoints {
+		for _, w := range order {
+			path, token := w.path, w.rule
+			switch {
+			case isUnder(path, m):
+				// the whole rule lives on the new mount
+				if token.command == "D" {
+					walkDir(path, &walked, &exlPol, token, nil)
+				} else {
+					addFile(path, &walked, token, nil)
+				}
+				p.PathCache.buildCache(path)
+
+			case token.command == "D" && isUnder(m, path) && !p.excludedPath(m):
+				// the mount is somewhere inside the rule
+				walkDir(m, &walked, &exlPol, token, nil)
+				p.PathCache.buildMountCache(m)
+			}
+		}
+	}
+
+	var count int
+	for k, v := range walked {
+		if _, ok := p.LookupTable[k]; ok {
+			continue
+		}
+		// no policy table when events don't come from eBPF
+		if bpf != nil {
+			if err := bpf.Objects.PolicyTable.Put(k, v); err != nil {
+				return count, fmt.Errorf("loading %d entries: %w", len(walked)-count, err)
+			}
+		}
+		p.LookupTable[k] = v
+		count++
+	}
+
+	return count, nil
+}
+
+// excludedPath reports whether path or one of its parents is excluded by
+// an E rule
+func (p *Cache) excludedPath(path string) bool {
+	for _, token := range p.tokens {
+		if token.command == "E" && coveredBy(token.argument, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildMountCache adds a mount point inside an already cached directory to
+// the path cache
+func (p *PathCache) buildMountCache(mountPoint string) {
+
+	info, err := os.Stat(filepath.Dir(mountPoint))
+	if err != nil {
+		log.Printf("WARN : %v", err)
+		return
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		log.Printf("WARN : %v", err)
+		return
+	}
+	parent := CacheKey{
+		Inode_number: uint64(stat.Ino),
+		Dev_id:       rawDev(stat),
+	}
+
+	p.__buildcache(mountPoint, &parent)
+}
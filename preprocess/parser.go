@@ -3,104 +3,238 @@ package preprocess
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"watchd/bpfloader"
 )
 
 type token struct {
+	file     string // included file the rule is from, empty for the config itself
 	lineNum  int
 	command  string
 	argument string
+	text     string // line of a version 2 file, whose arguments may be quoted
+	col      int    // where the argument starts in text
+	comment  string // comment lines before the rule and its inline comment
+	options  RuleOptions
 }
 
 type excludePolicy struct {
-	excludeDirs  map[bpfloader.TrackedFileKey]uint8
+	excludeDirs  map[bpfloader.TrackedFileKey]string // argument of the E rule
 	excludeFiles map[bpfloader.TrackedFileKey]uint8
 	excludeExts  map[string]uint8
 	excludeSuffs []string
+	excludeGlobs []string // E patterns, matched against the path
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 /* Read and Tokenize*/
-func ReadConfig(configPath string) ([]token, error) {
 
-	f, err := os.Open(configPath)
-	if err != nil {
-		return nil, err
+// ReadConfig reads the rules of the policy at configPath. INCLUDE rules are
+// replaced by the rules of the files they match, see configReader.
+func ReadConfig(configPath string) ([]token, error) {
+	r := newConfigReader()
+	tokens, err := r.read(configPath, nil)
+	for _, m := range r.missing {
+		log.Printf("WARN: %s not found, skipped", m)
 	}
-	defer f.Close()
+	return tokens, err
+}
+
+// tokenize splits the lines of a policy file into rules, file is set for
+// included files. A "version:" header before the first rule selects the
+// grammar of the file, see grammar.go.
+func tokenize(r io.Reader, file string) ([]token, error) {
+	tokens, _, err := tokenizeComments(r, file)
+	return tokens, err
+}
+
+// tokenizeComments is tokenize keeping the comments: the comment lines
+// before a rule, and its inline comment, go with the rule, the ones after
+// the last rule are returned
+func tokenizeComments(r io.Reader, file string) ([]token, string, error) {
 
 	var tokens []token
-	scanner := bufio.NewScanner(f)
+	var comments []string
+	scanner := bufio.NewScanner(r)
 	var lineNum int
 	lineNum = 0
+	version := grammarV1
+	rules := 0
 	for scanner.Scan() {
 		lineNum++
 		line := scanner.Text()
-		if line == "" || strings.HasPrefix(line, "#") {
+		if line == "" || strings.HasPrefix(line, "#") || (version == grammarV2 && isComment(line)) {
+			if c, ok := strings.CutPrefix(strings.TrimSpace(line), "#"); ok {
+				comments = append(comments, strings.TrimSpace(c))
+			}
+			continue
+		}
+		rules++
+
+		if command, value, ok := strings.Cut(line, ":"); ok && strings.TrimSpace(command) == "version" {
+			if rules > 1 {
+				return nil, "", &PolicyError{Code: ExitSyntax, File: file, Line: lineNum, Text: line, Message: "version must come before the rules", Hint: "move it to the top of the file"}
+			}
+			v, ok := parseVersion(value)
+			if !ok {
+				return nil, "", &PolicyError{Code: ExitSyntax, File: file, Line: lineNum, Text: line, Col: len(command) + 1, Message: "unsupported version", Hint: "supported versions: 1, 2"}
+			}
+			version = v
 			continue
 		}
+
+		if version == grammarV2 {
+			command, items, comment, err := lexRule(line)
+			if err != nil {
+				err.File, err.Line = file, lineNum
+				return nil, "", err
+			}
+			command, events, err := splitEvents(command, line)
+			if err != nil {
+				err.File, err.Line = file, lineNum
+				return nil, "", err
+			}
+			if comment != "" {
+				comments = append(comments, comment)
+			}
+			for i, it := range items {
+				t := token{
+					file:     file,
+					lineNum:  lineNum,
+					command:  command,
+					argument: it.text,
+					text:     line,
+					col:      it.col,
+					options:  RuleOptions{Events: events},
+				}
+				// a list is one line, its comment goes with the first item
+				if i == 0 {
+					t.comment = strings.Join(comments, "\n")
+				}
+				tokens = append(tokens, t)
+			}
+			comments = nil
+			continue
+		}
+
 		fields := strings.SplitN(line, ":", 2)
 		if len(fields) < 2 {
-			return nil, fmt.Errorf("ERROR [Line %d]: colon missing\n  %s\n  ^\nuse 'Command: Argument' format", lineNum, line)
+			return nil, "", &PolicyError{Code: ExitSyntax, File: file, Line: lineNum, Text: line, Message: "colon missing", Hint: "use 'Command: Argument' format"}
 		} else if len(fields) > 2 {
-			return nil, fmt.Errorf("ERROR [Line %d]: extra colon\n  %s\n  ^\nuse 'Command: Argument' format", lineNum, line)
+			return nil, "", &PolicyError{Code: ExitSyntax, File: file, Line: lineNum, Text: line, Message: "extra colon", Hint: "use 'Command: Argument' format"}
 		}
 
+		command, events, perr := splitEvents(strings.TrimSpace(fields[0]), line)
+		if perr != nil {
+			perr.File, perr.Line = file, lineNum
+			return nil, "", perr
+		}
 		tokens = append(tokens, token{
+			file:     file,
 			lineNum:  lineNum,
-			command:  strings.TrimSpace(fields[0]),
+			command:  command,
 			argument: strings.TrimSpace(fields[1]),
+			comment:  strings.Join(comments, "\n"),
+			options:  RuleOptions{Events: events},
 		})
+		comments = nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", fsError(err, nil)
 	}
-	return tokens, scanner.Err()
+	return tokens, strings.Join(comments, "\n"), nil
 }
 
 // Validate Syntax
 func SyntaxValidation(tokens []token) error {
 	for _, token := range tokens {
 		if token.command != "D" && token.command != "E" && token.command != "IF" && token.command != "EE" && token.command != "ES" {
-			return fmt.Errorf("ERROR [Line %d]: invalid command: %s\n  %s: %s\n  ^\nvalid commands: D, E, IF, EF, EE, ES", token.lineNum, token.command, token.command, token.argument)
+			return ruleError(ExitSyntax, token, false, "valid commands: D, E, IF, EE, ES, INCLUDE", "invalid command: %s", token.command)
 		}
 		if token.argument == "" {
-			return fmt.Errorf("ERROR [Line %d]: empty argument\n  %s: %s\n  ^\nprovide argument for command", token.lineNum, token.command, token.argument)
+			return ruleError(ExitSyntax, token, true, "provide argument for command", "empty argument")
+		}
+		if !strings.HasPrefix(token.argument, "/") && isPathRule(token.command) {
+			return ruleError(ExitSyntax, token, true, "provide absolute path", "argument must start with /")
 		}
-		if !strings.HasPrefix(token.argument, "/") && (token.command == "D" || token.command == "IF" || token.command == "E") {
-			return fmt.Errorf("ERROR [Line %d]: argument must start with /\n  %s: %s\n  ^\nprovide absolute path", token.lineNum, token.command, token.argument)
+		if token.command == "EE" && !strings.HasPrefix(token.argument, ".") {
+			return ruleError(ExitSyntax, token, true, "write the extension with its dot: ."+token.argument, "extension must start with .")
+		}
+		if hasGlob(token.argument) && isPathRule(token.command) {
+			if err := validGlob(token.argument); err != nil {
+				return ruleError(ExitSyntax, token, true, "use *, ?, [...] within a segment and ** as a whole segment", "%v", err)
+			}
+		}
+		if err := validOptions(token); err != nil {
+			return err
 		}
 	}
 	return nil
 
 }
 
-// Construct PolicyMap <PolicyKey, PolicyValue>
-func constructPolicyMap(tokens []token, exlPol excludePolicy) (bpfloader.TrackedFileMap, error) {
+// Construct PolicyMap <PolicyKey, PolicyValue>, recording in plan why each
+// path is in or out if plan isn't nil
+func constructPolicyMap(tokens []token, exlPol excludePolicy, plan *Plan) (bpfloader.TrackedFileMap, error) {
 
 	policyMap := make(bpfloader.TrackedFileMap)
 
-	for _, token := range tokens {
+	for _, w := range walkOrder(tokens) {
+		if w.rule.command == "D" {
+			walkDir(w.path, &policyMap, &exlPol, w.rule, plan)
+		} else {
+			addFile(w.path, &policyMap, w.rule, plan)
+		}
+	}
 
-		switch token.command {
+	return policyMap, nil
+}
+
+// ruleWalk is a path of a D or IF rule to walk
+type ruleWalk struct {
+	path string
+	rule token
+}
+
+// walkOrder returns the paths of the D and IF rules in the order the walk
+// takes them. D paths come deepest first, the most specific D claims its
+// subtree with its options and the walk of an outer D stops there. IF paths
+// come last, an IF wins over any D.
+func walkOrder(tokens []token) []ruleWalk {
+
+	var dirs, files []ruleWalk
+	for _, t := range tokens {
+		switch t.command {
 		case "D":
-			walkDir(token.argument, &policyMap, &exlPol)
+			for _, path := range t.paths() {
+				dirs = append(dirs, ruleWalk{path: path, rule: t})
+			}
 		case "IF":
-			addFile(token.argument, &policyMap)
-		default:
-			continue
+			for _, path := range t.paths() {
+				files = append(files, ruleWalk{path: path, rule: t})
+			}
 		}
 	}
 
-	return policyMap, nil
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return len(splitPath(dirs[i].path)) > len(splitPath(dirs[j].path))
+	})
+	return append(dirs, files...)
 }
 
-func walkDir(dir string, policyMap *bpfloader.TrackedFileMap, exlPol *excludePolicy) {
+// walkDir adds dir and everything below it that isn't excluded, rule is the
+// D rule walked
+func walkDir(dir string, policyMap *bpfloader.TrackedFileMap, exlPol *excludePolicy, rule token, plan *Plan) {
 
 	info, err := os.Stat(dir)
 	if err != nil {
-		fmt.Printf("WARN: %s not found %s\n", dir, err)
+		log.Printf("WARN: %s not found %s", dir, err)
 		return
 	}
 	stat := info.Sys().(*syscall.Stat_t)
@@ -110,7 +244,8 @@ func walkDir(dir string, policyMap *bpfloader.TrackedFileMap, exlPol *excludePol
 		Dev:         rawDev(stat),
 	}
 	value := bpfloader.TrackedFileValue{
-		FileSize: info.Size(),
+		FileSize:  info.Size(),
+		EventMask: rule.options.EventMask(),
 	}
 
 	if _, ok := (*policyMap)[key]; ok {
@@ -118,9 +253,16 @@ func walkDir(dir string, policyMap *bpfloader.TrackedFileMap, exlPol *excludePol
 	}
 
 	//check if it is excluded
-	if exlPol.excludeDirs[key] == 1 {
+	if arg, ok := exlPol.excludeDirs[key]; ok {
+		plan.exclude(dir, info.IsDir(), "E", arg)
 		return
 	}
+	for _, pattern := range exlPol.excludeGlobs {
+		if matchGlob(pattern, dir) {
+			plan.exclude(dir, info.IsDir(), "E", pattern)
+			return
+		}
+	}
 
 	filename := info.Name()
 	ext := filepath.Ext(filename)
@@ -128,6 +270,7 @@ func walkDir(dir string, policyMap *bpfloader.TrackedFileMap, exlPol *excludePol
 	// check if it is excluded by suffix
 	for _, suff := range exlPol.excludeSuffs {
 		if strings.HasSuffix(filename, suff) {
+			plan.exclude(dir, info.IsDir(), "ES", suff)
 			return
 		}
 	}
@@ -135,31 +278,33 @@ func walkDir(dir string, policyMap *bpfloader.TrackedFileMap, exlPol *excludePol
 	// check if it is excluded by extension
 	_, ok := exlPol.excludeExts[ext]
 	if ok {
+		plan.exclude(dir, info.IsDir(), "EE", ext)
 		return
 	}
 
 	(*policyMap)[key] = value
+	plan.include(key, dir, info.IsDir(), rule)
 	//fmt.Printf("key (%d, %d)  : Value %d \n", key.Inode_number, key.Dev, value.Val)
 
 	if info.IsDir() {
 		entries, err := os.ReadDir(dir)
 		if err != nil {
-			fmt.Printf("WARN: %s not found %s\n", dir, err)
+			log.Printf("WARN: %s not found %s", dir, err)
 			return
 		}
 		for _, entry := range entries {
-			walkDir(dir+"/"+entry.Name(), policyMap, exlPol)
+			walkDir(dir+"/"+entry.Name(), policyMap, exlPol, rule, plan)
 		}
 	}
 
 	return
 }
 
-func addFile(file string, policyMap *bpfloader.TrackedFileMap) {
+func addFile(file string, policyMap *bpfloader.TrackedFileMap, rule token, plan *Plan) {
 
 	info, err := os.Stat(file)
 	if err != nil {
-		fmt.Printf("WARN: %s not found %s\n", file, err)
+		log.Printf("WARN: %s not found %s", file, err)
 		return
 	}
 	stat := info.Sys().(*syscall.Stat_t)
@@ -169,13 +314,13 @@ func addFile(file string, policyMap *bpfloader.TrackedFileMap) {
 		Dev:         rawDev(stat),
 	}
 	value := bpfloader.TrackedFileValue{
-		FileSize: info.Size(),
+		FileSize:  info.Size(),
+		EventMask: rule.options.EventMask(),
 	}
 
-	if _, ok := (*policyMap)[key]; ok {
-		return
-	}
+	// IF wins over the D that walked the file already, its mask too
 	(*policyMap)[key] = value
+	plan.include(key, file, info.IsDir(), rule)
 	//fmt.Printf("key (%d, %d)  : Value %d \n", key.Inode_number, key.Dev, value.Val)
 
 	return
@@ -184,21 +329,26 @@ func addFile(file string, policyMap *bpfloader.TrackedFileMap) {
 func parseExcludePolicy(tokens []token) excludePolicy {
 
 	exlPol := excludePolicy{
-		excludeDirs:  make(map[bpfloader.TrackedFileKey]uint8),
+		excludeDirs:  make(map[bpfloader.TrackedFileKey]string),
 		excludeFiles: make(map[bpfloader.TrackedFileKey]uint8),
 		excludeExts:  make(map[string]uint8),
 		excludeSuffs: make([]string, 0),
+		excludeGlobs: make([]string, 0),
 	}
 
 	for _, token := range tokens {
 		switch token.command {
 		case "E":
+			if hasGlob(token.argument) {
+				exlPol.excludeGlobs = append(exlPol.excludeGlobs, token.argument)
+				continue
+			}
 			policy, err := generatePolicyFrompath(token.argument)
 			if err != nil {
-				fmt.Printf("WARN: %s not found %s\n", token.argument, err)
+				log.Printf("WARN: %s not found %s", token.argument, err)
 				continue
 			}
-			exlPol.excludeDirs[policy.Key] = 1
+			exlPol.excludeDirs[policy.Key] = token.argument
 
 		case "EE":
 			ext := token.argument
@@ -214,16 +364,16 @@ func parseExcludePolicy(tokens []token) excludePolicy {
 
 	//debug
 	for k, v := range exlPol.excludeDirs {
-		fmt.Printf("excludeDirs: %v -> %d\n", k, v)
+		log.Printf("excludeDirs: %v -> %s", k, v)
 	}
 	for k, v := range exlPol.excludeFiles {
-		fmt.Printf("excludeFiles: %v -> %d\n", k, v)
+		log.Printf("excludeFiles: %v -> %d", k, v)
 	}
 	for k, v := range exlPol.excludeExts {
-		fmt.Printf("excludeExts: %v -> %d\n", k, v)
+		log.Printf("excludeExts: %v -> %d", k, v)
 	}
 	for _, v := range exlPol.excludeSuffs {
-		fmt.Printf("excludeSuffs: %v\n", v)
+		log.Printf("excludeSuffs: %v", v)
 	}
 
 	return exlPol
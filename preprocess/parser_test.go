@@ -0,0 +1,112 @@
+package preprocess
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"watchd/bpfloader"
+)
+
+func TestEventMasks(t *testing.T) {
+
+	root := t.TempDir()
+	mkTree(t, root, "www/index.html", "www/passwd", "etc/passwd")
+
+	config := strings.Join([]string{
+		"D[create, delete]: " + root + "/www",
+		"D: " + root + "/etc",
+		"IF[modify]: " + root + "/www/passwd",
+	}, "\n")
+	tokens, err := tokenize(strings.NewReader(config), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SyntaxValidation(tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens[0].command != "D" || !reflect.DeepEqual(tokens[0].options.Events, []string{"create", "delete"}) {
+		t.Fatalf("rule 1: %+v", tokens[0])
+	}
+
+	policyMap, err := constructPolicyMap(tokens, parseExcludePolicy(tokens), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]uint32{
+		"www":            bpfloader.EventCreate | bpfloader.EventDelete,
+		"www/index.html": bpfloader.EventCreate | bpfloader.EventDelete,
+		"www/passwd":     bpfloader.EventModify, // IF wins over D
+		"etc/passwd":     0,
+	} {
+		if got := policyMap[inodeKey(t, filepath.Join(root, path))].EventMask; got != want {
+			t.Errorf("%s: mask %#x, want %#x", path, got, want)
+		}
+	}
+}
+
+func TestNestedEventMasks(t *testing.T) {
+
+	root := t.TempDir()
+	mkTree(t, root, "var/log/syslog", "var/www/index.html", "var/www/static/app.js")
+
+	outer := "D: " + root + "/var"
+	inner := "D[create,delete]: " + root + "/var/www"
+
+	for _, order := range [][]string{{outer, inner}, {inner, outer}} {
+		tokens, err := tokenize(strings.NewReader(strings.Join(order, "\n")), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		policyMap, err := constructPolicyMap(tokens, parseExcludePolicy(tokens), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the most specific D wins, whatever the order
+		for path, want := range map[string]uint32{
+			"var":                   0,
+			"var/log/syslog":        0,
+			"var/www":               bpfloader.EventCreate | bpfloader.EventDelete,
+			"var/www/static/app.js": bpfloader.EventCreate | bpfloader.EventDelete,
+		} {
+			if got := policyMap[inodeKey(t, filepath.Join(root, path))].EventMask; got != want {
+				t.Errorf("%v: %s: mask %#x, want %#x", order, path, got, want)
+			}
+		}
+
+		policy := Cache{tokens: tokens}
+		ex := policy.Explain(filepath.Join(root, "var/www/static/app.js"))
+		if ex.Winner == nil || ex.Winner.Argument != root+"/var/www" {
+			t.Errorf("%v: explain picks %v, want the D of var/www", order, ex.Winner)
+		}
+	}
+}
+
+func TestEventMaskErrors(t *testing.T) {
+
+	for _, config := range []string{
+		"D[create: /etc",
+		"D[create,,delete]: /etc",
+		"version: 2\nD[]: /etc",
+	} {
+		if _, err := tokenize(strings.NewReader(config), ""); err == nil {
+			t.Errorf("%q accepted", config)
+		}
+	}
+
+	for _, config := range []string{
+		"D[write]: /etc",
+		"E[create]: /etc",
+		"EE[delete]: .log",
+	} {
+		tokens, err := tokenize(strings.NewReader(config), "")
+		if err != nil {
+			t.Errorf("%q: %v", config, err)
+			continue
+		}
+		if err := SyntaxValidation(tokens); err == nil {
+			t.Errorf("%q accepted", config)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package preprocess
 
 import (
 	"bytes"
-	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"syscall"
@@ -21,6 +21,18 @@ type CacheValue struct {
 
 type PathCache struct {
 	cache map[CacheKey]CacheValue
+
+	// further names of hard linked files, the first name is in cache
+	links map[CacheKey][]CacheValue
+
+	// every name of cache and links, for Child
+	children map[childName]CacheKey
+}
+
+// childName is a name in a directory
+type childName struct {
+	parent CacheKey
+	name   string
 }
 
 func (p *PathCache) Get(key CacheKey) (CacheValue, bool) {
@@ -29,11 +41,19 @@ func (p *PathCache) Get(key CacheKey) (CacheValue, bool) {
 }
 
 func (p *PathCache) Put(key CacheKey, value CacheValue) {
+	if old, ok := p.cache[key]; ok {
+		p.unindex(key, old)
+	}
 	p.cache[key] = value
+	p.index(key, value)
 }
 
 func (p *PathCache) Delete(key CacheKey) {
+	for _, name := range p.Names(key) {
+		p.unindex(key, name)
+	}
 	delete(p.cache, key)
+	delete(p.links, key)
 }
 
 func (p *PathCache) Contains(key CacheKey) bool {
@@ -42,6 +62,140 @@ func (p *PathCache) Contains(key CacheKey) bool {
 
 }
 
+// Child returns the key of the entry named name under parent
+func (p *PathCache) Child(parent CacheKey, name string) (CacheKey, bool) {
+	key, ok := p.children[childName{parent, name}]
+	return key, ok
+}
+
+// index records value as a name of key for Child
+func (p *PathCache) index(key CacheKey, value CacheValue) {
+	if value.Parent == nil {
+		return
+	}
+	if p.children == nil {
+		p.children = make(map[childName]CacheKey)
+	}
+	p.children[childName{*value.Parent, value.Filename}] = key
+}
+
+// unindex forgets value as a name of key, unless the name went to another
+// key since
+func (p *PathCache) unindex(key CacheKey, value CacheValue) {
+	if value.Parent == nil {
+		return
+	}
+	name := childName{*value.Parent, value.Filename}
+	if p.children[name] == key {
+		delete(p.children, name)
+	}
+}
+
+// Names returns every known name of key, more than one for hard linked files
+func (p *PathCache) Names(key CacheKey) []CacheValue {
+	value, ok := p.cache[key]
+	if !ok {
+		return nil
+	}
+	return append([]CacheValue{value}, p.links[key]...)
+}
+
+// Paths returns the full path of every known name of key. Names whose
+// parents are not all known are left out.
+func (p *PathCache) Paths(key CacheKey) []string {
+
+	var paths []string
+	for _, name := range p.Names(key) {
+		if path, ok := p.path(name); ok {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// path follows the parents of value up to the root of the cache
+func (p *PathCache) path(value CacheValue) (string, bool) {
+
+	parts := []string{value.Filename}
+	// the cache has no cycles, the bound guards against a corrupt one
+	for i := 0; value.Parent != nil && i < 4096; i++ {
+		var ok bool
+		if value, ok = p.cache[*value.Parent]; !ok {
+			return "", false
+		}
+		parts = append(parts, value.Filename)
+	}
+	if value.Parent != nil {
+		return "", false
+	}
+
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return filepath.Clean("/" + filepath.Join(parts...)), true
+}
+
+// AddLink records name under parent as a further name of key. It is a
+// no-op for a name already known.
+func (p *PathCache) AddLink(key CacheKey, value CacheValue) {
+
+	for _, name := range p.Names(key) {
+		if sameName(name, value) {
+			return
+		}
+	}
+	p.index(key, value)
+	if _, ok := p.cache[key]; !ok {
+		p.cache[key] = value
+		return
+	}
+	if p.links == nil {
+		p.links = make(map[CacheKey][]CacheValue)
+	}
+	p.links[key] = append(p.links[key], value)
+}
+
+// Unlink forgets the name of key under parent. If it was the first name,
+// the next known one takes its place. The entry goes once no name is left.
+func (p *PathCache) Unlink(key CacheKey, parent CacheKey, name string) {
+
+	gone := CacheValue{Parent: &parent, Filename: name}
+	links := p.links[key]
+	p.unindex(key, gone)
+
+	if value, ok := p.cache[key]; ok && sameName(value, gone) {
+		if len(links) == 0 {
+			delete(p.cache, key)
+			return
+		}
+		p.cache[key] = links[0]
+		links = links[1:]
+	} else {
+		for i, link := range links {
+			if sameName(link, gone) {
+				links = append(links[:i:i], links[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if len(links) == 0 {
+		delete(p.links, key)
+	} else {
+		p.links[key] = links
+	}
+}
+
+func sameName(a, b CacheValue) bool {
+	if a.Filename != b.Filename {
+		return false
+	}
+	if a.Parent == nil || b.Parent == nil {
+		return a.Parent == b.Parent
+	}
+	return *a.Parent == *b.Parent
+}
+
 // / Path Map
 var base_key = CacheKey{
 	Inode_number: 0,
@@ -64,17 +218,17 @@ func (p *PathCache) buildCache(folderpath string) {
 
 	info, err := os.Stat(folderpath)
 	if err != nil {
-		fmt.Printf("WARN : %v\n", err)
+		log.Printf("WARN : %v", err)
 		return
 	}
 
 	if !info.IsDir() {
-		fmt.Printf("WARN : %v is not a directory\n", folderpath)
+		log.Printf("WARN : %v is not a directory", folderpath)
 		return
 	}
 	stat, ok := info.Sys().(*syscall.Stat_t)
 	if !ok {
-		fmt.Printf("WARN : %v\n", err)
+		log.Printf("WARN : %v", err)
 		return
 	}
 	key := CacheKey{
@@ -85,17 +239,17 @@ func (p *PathCache) buildCache(folderpath string) {
 		return
 	}
 
-	p.cache[key] = CacheValue{
+	p.Put(key, CacheValue{
 		Parent:   &base_key, // parent is the parent of the current folder
 		Filename: folderpath,
-	}
+	})
 
 	//log.Println("Building cache for", folderpath, "Key : (", key.inode_number, ",", key.dev_id, ")", "Value : (", p.cache[key].parent.inode_number, ",", p.cache[key].parent.dev_id, ",", p.cache[key].filename, ")")
 
 	// process subfolders
 	entries, err := os.ReadDir(folderpath)
 	if err != nil {
-		fmt.Printf("WARN : %v\n", err)
+		log.Printf("WARN : %v", err)
 		return
 	}
 	for _, entry := range entries {
@@ -108,12 +262,12 @@ func (p *PathCache) __buildcache(folderpath string, parent *CacheKey) {
 
 	info, err := os.Stat(folderpath)
 	if err != nil {
-		fmt.Printf("WARN : %v\n", err)
+		log.Printf("WARN : %v", err)
 		return
 	}
 	stat, ok := info.Sys().(*syscall.Stat_t)
 	if !ok {
-		fmt.Printf("WARN : %v\n", err)
+		log.Printf("WARN : %v", err)
 		return
 	}
 	key := CacheKey{
@@ -121,13 +275,17 @@ func (p *PathCache) __buildcache(folderpath string, parent *CacheKey) {
 		Dev_id:       rawDev(stat),
 	}
 	if _, ok := p.cache[key]; ok {
+		// another name of a hard linked file
+		if !info.IsDir() {
+			p.AddLink(key, CacheValue{Parent: parent, Filename: info.Name()})
+		}
 		return
 	}
 
-	p.cache[key] = CacheValue{
+	p.Put(key, CacheValue{
 		Parent:   parent,
 		Filename: info.Name(),
-	}
+	})
 
 	//log.Println("Building cache for", folderpath, "Key : (", key.inode_number, ",", key.dev_id, ")", "Value : (", p.cache[key].parent.inode_number, ",", p.cache[key].parent.dev_id, ",", p.cache[key].filename, ")")
 
@@ -135,7 +293,7 @@ func (p *PathCache) __buildcache(folderpath string, parent *CacheKey) {
 
 		entries, err := os.ReadDir(folderpath)
 		if err != nil {
-			fmt.Printf("WARN : %v\n", err)
+			log.Printf("WARN : %v", err)
 			return
 		}
 		for _, entry := range entries {
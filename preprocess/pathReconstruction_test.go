@@ -0,0 +1,97 @@
+package preprocess
+
+import "testing"
+
+func TestPathCacheLinks(t *testing.T) {
+
+	var p PathCache
+	p.initPathCache()
+
+	dirA := CacheKey{Inode_number: 10, Dev_id: 1}
+	dirB := CacheKey{Inode_number: 11, Dev_id: 1}
+	file := CacheKey{Inode_number: 20, Dev_id: 1}
+
+	p.Put(file, CacheValue{Parent: &dirA, Filename: "passwd"})
+	p.AddLink(file, CacheValue{Parent: &dirB, Filename: "passwd.bak"})
+	p.AddLink(file, CacheValue{Parent: &dirB, Filename: "passwd.bak"})
+
+	if n := len(p.Names(file)); n != 2 {
+		t.Fatalf("got %d names, want 2", n)
+	}
+
+	// first name goes, the link takes its place
+	p.Unlink(file, dirA, "passwd")
+	names := p.Names(file)
+	if len(names) != 1 || names[0].Filename != "passwd.bak" || *names[0].Parent != dirB {
+		t.Fatalf("after unlink got %+v", names)
+	}
+
+	// unknown names are ignored
+	p.Unlink(file, dirA, "shadow")
+	if !p.Contains(file) {
+		t.Fatal("entry dropped on unlink of an unknown name")
+	}
+
+	p.Unlink(file, dirB, "passwd.bak")
+	if p.Contains(file) || p.Names(file) != nil {
+		t.Fatal("entry kept after the last name was unlinked")
+	}
+}
+
+func TestPathCachePaths(t *testing.T) {
+
+	var p PathCache
+	p.initPathCache()
+
+	root := CacheKey{Inode_number: 2, Dev_id: 1}
+	dir := CacheKey{Inode_number: 10, Dev_id: 1}
+	file := CacheKey{Inode_number: 20, Dev_id: 1}
+	orphan := CacheKey{Inode_number: 30, Dev_id: 1}
+	unknown := CacheKey{Inode_number: 99, Dev_id: 1}
+
+	p.Put(root, CacheValue{Parent: &base_key, Filename: "/etc"})
+	p.Put(dir, CacheValue{Parent: &root, Filename: "ssh"})
+	p.Put(file, CacheValue{Parent: &dir, Filename: "sshd_config"})
+	p.AddLink(file, CacheValue{Parent: &root, Filename: "sshd_config.link"})
+	p.Put(orphan, CacheValue{Parent: &unknown, Filename: "lost"})
+
+	got := p.Paths(file)
+	if len(got) != 2 || got[0] != "/etc/ssh/sshd_config" || got[1] != "/etc/sshd_config.link" {
+		t.Errorf("got %v", got)
+	}
+	if got := p.Paths(orphan); got != nil {
+		t.Errorf("orphan: got %v", got)
+	}
+}
+
+func TestPathCacheChild(t *testing.T) {
+
+	var p PathCache
+	p.initPathCache()
+
+	dirA := CacheKey{Inode_number: 10, Dev_id: 1}
+	dirB := CacheKey{Inode_number: 11, Dev_id: 1}
+	file := CacheKey{Inode_number: 20, Dev_id: 1}
+	other := CacheKey{Inode_number: 21, Dev_id: 1}
+
+	p.Put(file, CacheValue{Parent: &dirA, Filename: "passwd"})
+	p.AddLink(file, CacheValue{Parent: &dirB, Filename: "passwd.bak"})
+
+	for _, name := range []CacheValue{{Parent: &dirA, Filename: "passwd"}, {Parent: &dirB, Filename: "passwd.bak"}} {
+		if key, ok := p.Child(*name.Parent, name.Filename); !ok || key != file {
+			t.Errorf("Child(%v, %s) = %v, %v", *name.Parent, name.Filename, key, ok)
+		}
+	}
+
+	// the name moves to another inode, unlinking the old one keeps it
+	p.Put(other, CacheValue{Parent: &dirB, Filename: "passwd.bak"})
+	p.Unlink(file, dirB, "passwd.bak")
+	if key, ok := p.Child(dirB, "passwd.bak"); !ok || key != other {
+		t.Errorf("after rename got %v, %v", key, ok)
+	}
+
+	p.Delete(file)
+	if _, ok := p.Child(dirA, "passwd"); ok {
+		t.Error("name kept after Delete")
+	}
+}
@@ -0,0 +1,156 @@
+/** The resolved watch set of a policy, to review it before deploying */
+package preprocess
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"watchd/bpfloader"
+)
+
+// Plan lists what the walk of a policy includes and excludes, and why
+type Plan struct {
+	Included []PlanEntry `json:"included"` // files and directories in the policy table
+	Excluded []PlanEntry `json:"excluded"` // roots of the subtrees skipped
+
+	Entries  int `json:"entries"`  // distinct inodes, the policy table entries needed
+	Files    int `json:"files"`    // included files
+	Dirs     int `json:"dirs"`     // included directories
+	Capacity int `json:"capacity"` // size of the policy table
+
+	tokens []token
+	seen   map[bpfloader.TrackedFileKey]int // index in Included of the entry of an inode
+}
+
+// PlanEntry is a path and the rule deciding about it
+type PlanEntry struct {
+	Path string `json:"path"`
+	Dir  bool   `json:"dir,omitempty"`
+	File string `json:"file,omitempty"` // included file of the rule, empty for the config itself
+	Line int    `json:"line"`
+	Rule string `json:"rule"` // "D: /etc"
+}
+
+// BuildPlan walks the policy at configPath like ParseConfig does, without
+// loading anything, and records why each path is in or out. capacity is the
+// number of entries of the policy table.
+func BuildPlan(configPath string, capacity int) (*Plan, error) {
+
+	tokens, err := ReadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := SyntaxValidation(tokens); err != nil {
+		return nil, err
+	}
+	if _, err := SemanticValidation(tokens); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Capacity: capacity, tokens: tokens}
+	policyMap, err := constructPolicyMap(tokens, parseExcludePolicy(tokens), plan)
+	if err != nil {
+		return nil, err
+	}
+	plan.Entries = len(policyMap)
+
+	// a path is excluded once, and not at all if an IF brought it back
+	included := make(map[string]uint8)
+	for _, e := range plan.Included {
+		included[e.Path] = 1
+	}
+	excluded := plan.Excluded[:0]
+	for _, e := range plan.Excluded {
+		if _, ok := included[e.Path]; ok {
+			continue
+		}
+		included[e.Path] = 1
+		excluded = append(excluded, e)
+	}
+	plan.Excluded = excluded
+
+	return plan, nil
+}
+
+// Over returns by how many entries the plan exceeds the capacity, 0 if it fits
+func (p *Plan) Over() int {
+	if p.Entries > p.Capacity {
+		return p.Entries - p.Capacity
+	}
+	return 0
+}
+
+// include records path as included by rule. An inode is counted once, a
+// later rule including it again replaces the entry.
+func (p *Plan) include(key bpfloader.TrackedFileKey, path string, dir bool, rule token) {
+	if p == nil {
+		return
+	}
+	entry := PlanEntry{
+		Path: filepath.Clean(path),
+		Dir:  dir,
+		File: rule.file,
+		Line: rule.lineNum,
+		Rule: rule.command + ": " + rule.argument,
+	}
+	if i, ok := p.seen[key]; ok {
+		p.Included[i] = entry
+		return
+	}
+	if p.seen == nil {
+		p.seen = make(map[bpfloader.TrackedFileKey]int)
+	}
+	p.seen[key] = len(p.Included)
+	p.Included = append(p.Included, entry)
+	if dir {
+		p.Dirs++
+	} else {
+		p.Files++
+	}
+}
+
+// exclude records the subtree at path as excluded by the rule command: argument
+func (p *Plan) exclude(path string, dir bool, command string, argument string) {
+	if p == nil {
+		return
+	}
+	entry := PlanEntry{Path: filepath.Clean(path), Dir: dir, Rule: command + ": " + argument}
+	for _, t := range p.tokens {
+		if t.command == command && t.argument == argument {
+			entry.File, entry.Line = t.file, t.lineNum
+			break
+		}
+	}
+	p.Excluded = append(p.Excluded, entry)
+}
+
+// WriteText writes the plan one path per line, + for included and - for
+// excluded, directories with a trailing slash, then the totals
+func (p *Plan) WriteText(w io.Writer) error {
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	write := func(sign string, e PlanEntry) {
+		path := e.Path
+		if e.Dir && !strings.HasSuffix(path, "/") {
+			path += "/"
+		}
+		rule := token{file: e.File, lineNum: e.Line}
+		fmt.Fprintf(tw, "%s %s\t%s (%s)\n", sign, path, e.Rule, rule.location())
+	}
+	for _, e := range p.Included {
+		write("+", e)
+	}
+	for _, e := range p.Excluded {
+		write("-", e)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\nIncluded: %d files, %d directories\nExcluded: %d subtrees\nPolicy table: %d of %d entries (%.1f%%)\n",
+		p.Files, p.Dirs, len(p.Excluded), p.Entries, p.Capacity, 100*float64(p.Entries)/float64(max(p.Capacity, 1)))
+	return err
+}
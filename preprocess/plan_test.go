@@ -0,0 +1,106 @@
+package preprocess
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildPlan(t *testing.T) {
+
+	root := t.TempDir()
+	mkTree(t, root,
+		"app/bin/run",
+		"app/cache/page",
+		"app/cache/critical.log",
+		"app/logs/x.log",
+	)
+
+	config := filepath.Join(root, "config.txt")
+	rules := strings.Join([]string{
+		"D: " + root + "/app",
+		"E: " + root + "/app/cache",
+		"EE: .log",
+		"IF: " + root + "/app/cache/critical.log",
+	}, "\n")
+	if err := os.WriteFile(config, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := BuildPlan(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// app, app/bin, app/bin/run, app/logs and the IF
+	if plan.Entries != 5 || plan.Files != 2 || plan.Dirs != 3 {
+		t.Errorf("got %d entries, %d files, %d dirs", plan.Entries, plan.Files, plan.Dirs)
+	}
+	if plan.Over() != 1 {
+		t.Errorf("over by %d, want 1", plan.Over())
+	}
+
+	excluded := make(map[string]int)
+	for _, e := range plan.Excluded {
+		excluded[strings.TrimPrefix(e.Path, root)] = e.Line
+	}
+	want := map[string]int{"/app/cache": 2, "/app/logs/x.log": 3}
+	if len(excluded) != len(want) {
+		t.Errorf("excluded %v, want %v", excluded, want)
+	}
+	for path, line := range want {
+		if excluded[path] != line {
+			t.Errorf("%s excluded by line %d, want %d", path, excluded[path], line)
+		}
+	}
+
+	for _, e := range plan.Included {
+		if strings.HasSuffix(e.Path, "critical.log") && e.Line != 4 {
+			t.Errorf("critical.log included by line %d, want the IF", e.Line)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := plan.WriteText(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Policy table: 5 of 4 entries") {
+		t.Errorf("totals missing:\n%s", out.String())
+	}
+}
+
+func TestBuildPlanOverlap(t *testing.T) {
+
+	root := t.TempDir()
+	mkTree(t, root,
+		"app/bin/run",
+		"app/conf",
+	)
+
+	config := filepath.Join(root, "config.txt")
+	rules := strings.Join([]string{
+		"D: " + root + "/app",
+		"IF: " + root + "/app/bin/run",
+		"D: " + root + "/app/bin",
+	}, "\n")
+	if err := os.WriteFile(config, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := BuildPlan(config, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// app, app/bin, app/bin/run and app/conf, each once
+	if plan.Entries != 4 || plan.Files != 2 || plan.Dirs != 2 || len(plan.Included) != 4 {
+		t.Errorf("got %d entries, %d files, %d dirs, %d included", plan.Entries, plan.Files, plan.Dirs, len(plan.Included))
+	}
+	for _, e := range plan.Included {
+		if strings.HasSuffix(e.Path, "/run") && e.Line != 2 {
+			t.Errorf("run included by line %d, want the IF", e.Line)
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package preprocess
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"os"
 	"syscall"
 	"watchd/bpfloader"
+
+	"golang.org/x/sys/unix"
 )
 
 type FilterList struct {
@@ -16,55 +23,135 @@ type Cache struct {
 	LookupTable bpfloader.TrackedFileMap
 	PathCache   PathCache
 	FilterList
+
+	tokens     []token     // parsed rules, kept to re-walk D rules at runtime
+	mountTable *MountTable // mount table of the last scan
 }
 
+// ErrEmptyPolicy is returned by ParseConfig when no file of the policy exists
+// on this host. The returned Cache is still usable, e.g. to replay events.
+var ErrEmptyPolicy = errors.New("policy map is empty Please check the policy file")
+
 func ParseConfig(configPath string) (Cache, error) {
 
-	lookupTable, pathCache, filterList, err := parseConfig(configPath)
+	tokens, lookupTable, pathCache, filterList, err := parseConfig(configPath)
 	if err != nil {
 		return Cache{}, err
 	}
 
-	if len(lookupTable) == 0 {
-		return Cache{}, errors.New("policy map is empty Please check the policy file")
+	mountTable, err := readMountTable(mountInfoPath)
+	if err != nil {
+		log.Printf("WARN: reading mount table %s", err)
 	}
-	return Cache{
+
+	cache := Cache{
 		LookupTable: lookupTable,
 		PathCache:   pathCache,
 		FilterList:  filterList,
-	}, nil
+		tokens:      tokens,
+		mountTable:  mountTable,
+	}
+
+	if len(lookupTable) == 0 {
+		return cache, ErrEmptyPolicy
+	}
+	return cache, nil
+}
+
+// HashConfig returns the sha256 of the policy file at configPath and the
+// files it includes in hex, to tell versions of the policy apart in logs
+func HashConfig(configPath string) (string, error) {
+
+	r := newConfigReader()
+	r.read(configPath, nil)
+	if len(r.files) == 0 {
+		_, err := os.Stat(configPath)
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, path := range r.files {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", path)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// LoadRules reads and validates the rules of the policy at configPath
+// without walking the filesystem. The Cache only answers questions about
+// the rules, e.g. Explain.
+func LoadRules(configPath string) (Cache, error) {
+
+	tokens, err := ReadConfig(configPath)
+	if err != nil {
+		return Cache{}, err
+	}
+	if err := SyntaxValidation(tokens); err != nil {
+		return Cache{}, err
+	}
+	if _, err := SemanticValidation(tokens); err != nil {
+		return Cache{}, err
+	}
+	return Cache{tokens: tokens}, nil
 }
 
 func (p *Cache) LoadTrackedFileMap(bpf *bpfloader.BPF) (int, error) {
 
 	var count int
 	var totalEntries = len(p.LookupTable)
-	fmt.Println("Total entries in policy Table ", totalEntries)
+	log.Println("Total entries in policy Table ", totalEntries)
 	for k, v := range p.LookupTable {
-		fmt.Println("Loading key ( ", k.InodeNumber, ", ", k.Dev, ")")
+		log.Println("Loading key ( ", k.InodeNumber, ", ", k.Dev, ")")
 		if err := bpf.Objects.PolicyTable.Put(k, v); err != nil {
-			fmt.Println("Error loading entry into the policy table")
-			fmt.Println("Total of ", totalEntries-count, " entries not loaded")
+			log.Println("Error loading entry into the policy table")
+			log.Println("Total of ", totalEntries-count, " entries not loaded")
 			return count, err
 
 		}
 		count++
 	}
 
-	fmt.Println("Loaded", count, " entries into the policy table")
+	log.Println("Loaded", count, " entries into the policy table")
 	return count, nil
 }
 
+// WatchRoots returns the paths of all D and IF rules, patterns expanded to
+// the paths they match now
+func (p *Cache) WatchRoots() []string {
+	var roots []string
+	for _, token := range p.tokens {
+		if token.command == "D" || token.command == "IF" {
+			roots = append(roots, token.paths()...)
+		}
+	}
+	return roots
+}
+
 /* -------------------------------------------------------------------------------------- Internal Helpers -----------------------------------*/
-func parseConfig(configPath string) (bpfloader.TrackedFileMap, PathCache, FilterList, error) {
+func parseConfig(configPath string) ([]token, bpfloader.TrackedFileMap, PathCache, FilterList, error) {
 
 	/* For ebpf lookup table*/
 	tokens, err := ReadConfig(configPath)
 	if err != nil {
-		return nil, PathCache{}, FilterList{}, err
+		return nil, nil, PathCache{}, FilterList{}, err
 	}
 	if err := SyntaxValidation(tokens); err != nil {
-		return nil, PathCache{}, FilterList{}, err
+		return nil, nil, PathCache{}, FilterList{}, err
+	}
+	warnings, err := SemanticValidation(tokens)
+	for _, w := range warnings {
+		log.Println(w)
+	}
+	if err != nil {
+		return nil, nil, PathCache{}, FilterList{}, err
 	}
 
 	exlPol := parseExcludePolicy(tokens)
@@ -74,30 +161,33 @@ func parseConfig(configPath string) (bpfloader.TrackedFileMap, PathCache, Filter
 		IgnoredExtensions: exlPol.excludeExts,
 	}
 
-	ret, err := constructPolicyMap(tokens, exlPol)
+	ret, err := constructPolicyMap(tokens, exlPol, nil)
 
 	/* for Path reconstruction */
 	var path_cache PathCache
 	path_cache.initPathCache()
 	for _, token := range tokens {
 		if token.command == "D" || token.command == "IF" {
-			path_cache.buildCache(token.argument)
+			for _, path := range token.paths() {
+				path_cache.buildCache(path)
+			}
 		}
 	}
 
-	fmt.Println("Policy Map items: ", len(ret))
-	fmt.Println("Policy Map Size: ", (len(ret)*17.0)/1024.0, " KB")
+	log.Println("Policy Map items: ", len(ret))
+	log.Println("Policy Map Size: ", (len(ret)*17.0)/1024.0, " KB")
 
-	fmt.Println("Path Cache items: ", len(path_cache.cache))
-	fmt.Println("Path Cache Size: ", (len(path_cache.cache)*17.0)/1024.0, " KB")
+	log.Println("Path Cache items: ", len(path_cache.cache))
+	log.Println("Path Cache Size: ", (len(path_cache.cache)*17.0)/1024.0, " KB")
 
-	return ret, path_cache, filterList, nil
+	return tokens, ret, path_cache, filterList, nil
 
 }
 
 func (p *PathCache) initPathCache() PathCache {
 
 	p.cache = make(map[CacheKey]CacheValue)
+	p.links = make(map[CacheKey][]CacheValue)
 	p.Put(base_key, CacheValue{
 		Parent:   nil,
 		Filename: "",
@@ -106,11 +196,17 @@ func (p *PathCache) initPathCache() PathCache {
 	return *p
 }
 
+// KernelDev converts st_dev of st to the s_dev encoding reported by the
+// kernel hooks, as used in bpfloader.TrackedFileKey
+func KernelDev(st *syscall.Stat_t) uint64 {
+	return rawDev(st)
+}
+
 /* Internal helpers */
-/* Don't touch this */
 
+// rawDev re-encodes the userspace dev_t of st the way the kernel keeps
+// s_dev. Note st_dev of a btrfs subvolume is not the s_dev of its
+// superblock, see MountTable.
 func rawDev(st *syscall.Stat_t) uint64 {
-	major := uint64(st.Dev >> 8)
-	minor := uint64(st.Dev & 0xff)
-	return (major << 20) | minor
+	return mkdev(uint64(unix.Major(st.Dev)), uint64(unix.Minor(st.Dev)))
 }
@@ -0,0 +1,186 @@
+/** Replacing the policy of a running watchd with the entries that changed only */
+package preprocess
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"watchd/bpfloader"
+
+	"github.com/cilium/ebpf"
+)
+
+// Track records an entry the kernel added to the policy table at runtime,
+// e.g. for a created file, so a reload can tell it from the entries of the
+// walk.
+func (p *Cache) Track(key bpfloader.TrackedFileKey, value bpfloader.TrackedFileValue) {
+	if p.LookupTable == nil {
+		p.LookupTable = make(bpfloader.TrackedFileMap)
+	}
+	p.LookupTable[key] = value
+}
+
+// Untrack forgets an entry the kernel removed from the policy table
+func (p *Cache) Untrack(key bpfloader.TrackedFileKey) {
+	delete(p.LookupTable, key)
+}
+
+// PolicyDiff is the change of the policy table from one policy to the next
+type PolicyDiff struct {
+	Added   bpfloader.TrackedFileMap
+	Removed bpfloader.TrackedFileMap // with the old values, to roll back
+	Changed bpfloader.TrackedFileMap // entries whose event mask changed, with the new values
+
+	previous bpfloader.TrackedFileMap // the old values of Changed, to roll back
+}
+
+// Diff compares the entries of the current policy with the ones of next.
+//
+// Files created after next was walked are only in the current policy. They
+// are kept, and added to next, if next includes their path, and change if
+// the mask of the rule including them does. Entries in both only change if
+// their event mask does.
+func Diff(current *Cache, next *Cache) PolicyDiff {
+
+	diff := PolicyDiff{
+		Added:    make(bpfloader.TrackedFileMap),
+		Removed:  make(bpfloader.TrackedFileMap),
+		Changed:  make(bpfloader.TrackedFileMap),
+		previous: make(bpfloader.TrackedFileMap),
+	}
+
+	for k, v := range next.LookupTable {
+		old, ok := current.LookupTable[k]
+		if !ok {
+			diff.Added[k] = v
+			continue
+		}
+		if old.EventMask != v.EventMask {
+			changed := old
+			changed.EventMask = v.EventMask
+			diff.Changed[k] = changed
+			diff.previous[k] = old
+		}
+	}
+
+	for k, v := range current.LookupTable {
+		if _, ok := next.LookupTable[k]; ok {
+			continue
+		}
+		if adopted, ok := next.adopt(k, v, &current.PathCache); ok {
+			if adopted.EventMask != v.EventMask {
+				diff.Changed[k] = adopted
+				diff.previous[k] = v
+			}
+			continue
+		}
+		diff.Removed[k] = v
+	}
+
+	return diff
+}
+
+// adopt adds the entry key of a file created after p was walked, if p
+// includes one of its paths and the file is still there. It takes the event
+// mask of the rule of p including it, which is returned with value. Its
+// names are copied from paths.
+func (p *Cache) adopt(key bpfloader.TrackedFileKey, value bpfloader.TrackedFileValue, paths *PathCache) (bpfloader.TrackedFileValue, bool) {
+
+	cacheKey := CacheKey{Inode_number: key.InodeNumber, Dev_id: key.Dev}
+
+	for _, path := range paths.Paths(cacheKey) {
+		ex := p.Explain(path)
+		if !ex.Included {
+			continue
+		}
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path, &st); err != nil || st.Ino != key.InodeNumber || rawDev(&st) != key.Dev {
+			continue
+		}
+
+		if ex.Winner != nil {
+			value.EventMask = ex.Winner.Options.EventMask()
+		}
+		p.Track(key, value)
+		for _, name := range paths.Names(cacheKey) {
+			if !p.PathCache.Contains(cacheKey) {
+				p.PathCache.Put(cacheKey, name)
+			} else {
+				p.PathCache.AddLink(cacheKey, name)
+			}
+		}
+		return value, true
+	}
+	return value, false
+}
+
+// Apply makes the changes of d to the policy table. If one fails, the ones
+// made are undone, so the table keeps the current policy.
+//
+// It does nothing on a nil BPF, for backends that don't use eBPF.
+func (d PolicyDiff) Apply(bpf *bpfloader.BPF) error {
+
+	if bpf == nil {
+		return nil
+	}
+	table := bpf.Objects.PolicyTable
+
+	var added []bpfloader.TrackedFileKey
+	var removed []bpfloader.TrackedFileKey
+	var changed []bpfloader.TrackedFileKey
+
+	rollback := func() {
+		for _, k := range added {
+			table.Delete(k)
+		}
+		for _, k := range removed {
+			table.Put(k, d.Removed[k])
+		}
+		for _, k := range changed {
+			table.Put(k, d.previous[k])
+		}
+	}
+
+	for k, v := range d.Added {
+		if err := table.Put(k, v); err != nil {
+			rollback()
+			return fmt.Errorf("adding %d entries: %w", len(d.Added), err)
+		}
+		added = append(added, k)
+	}
+
+	// only the mask changes, the size stays as the kernel last set it
+	for k, v := range d.Changed {
+		var live bpfloader.TrackedFileValue
+		err := table.Lookup(k, &live)
+		if err == nil {
+			d.previous[k] = live
+			live.EventMask = v.EventMask
+			err = table.Update(k, live, ebpf.UpdateExist)
+		}
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			// deleted in the meantime
+			continue
+		}
+		if err != nil {
+			rollback()
+			return fmt.Errorf("changing %d entries: %w", len(d.Changed), err)
+		}
+		changed = append(changed, k)
+	}
+
+	for k := range d.Removed {
+		err := table.Delete(k)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			// deleted in the meantime
+			continue
+		}
+		if err != nil {
+			rollback()
+			return fmt.Errorf("removing %d entries: %w", len(d.Removed), err)
+		}
+		removed = append(removed, k)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package preprocess
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"watchd/bpfloader"
+)
+
+func TestDiff(t *testing.T) {
+
+	root := t.TempDir()
+	mkTree(t, root, "app/a", "app/b", "other/c")
+
+	walk := func(lines ...string) Cache {
+		tokens := rules(lines...)
+		policyMap, err := constructPolicyMap(tokens, parseExcludePolicy(tokens), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths PathCache
+		paths.initPathCache()
+		for _, token := range tokens {
+			if token.command == "D" {
+				paths.buildCache(token.argument)
+			}
+		}
+		return Cache{LookupTable: policyMap, PathCache: paths, tokens: tokens}
+	}
+
+	current := walk("D: "+root+"/app", "D: "+root+"/other")
+
+	// created after the next policy was walked
+	created := filepath.Join(root, "app/new")
+	if err := os.WriteFile(created, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	next := walk("D: "+root+"/app", "E: "+root+"/app/b")
+
+	key := inodeKey(t, created)
+	current.Track(key, bpfloader.TrackedFileValue{})
+	dir := inodeKey(t, root+"/app")
+	current.PathCache.Put(CacheKey{Inode_number: key.InodeNumber, Dev_id: key.Dev},
+		CacheValue{Parent: &CacheKey{Inode_number: dir.InodeNumber, Dev_id: dir.Dev}, Filename: "new"})
+	delete(next.LookupTable, key)
+
+	diff := Diff(&current, &next)
+
+	if len(diff.Added) != 0 {
+		t.Errorf("added %v", diff.Added)
+	}
+	// other, other/c and app/b
+	if len(diff.Removed) != 3 {
+		t.Errorf("removed %d entries, want 3", len(diff.Removed))
+	}
+	for _, p := range []string{"other", "other/c", "app/b"} {
+		if _, ok := diff.Removed[inodeKey(t, filepath.Join(root, p))]; !ok {
+			t.Errorf("%s not removed", p)
+		}
+	}
+	if _, ok := next.LookupTable[key]; !ok {
+		t.Error("file created during the reload not kept")
+	}
+
+	// the other way round
+	back := Diff(&next, &current)
+	if len(back.Added) != 3 || len(back.Removed) != 0 {
+		t.Errorf("reverse diff added %d, removed %d", len(back.Added), len(back.Removed))
+	}
+
+	if err := diff.Apply(nil); err != nil {
+		t.Errorf("Apply without BPF: %v", err)
+	}
+}
+
+func TestDiffEventMask(t *testing.T) {
+
+	a := bpfloader.TrackedFileKey{InodeNumber: 1, Dev: 1}
+	b := bpfloader.TrackedFileKey{InodeNumber: 2, Dev: 1}
+
+	current := Cache{LookupTable: bpfloader.TrackedFileMap{
+		a: {FileSize: 10},
+		b: {FileSize: 20, EventMask: bpfloader.EventModify},
+	}}
+	next := Cache{LookupTable: bpfloader.TrackedFileMap{
+		a: {FileSize: 0, EventMask: bpfloader.EventCreate},
+		b: {FileSize: 0, EventMask: bpfloader.EventModify},
+	}}
+
+	diff := Diff(&current, &next)
+	if len(diff.Added) != 0 || len(diff.Removed) != 0 {
+		t.Errorf("added %v, removed %v", diff.Added, diff.Removed)
+	}
+	want := bpfloader.TrackedFileMap{a: {FileSize: 10, EventMask: bpfloader.EventCreate}}
+	if !reflect.DeepEqual(diff.Changed, want) {
+		t.Errorf("changed %v, want %v", diff.Changed, want)
+	}
+}
+
+func TestDiffAdoptEventMask(t *testing.T) {
+
+	root := t.TempDir()
+	mkTree(t, root, "app/a")
+
+	created := filepath.Join(root, "app/new")
+	if err := os.WriteFile(created, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	key := inodeKey(t, created)
+	dir := inodeKey(t, root+"/app")
+
+	// created before the reload, with the mask of the old rule
+	current := Cache{LookupTable: bpfloader.TrackedFileMap{
+		dir: {EventMask: bpfloader.EventCreate},
+		key: {FileSize: 7, EventMask: bpfloader.EventCreate},
+	}}
+	current.PathCache.initPathCache()
+	current.PathCache.Put(CacheKey{Inode_number: dir.InodeNumber, Dev_id: dir.Dev}, CacheValue{Filename: root + "/app"})
+	current.PathCache.Put(CacheKey{Inode_number: key.InodeNumber, Dev_id: key.Dev},
+		CacheValue{Parent: &CacheKey{Inode_number: dir.InodeNumber, Dev_id: dir.Dev}, Filename: "new"})
+
+	tokens := rules("D: " + root + "/app")
+	tokens[0].options = RuleOptions{Events: []string{"modify"}}
+	next := Cache{LookupTable: bpfloader.TrackedFileMap{
+		dir: {EventMask: bpfloader.EventModify},
+	}, tokens: tokens}
+	next.PathCache.initPathCache()
+
+	diff := Diff(&current, &next)
+
+	if len(diff.Removed) != 0 {
+		t.Errorf("removed %v", diff.Removed)
+	}
+	want := bpfloader.TrackedFileValue{FileSize: 7, EventMask: bpfloader.EventModify}
+	if diff.Changed[key] != want {
+		t.Errorf("changed to %v, want %v", diff.Changed[key], want)
+	}
+	if next.LookupTable[key] != want {
+		t.Errorf("adopted as %v, want %v", next.LookupTable[key], want)
+	}
+}
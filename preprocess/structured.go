@@ -0,0 +1,374 @@
+/** The structured policy format, JSON with options per rule */
+package preprocess
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"watchd/bpfloader"
+)
+
+// structuredVersion is the version of the structured format written by
+// ConvertConfig and the only one read
+const structuredVersion = 1
+
+// severities a rule can give its events
+var severities = map[string]uint8{
+	"info":     1,
+	"low":      1,
+	"medium":   1,
+	"high":     1,
+	"critical": 1,
+}
+
+// eventNames are the event types a rule can select, UNLINK goes with delete
+var eventNames = map[string]uint32{
+	"create": bpfloader.EventCreate,
+	"modify": bpfloader.EventModify,
+	"delete": bpfloader.EventDelete,
+	"flags":  bpfloader.EventFlags,
+}
+
+// RuleOptions are the settings a D or IF rule gives the files it includes.
+// The line format only carries Events, see tokenizeComments.
+type RuleOptions struct {
+	Events   []string `json:"events,omitempty"`   // Events are the event types reported, all if empty.
+	Severity string   `json:"severity,omitempty"` // Severity is copied to the events, one of severities.
+	Labels   []string `json:"labels,omitempty"`   // Labels are copied to the events.
+	Hash     bool     `json:"hash,omitempty"`     // Hash sets the sha256 of the file as checksum of CREATE and MODIFY.
+}
+
+func (o RuleOptions) empty() bool {
+	return len(o.Events) == 0 && o.Severity == "" && len(o.Labels) == 0 && !o.Hash
+}
+
+// equal reports whether o gives files the same settings as other, events
+// are compared by mask
+func (o RuleOptions) equal(other RuleOptions) bool {
+	return o.EventMask() == other.EventMask() && o.Severity == other.Severity &&
+		slices.Equal(o.Labels, other.Labels) && o.Hash == other.Hash
+}
+
+// EventMask returns the Event bits of the policy table entries of the rule,
+// 0 for all events
+func (o RuleOptions) EventMask() uint32 {
+	var mask uint32
+	for _, name := range o.Events {
+		mask |= eventNames[name]
+	}
+	return mask
+}
+
+func (o RuleOptions) String() string {
+	var opts []string
+	if len(o.Events) > 0 {
+		opts = append(opts, "events="+strings.Join(o.Events, ","))
+	}
+	if o.Severity != "" {
+		opts = append(opts, "severity="+o.Severity)
+	}
+	if len(o.Labels) > 0 {
+		opts = append(opts, "labels="+strings.Join(o.Labels, ","))
+	}
+	if o.Hash {
+		opts = append(opts, "hash")
+	}
+	return strings.Join(opts, " ")
+}
+
+// StructuredPolicy is a policy file in the structured format
+//
+//	{
+//	  "version": 1,
+//	  "rules": [
+//	    {"command": "D", "argument": "/etc", "severity": "high", "hash": true},
+//	    {"command": "D", "argument": "/var/www", "events": ["create", "delete"]},
+//	    {"command": "EE", "argument": ".log", "comment": "rotated logs"}
+//	  ]
+//	}
+type StructuredPolicy struct {
+	Version int              `json:"version"`
+	Rules   []StructuredRule `json:"rules"`
+	Comment string           `json:"comment,omitempty"` // Comment follows the last rule.
+}
+
+// StructuredRule is a rule of a structured policy, Command and Argument as
+// in the line format
+type StructuredRule struct {
+	Command  string `json:"command"`
+	Argument string `json:"argument"`
+	RuleOptions
+	Comment string `json:"comment,omitempty"`
+}
+
+// isStructured reports whether the policy file at path is in the structured
+// format, by its extension
+func isStructured(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".json")
+}
+
+// isYAML reports whether path names a YAML file, which watchd doesn't read
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// decodeStructured returns the rules of a structured policy file and the
+// comment after them. Each rule has the line of its argument.
+func decodeStructured(data []byte, file string) ([]token, string, error) {
+
+	var policy StructuredPolicy
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&policy); err != nil {
+		return nil, "", jsonError(err, data, file)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, "", &PolicyError{Code: ExitSyntax, File: file, Message: "data after the policy object"}
+	}
+	if policy.Version != structuredVersion {
+		return nil, "", &PolicyError{Code: ExitSyntax, File: file, Message: fmt.Sprintf("unsupported version %d", policy.Version),
+			Hint: fmt.Sprintf(`start the file with "version": %d`, structuredVersion)}
+	}
+
+	starts := ruleOffsets(data)
+	tokens := make([]token, 0, len(policy.Rules))
+	for i, r := range policy.Rules {
+		t := token{
+			file:     file,
+			lineNum:  i + 1,
+			command:  r.Command,
+			argument: r.Argument,
+			comment:  r.Comment,
+			options:  r.RuleOptions,
+		}
+		if i < len(starts) {
+			end := len(data)
+			if i+1 < len(starts) {
+				end = starts[i+1]
+			}
+			t.lineNum, t.text, t.col = argumentLine(data, starts[i], end, r.Argument)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, policy.Comment, nil
+}
+
+// jsonError turns an error of encoding/json into a PolicyError pointing at
+// the offending character
+func jsonError(err error, data []byte, file string) *PolicyError {
+
+	var offset int64 = -1
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) {
+		offset = syntaxErr.Offset
+	} else if errors.As(err, &typeErr) {
+		offset = typeErr.Offset
+	}
+
+	e := &PolicyError{Code: ExitSyntax, File: file, Message: strings.TrimPrefix(err.Error(), "json: ")}
+	if offset < 0 {
+		return e
+	}
+	offset = min(offset, int64(len(data)))
+	lineStart := bytes.LastIndexByte(data[:offset], '\n') + 1
+	lineEnd := bytes.IndexByte(data[lineStart:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(data) - lineStart
+	}
+	e.Line = bytes.Count(data[:lineStart], []byte("\n")) + 1
+	e.Text = string(data[lineStart : lineStart+lineEnd])
+	e.Col = max(int(offset)-lineStart-1, 0)
+	return e
+}
+
+// ruleOffsets returns where each object of the "rules" array starts in data
+func ruleOffsets(data []byte) []int {
+
+	var starts []int
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	key := false // the next string at depth 1 is a key
+	inRules := false
+
+	for {
+		offset := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			return starts
+		}
+		switch v := tok.(type) {
+		case json.Delim:
+			if v == '{' || v == '[' {
+				if inRules && depth == 2 && v == '{' {
+					starts = append(starts, offset+bytes.IndexByte(data[offset:], '{'))
+				}
+				if depth == 0 {
+					key = true
+				}
+				depth++
+				continue
+			}
+			depth--
+			if depth == 1 {
+				inRules = false
+				key = true
+			}
+		case string:
+			if depth == 1 && key {
+				inRules = v == "rules"
+				key = false
+				continue
+			}
+			if depth == 1 {
+				key = true
+			}
+		default:
+			if depth == 1 {
+				key = true
+			}
+		}
+	}
+}
+
+// argumentLine returns the line of data[start:end] holding the argument of
+// a rule, the text of the line and where the argument starts in it. The
+// line of start if there is no argument.
+func argumentLine(data []byte, start int, end int, argument string) (int, string, int) {
+
+	at, col := start, 0
+	rule := data[start:end]
+	if i := bytes.Index(rule, []byte(`"argument"`)); i >= 0 {
+		at = start + i
+		if j := bytes.Index(rule[i:], []byte(strconv.Quote(argument))); j >= 0 {
+			at = start + i + j
+		}
+	}
+
+	lineStart := bytes.LastIndexByte(data[:at], '\n') + 1
+	lineEnd := bytes.IndexByte(data[lineStart:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(data) - lineStart
+	}
+	col = at - lineStart
+	return bytes.Count(data[:lineStart], []byte("\n")) + 1, string(data[lineStart : lineStart+lineEnd]), col
+}
+
+// validOptions checks the options of the rule t
+func validOptions(t token) error {
+
+	o := t.options
+	if o.empty() {
+		return nil
+	}
+	if t.command != "D" && t.command != "IF" {
+		return ruleError(ExitSyntax, t, false, "move the options to the D or IF rule including the files", "options on a %s rule", t.command)
+	}
+	for _, name := range o.Events {
+		if _, ok := eventNames[name]; !ok {
+			return ruleError(ExitSyntax, t, false, "valid events: "+strings.Join(sortedKeys(eventNames), ", "), "invalid event %q", name)
+		}
+	}
+	if _, ok := severities[o.Severity]; o.Severity != "" && !ok {
+		return ruleError(ExitSyntax, t, true, "valid severities: "+strings.Join(sortedKeys(severities), ", "), "invalid severity %q", o.Severity)
+	}
+	for _, label := range o.Labels {
+		if strings.TrimSpace(label) == "" {
+			return ruleError(ExitSyntax, t, true, "remove it", "empty label")
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in order, for hints
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RuleOptions returns the options of the rule including path, false if
+// no rule including it has any
+func (p *Cache) RuleOptions(path string) (RuleOptions, bool) {
+
+	found := false
+	for _, t := range p.tokens {
+		if !t.options.empty() {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return RuleOptions{}, false
+	}
+
+	ex := p.Explain(path)
+	if !ex.Included || ex.Winner == nil || ex.Winner.Options.empty() {
+		return RuleOptions{}, false
+	}
+	return ex.Winner.Options, true
+}
+
+// ConvertConfig translates the policy file at configPath from the line
+// format to the structured one. Comments go with the rule they precede,
+// INCLUDE rules are kept as they are, the files they name are converted on
+// their own. Converting the result back to rules has to give the same
+// rules, or it is an error.
+func ConvertConfig(configPath string) (*StructuredPolicy, error) {
+
+	if isStructured(configPath) {
+		return nil, fmt.Errorf("%s is already structured", configPath)
+	}
+	f, err := os.Open(configPath)
+	if err != nil {
+		return nil, fsError(err, nil)
+	}
+	defer f.Close()
+
+	tokens, trailing, err := tokenizeComments(f, "")
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &StructuredPolicy{Version: structuredVersion, Rules: []StructuredRule{}, Comment: trailing}
+	for _, t := range tokens {
+		policy.Rules = append(policy.Rules, StructuredRule{
+			Command:     t.command,
+			Argument:    t.argument,
+			RuleOptions: t.options,
+			Comment:     t.comment,
+		})
+	}
+
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	back, backTrailing, err := decodeStructured(data, "")
+	if err != nil {
+		return nil, fmt.Errorf("converted policy doesn't read back: %w", err)
+	}
+	if backTrailing != trailing || len(back) != len(tokens) {
+		return nil, fmt.Errorf("converted policy has %d rules, the config %d", len(back), len(tokens))
+	}
+	for i, t := range tokens {
+		b := back[i]
+		if b.command != t.command || b.argument != t.argument || b.comment != t.comment || !reflect.DeepEqual(b.options, t.options) {
+			return nil, ruleError(ExitInternal, t, true, "", "rule converted as %s: %s", b.command, b.argument)
+		}
+	}
+	return policy, nil
+}
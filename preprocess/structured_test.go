@@ -0,0 +1,169 @@
+package preprocess
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeStructured(t *testing.T) {
+
+	data := []byte(`{
+  "version": 1,
+  "rules": [
+    {"command": "D", "argument": "/var/www", "severity": "high", "labels": ["web"], "hash": true},
+    {
+      "comment": "caches churn",
+      "command": "E",
+      "argument": "/var/www/cache"
+    },
+    {"command": "EE", "argument": ".log"}
+  ],
+  "comment": "end"
+}`)
+
+	tokens, trailing, err := decodeStructured(data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trailing != "end" || len(tokens) != 3 {
+		t.Fatalf("got %d rules, trailing %q", len(tokens), trailing)
+	}
+
+	want := RuleOptions{Severity: "high", Labels: []string{"web"}, Hash: true}
+	if !reflect.DeepEqual(tokens[0].options, want) {
+		t.Errorf("options: got %+v, want %+v", tokens[0].options, want)
+	}
+	for i, line := range []int{4, 8, 10} {
+		if tokens[i].lineNum != line {
+			t.Errorf("rule %d: line %d, want %d", i, tokens[i].lineNum, line)
+		}
+	}
+	if tokens[1].comment != "caches churn" || tokens[1].text != `      "argument": "/var/www/cache"` || tokens[1].col != 18 {
+		t.Errorf("rule 1: %+v", tokens[1])
+	}
+}
+
+func TestDecodeStructuredErrors(t *testing.T) {
+
+	tests := []struct {
+		data    string
+		message string
+		line    int
+	}{
+		{"{\n\"version\": 1,\n\"rules\": [\n{\"command\": \"D\" \"argument\": \"/etc\"}]}", "invalid character", 4},
+		{`{"version": 1, "rules": [{"command": "D", "argument": "/etc", "sev": "high"}]}`, "unknown field", 0},
+		{`{"version": 2, "rules": []}`, "unsupported version", 0},
+		{`{"version": 1, "rules": []} {}`, "data after", 0},
+	}
+
+	for _, tt := range tests {
+		_, _, err := decodeStructured([]byte(tt.data), "")
+		var pe *PolicyError
+		if !errors.As(err, &pe) {
+			t.Errorf("%s: got %v, want a PolicyError", tt.data, err)
+			continue
+		}
+		if !strings.Contains(pe.Message, tt.message) || pe.Line != tt.line {
+			t.Errorf("%s: got %q at line %d", tt.data, pe.Message, pe.Line)
+		}
+	}
+}
+
+func TestValidOptions(t *testing.T) {
+
+	for _, tok := range []token{
+		{lineNum: 1, command: "E", argument: "/tmp", options: RuleOptions{Hash: true}},
+		{lineNum: 1, command: "D", argument: "/etc", options: RuleOptions{Severity: "urgent"}},
+		{lineNum: 1, command: "IF", argument: "/etc/passwd", options: RuleOptions{Labels: []string{" "}}},
+	} {
+		if err := SyntaxValidation([]token{tok}); err == nil {
+			t.Errorf("%+v accepted", tok)
+		}
+	}
+}
+
+func TestConvertConfig(t *testing.T) {
+
+	root := t.TempDir()
+	writeConfig(t, root, map[string][]string{
+		"v1.txt": {"# system", "D: /etc", "D[create,delete]: /var/www", "EE: .log", "INCLUDE: conf.d/*.conf", "# end"},
+		"v2.txt": {"version: 2", `D: "/srv/a b"  # spaces`, "E: /srv/a b/x, /srv/y"},
+	})
+
+	policy, err := ConvertConfig(filepath.Join(root, "v1.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &StructuredPolicy{
+		Version: 1,
+		Rules: []StructuredRule{
+			{Command: "D", Argument: "/etc", Comment: "system"},
+			{Command: "D", Argument: "/var/www", RuleOptions: RuleOptions{Events: []string{"create", "delete"}}},
+			{Command: "EE", Argument: ".log"},
+			{Command: "INCLUDE", Argument: "conf.d/*.conf"},
+		},
+		Comment: "end",
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("v1: got %+v, want %+v", policy, want)
+	}
+
+	policy, err = ConvertConfig(filepath.Join(root, "v2.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &StructuredPolicy{
+		Version: 1,
+		Rules: []StructuredRule{
+			{Command: "D", Argument: "/srv/a b", Comment: "spaces"},
+			{Command: "E", Argument: "/srv/a b/x"},
+			{Command: "E", Argument: "/srv/y"},
+		},
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("v2: got %+v, want %+v", policy, want)
+	}
+}
+
+func TestStructuredPolicy(t *testing.T) {
+
+	root := t.TempDir()
+	mkTree(t, root, "www/index.html", "etc/passwd")
+	config := filepath.Join(root, "policy.json")
+	data := `{"version": 1, "rules": [
+		{"command": "D", "argument": "` + root + `/www", "severity": "low", "labels": ["web", "public"]},
+		{"command": "IF", "argument": "` + root + `/etc/passwd", "severity": "critical", "hash": true},
+		{"command": "INCLUDE", "argument": "extra.txt"}
+	]}`
+	if err := os.WriteFile(config, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(t, root, map[string][]string{"extra.txt": {"EE: .log"}})
+
+	policy, err := ParseConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := policy.LookupTable[inodeKey(t, root+"/www/index.html")]; !ok {
+		t.Error("index.html not in the policy")
+	}
+	if _, ok := policy.FilterList.IgnoredExtensions[".log"]; !ok {
+		t.Error("rule of the included line format file missing")
+	}
+
+	opts, ok := policy.RuleOptions(root + "/www/index.html")
+	if !ok || opts.Severity != "low" || !reflect.DeepEqual(opts.Labels, []string{"web", "public"}) {
+		t.Errorf("www: got %+v, %v", opts, ok)
+	}
+	opts, ok = policy.RuleOptions(root + "/etc/passwd")
+	if !ok || opts.Severity != "critical" || !opts.Hash {
+		t.Errorf("passwd: got %+v, %v", opts, ok)
+	}
+	if _, ok := policy.RuleOptions(root + "/etc/shadow"); ok {
+		t.Error("options for a path no rule includes")
+	}
+}
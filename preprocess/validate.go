@@ -0,0 +1,275 @@
+/** Error classes and the semantic checks of docs/parser.txt */
+package preprocess
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Error classes of a policy, they are the exit codes of watchd validate
+const (
+	ExitSyntax     = 1
+	ExitSemantic   = 2
+	ExitFilesystem = 3 // permission denied and other I/O errors
+	ExitResource   = 4 // out of memory or file descriptors
+	ExitInternal   = 5
+)
+
+// PolicyError is an error or a warning about a policy file, printed as
+//
+//	ERROR [Line N]: <message>
+//	  <offending line>
+//	  ^
+//	<suggestion>
+//
+// or, for a rule of an included file,
+//
+//	ERROR [<file>, Line N]: <message>
+//	  <offending line>
+//	  ^
+//	<suggestion>
+type PolicyError struct {
+	Code    int    // Code is the error class, one of the Exit constants.
+	File    string // File is the included file of the rule, empty for the config itself.
+	Line    int    // Line is the line of the rule, 0 if not about a rule.
+	Text    string // Text is the offending line.
+	Col     int    // Col is where the caret points in Text.
+	Message string
+	Hint    string
+	Warning bool // Warning is set for problems that don't stop watchd.
+}
+
+func (e *PolicyError) Error() string {
+
+	var b strings.Builder
+
+	level := "ERROR"
+	if e.Warning {
+		level = "WARN"
+	}
+	if e.Line > 0 && e.File != "" {
+		fmt.Fprintf(&b, "%s [%s, Line %d]: %s", level, e.File, e.Line, e.Message)
+	} else if e.Line > 0 {
+		fmt.Fprintf(&b, "%s [Line %d]: %s", level, e.Line, e.Message)
+	} else {
+		fmt.Fprintf(&b, "%s: %s", level, e.Message)
+	}
+	if e.Text != "" {
+		fmt.Fprintf(&b, "\n  %s\n  %s^", e.Text, strings.Repeat(" ", e.Col))
+	}
+	if e.Hint != "" {
+		fmt.Fprintf(&b, "\n%s", e.Hint)
+	}
+	return b.String()
+}
+
+// ExitCode returns the exit code for err: the class of a PolicyError, 1 for
+// any other error.
+func ExitCode(err error) int {
+	var pe *PolicyError
+	if errors.As(err, &pe) {
+		return pe.Code
+	}
+	return 1
+}
+
+// ruleError returns a PolicyError of class code about the rule t, the caret
+// under its argument if onArgument is set, under the command otherwise
+func ruleError(code int, t token, onArgument bool, hint string, format string, a ...any) *PolicyError {
+	e := &PolicyError{
+		Code:    code,
+		File:    t.file,
+		Line:    t.lineNum,
+		Text:    t.command + ": " + t.argument,
+		Message: fmt.Sprintf(format, a...),
+		Hint:    hint,
+	}
+	if t.text != "" {
+		e.Text = t.text
+		if onArgument {
+			e.Col = t.col
+		}
+		return e
+	}
+	if onArgument {
+		e.Col = len(t.command) + 2
+	}
+	return e
+}
+
+// ruleWarning is ruleError for problems that don't stop watchd
+func ruleWarning(t token, hint string, format string, a ...any) *PolicyError {
+	e := ruleError(ExitSemantic, t, true, hint, format, a...)
+	e.Warning = true
+	return e
+}
+
+// fsError classifies an error of the filesystem, running out of memory or
+// descriptors is a resource error
+func fsError(err error, t *token) *PolicyError {
+
+	code := ExitFilesystem
+	if errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ENOSPC) {
+		code = ExitResource
+	}
+
+	if t == nil {
+		return &PolicyError{Code: code, Message: err.Error()}
+	}
+	return ruleError(code, *t, true, "check the permissions of the path", "%v", err)
+}
+
+// SemanticValidation checks the rules against each other. Duplicate rules
+// are errors. An IF under an E, a D inside another D and paths that aren't
+// clean are returned as warnings.
+func SemanticValidation(tokens []token) ([]*PolicyError, error) {
+
+	var warnings []*PolicyError
+	seen := make(map[string]token)
+
+	for i, t := range tokens {
+
+		arg := t.argument
+		if isPathRule(t.command) {
+			if clean := filepath.Clean(arg); clean != arg {
+				warnings = append(warnings, ruleWarning(t, "", "path is read as %s", clean))
+				arg = clean
+			}
+		}
+
+		id := t.command + ":" + arg
+		if first, ok := seen[id]; ok {
+			return warnings, ruleError(ExitSemantic, t, false, "remove one of them",
+				"duplicate rule, same as %s", first.location())
+		}
+		seen[id] = t
+
+		switch t.command {
+		case "IF":
+			for _, e := range tokens {
+				if e.command == "E" && coveredBy(e.argument, nestedPath(arg)) {
+					warnings = append(warnings, ruleWarning(t,
+						"IF overrides E for this path only, its contents stay excluded",
+						"under E: %s (%s)", e.argument, e.location()))
+					break
+				}
+			}
+
+		case "D":
+			for j, outer := range tokens {
+				if j == i || outer.command != "D" || filepath.Clean(outer.argument) == arg {
+					continue
+				}
+				if !coveredBy(outer.argument, nestedPath(arg)) || reincluded(tokens, outer.argument, arg) {
+					continue
+				}
+				if t.options.equal(outer.options) {
+					warnings = append(warnings, ruleWarning(t, "remove it, the walk of the outer D covers it",
+						"already included by D: %s (%s)", outer.argument, outer.location()))
+				} else {
+					warnings = append(warnings, ruleWarning(t, "the most specific D wins, in either order",
+						"its options win over D: %s (%s) below %s", outer.argument, outer.location(), arg))
+				}
+				break
+			}
+		}
+	}
+
+	return warnings, nil
+}
+
+// checkPaths stats the paths of the D, E and IF rules. Missing paths are
+// warnings, the walk skips them. Paths that can't be read are errors.
+func checkPaths(tokens []token) ([]*PolicyError, error) {
+
+	var warnings []*PolicyError
+
+	for i, t := range tokens {
+		if !isPathRule(t.command) {
+			continue
+		}
+
+		path := t.argument
+		if hasGlob(path) {
+			path = globRoot(path)
+		}
+
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			warnings = append(warnings, ruleWarning(t, "it is skipped", "%s not found", path))
+			continue
+		}
+		if err != nil {
+			return warnings, fsError(err, &tokens[i])
+		}
+
+		// the walk has to list D directories, IF and E are only stat'ed
+		if t.command == "D" && info.IsDir() {
+			f, err := os.Open(path)
+			if err != nil {
+				return warnings, fsError(err, &tokens[i])
+			}
+			f.Close()
+		}
+	}
+
+	return warnings, nil
+}
+
+// ValidateConfig runs every check of the policy at configPath, as watchd
+// validate does. The error is a *PolicyError, see ExitCode.
+func ValidateConfig(configPath string) (warnings []*PolicyError, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PolicyError{Code: ExitInternal, Message: fmt.Sprintf("internal error: %v", r)}
+		}
+	}()
+
+	tokens, err := ReadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := SyntaxValidation(tokens); err != nil {
+		return nil, err
+	}
+
+	warnings, err = SemanticValidation(tokens)
+	if err != nil {
+		return warnings, err
+	}
+
+	fsWarnings, err := checkPaths(tokens)
+	return append(warnings, fsWarnings...), err
+}
+
+// isPathRule reports whether the argument of command is a path
+func isPathRule(command string) bool {
+	return command == "D" || command == "E" || command == "IF"
+}
+
+// nestedPath returns a path standing for everything argument matches when
+// checking whether another rule covers it. Pattern segments other than
+// "**" compare as names, so /home/*/.ssh lies below /home/*.
+func nestedPath(argument string) string {
+	if strings.Contains(argument, "**") {
+		return globRoot(argument)
+	}
+	return argument
+}
+
+// reincluded reports whether an E between the D outer and the D inner
+// excludes inner, which makes inner include it again
+func reincluded(tokens []token, outer string, inner string) bool {
+	for _, e := range tokens {
+		if e.command == "E" && coveredBy(e.argument, nestedPath(inner)) && !coveredBy(e.argument, nestedPath(outer)) {
+			return true
+		}
+	}
+	return false
+}
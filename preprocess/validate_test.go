@@ -0,0 +1,135 @@
+package preprocess
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func rules(lines ...string) []token {
+	var tokens []token
+	for i, l := range lines {
+		command, argument, _ := strings.Cut(l, ":")
+		tokens = append(tokens, token{lineNum: i + 1, command: command, argument: strings.TrimSpace(argument)})
+	}
+	return tokens
+}
+
+func TestSemanticValidation(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		tokens   []token
+		warnings []int // lines warned about
+		errLine  int
+	}{
+		{"clean", rules("D: /opt/app", "E: /opt/app/cache", "EE: .log"), nil, 0},
+		{"duplicate", rules("D: /opt/app", "EE: .log", "D: /opt/app/"), []int{3}, 3},
+		{"duplicate EE", rules("EE: .log", "EE: .log"), nil, 2},
+		{"IF under E", rules("D: /opt/app", "E: /opt/app/cache", "IF: /opt/app/cache/critical.log"), []int{3}, 0},
+		{"nested D", rules("D: /opt", "D: /opt/app"), []int{2}, 0},
+		{"nested D pattern", rules("D: /home/*", "D: /home/*/.ssh", "D: /home/**/x"), []int{2}, 0},
+		{"D inside E", rules("D: /opt", "E: /opt/cache", "D: /opt/cache/keep"), nil, 0},
+		{"not clean", rules("D: /opt//app"), []int{1}, 0},
+	}
+
+	for _, tt := range tests {
+		warnings, err := SemanticValidation(tt.tokens)
+
+		var lines []int
+		for _, w := range warnings {
+			if !w.Warning {
+				t.Errorf("%s: warning %v not marked as such", tt.name, w)
+			}
+			lines = append(lines, w.Line)
+		}
+		if fmt.Sprint(lines) != fmt.Sprint(tt.warnings) {
+			t.Errorf("%s: warnings on lines %v, want %v", tt.name, lines, tt.warnings)
+		}
+
+		if tt.errLine == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		var pe *PolicyError
+		if !errors.As(err, &pe) || pe.Line != tt.errLine || ExitCode(err) != ExitSemantic {
+			t.Errorf("%s: got %v, want a semantic error on line %d", tt.name, err, tt.errLine)
+		}
+	}
+}
+
+func TestNestedDOptions(t *testing.T) {
+
+	tokens := rules("D: /var", "D: /var/www")
+	tokens[1].options = RuleOptions{Events: []string{"create", "delete"}}
+
+	warnings, err := SemanticValidation(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "options win") {
+		t.Errorf("got %v, want the nested D's options to win", warnings)
+	}
+
+	// same events, in another order
+	tokens[0].options = RuleOptions{Events: []string{"delete", "create"}}
+	warnings, _ = SemanticValidation(tokens)
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "already included") {
+		t.Errorf("got %v, want the nested D to be redundant", warnings)
+	}
+}
+
+func TestSyntaxValidationClasses(t *testing.T) {
+
+	err := SyntaxValidation(rules("EE: log"))
+	if ExitCode(err) != ExitSyntax {
+		t.Fatalf("EE without dot: got %v", err)
+	}
+
+	want := "ERROR [Line 1]: extension must start with .\n  EE: log\n      ^\nwrite the extension with its dot: .log"
+	if err.Error() != want {
+		t.Errorf("got\n%s\nwant\n%s", err, want)
+	}
+
+	if ExitCode(fmt.Errorf("wrapped: %w", err)) != ExitSyntax {
+		t.Error("class lost through wrapping")
+	}
+	if ExitCode(errors.New("other")) != 1 {
+		t.Error("other errors should exit 1")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "config.txt")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	warnings, err := ValidateConfig(write("D: " + dir + "\nD: /nonexistent/watchd\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Line != 2 {
+		t.Errorf("got warnings %v, want one for the missing path", warnings)
+	}
+
+	if _, err := ValidateConfig(write("D /etc\n")); ExitCode(err) != ExitSyntax {
+		t.Errorf("colon missing: got %v", err)
+	}
+	if _, err := ValidateConfig(write("ES: ~\nES: ~\n")); ExitCode(err) != ExitSemantic {
+		t.Errorf("duplicate: got %v", err)
+	}
+	if _, err := ValidateConfig(filepath.Join(dir, "missing.txt")); ExitCode(err) != ExitFilesystem {
+		t.Errorf("missing config: got %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"watchd/bpfloader"
+	"watchd/eventcore"
+	"watchd/fanotify"
+	"watchd/netlog"
+	"watchd/preprocess"
+	"watchd/selfcheck"
+)
+
+// livePolicy is the policy in effect, a reload replaces it as a whole
+type livePolicy struct {
+	mu     sync.Mutex // held while an event is processed or a reload applied
+	policy *preprocess.Cache
+}
+
+// process runs event through eventcore with the policy in effect
+func (l *livePolicy) process(event *bpfloader.FileChangeEvent, bpf *bpfloader.BPF) (netlog.Payload, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return eventcore.ProcessEvent(event, bpf, l.policy)
+}
+
+// with runs fn with the policy in effect, as an event would see it
+func (l *livePolicy) with(fn func(policy *preprocess.Cache)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fn(l.policy)
+}
+
+// reloader applies a new version of the config to a running watchd
+type reloader struct {
+	mu   sync.Mutex // one reload at a time
+	hash string     // of the config last applied or rejected, "" if unreadable
+
+	live    *livePolicy
+	bpf     *bpfloader.BPF     // nil for the fanotify backend
+	watcher *fanotify.Watcher  // nil for the ebpf backend
+	checker *selfcheck.Checker // nil if the self check is off
+}
+
+// errUnchanged is returned by reload for a config that is the one last
+// applied or rejected
+var errUnchanged = errors.New("config unchanged")
+
+// reload parses the config again and replaces the policy in effect with it,
+// changing only the policy table entries that differ. The walk runs while
+// events are still processed with the current policy, they only wait while
+// the changes are applied. On any error the current policy stays.
+//
+// With skipUnchanged, a config with the hash of the last one applied or
+// rejected returns errUnchanged.
+func (r *reloader) reload(skipUnchanged bool) (preprocess.PolicyDiff, string, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hash, _ := preprocess.HashConfig(config)
+	if skipUnchanged && hash == r.hash {
+		r.reloadDone()
+		return preprocess.PolicyDiff{}, hash, errUnchanged
+	}
+	r.hash = hash
+
+	next, err := preprocess.ParseConfig(config)
+	if err != nil {
+		r.reloadDone()
+		return preprocess.PolicyDiff{}, hash, err
+	}
+
+	r.live.mu.Lock()
+	diff := preprocess.Diff(r.live.policy, &next)
+	if err := diff.Apply(r.bpf); err != nil {
+		r.live.mu.Unlock()
+		r.reloadDone()
+		return preprocess.PolicyDiff{}, hash, err
+	}
+	if r.watcher != nil {
+		r.watcher.Reload(&next, diff)
+	}
+	r.live.policy = &next
+	r.live.mu.Unlock()
+
+	if r.checker != nil {
+		r.checker.PolicyReloaded(&next, config)
+	}
+	return diff, hash, nil
+}
+
+// reloadDone tells the self check the config was rejected or unchanged, a
+// routine config push isn't tampering
+func (r *reloader) reloadDone() {
+	if r.checker != nil {
+		r.checker.ReloadDone(config)
+	}
+}
+
+// logReload reloads and logs the outcome with the policy hash, cause is
+// what asked for it
+func (r *reloader) logReload(cause string, skipUnchanged bool) (preprocess.PolicyDiff, error) {
+
+	diff, hash, err := r.reload(skipUnchanged)
+	if errors.Is(err, errUnchanged) {
+		return diff, err
+	}
+	if err != nil {
+		log.Printf("ERROR: policy %s rejected (%s), keeping the current policy: %v", shortHash(hash), cause, err)
+		return diff, err
+	}
+	log.Printf("Policy %s applied (%s): %d entries added, %d removed, %d changed", shortHash(hash), cause, len(diff.Added), len(diff.Removed), len(diff.Changed))
+	return diff, nil
+}
+
+// shortHash abbreviates a policy hash for logs
+func shortHash(hash string) string {
+	if hash == "" {
+		return "(unreadable)"
+	}
+	return hash[:12]
+}
+
+// serveControl answers the requests of watchd reload on l until it is
+// closed
+func (r *reloader) serveControl(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("control socket: %v", err)
+			continue
+		}
+		go r.handleControl(conn)
+	}
+}
+
+// handleControl answers one request. The first line of the reply is "OK" or
+// "ERROR <exit code>", the message follows.
+func (r *reloader) handleControl(conn net.Conn) {
+
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return
+	}
+
+	switch strings.TrimSpace(line) {
+	case "reload":
+		diff, err := r.logReload("control", false)
+		if err != nil {
+			fmt.Fprintf(conn, "ERROR %d\n%v\n", preprocess.ExitCode(err), err)
+			return
+		}
+		fmt.Fprintf(conn, "OK\npolicy reloaded: %d entries added, %d removed, %d changed\n", len(diff.Added), len(diff.Removed), len(diff.Changed))
+	default:
+		fmt.Fprintf(conn, "ERROR 1\nunknown request %q\n", strings.TrimSpace(line))
+	}
+}
+
+// listenControl opens the control socket at path, replacing a socket left
+// behind by a watchd that didn't exit cleanly
+func listenControl(path string) (net.Listener, error) {
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// requestReload asks the watchd listening at path to reload its config and
+// prints the reply. A rejected reload returns the class of its error.
+func requestReload(path string) error {
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("no watchd listening on %s: %w", path, err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "reload\n"); err != nil {
+		return err
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+
+	status, message, _ := strings.Cut(string(reply), "\n")
+	if status == "OK" {
+		fmt.Print(message)
+		return nil
+	}
+
+	code, err := strconv.Atoi(strings.TrimPrefix(status, "ERROR "))
+	if err != nil {
+		return fmt.Errorf("malformed reply %q", status)
+	}
+	return &preprocess.PolicyError{Code: code, Message: "reload rejected, the current policy stays\n" + strings.TrimSpace(message)}
+}
@@ -0,0 +1,311 @@
+// Package selfcheck detects tampering with watchd itself: hooks detached
+// from the kernel, policy table entries removed behind its back, and changes
+// to its own binary, config and API auth file.
+package selfcheck
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"watchd/bpfloader"
+	"watchd/preprocess"
+)
+
+// Finding is a single sign of tampering
+type Finding struct {
+	Target string // hook, map or file tampered with
+	Reason string
+}
+
+// Checker holds what watchd looked like at startup to compare against.
+type Checker struct {
+	mu     sync.Mutex // Check and PolicyReloaded run in different goroutines
+	closed bool
+
+	bpf      *bpfloader.BPF
+	report   *bpfloader.AttachReport
+	reattach bool
+
+	// policy entries of the D and IF roots, they exist on disk for as long
+	// as the same inode stays at the path
+	pinned  map[string]bpfloader.TrackedFileKey
+	emptied bool
+
+	files map[string]fileState
+
+	// config files with a reload coming, they aren't checked until it ran
+	pending map[string]bool
+}
+
+// fileState is what a watched file looked like when it was last checked
+type fileState struct {
+	ino   uint64
+	size  int64
+	mtime syscall.Timespec
+	ctime syscall.Timespec
+	hash  [sha256.Size]byte
+	gone  bool
+}
+
+// New snapshots the policy roots of policy and the files. bpf and report
+// may be nil for backends without eBPF. With reattach, detached hooks are
+// attached again by Check.
+//
+// It has to run before events are processed, it reads the policy lookup
+// table.
+func New(bpf *bpfloader.BPF, report *bpfloader.AttachReport, policy *preprocess.Cache, files []string, reattach bool) *Checker {
+
+	c := &Checker{
+		bpf:      bpf,
+		report:   report,
+		reattach: reattach,
+		pinned:   make(map[string]bpfloader.TrackedFileKey),
+		files:    make(map[string]fileState),
+		pending:  make(map[string]bool),
+	}
+
+	c.pin(policy)
+
+	for _, path := range files {
+		if path == "" {
+			continue
+		}
+		state, err := snapshot(path, nil)
+		if err != nil {
+			log.Printf("WARN: self check can't watch %s: %v", path, err)
+			continue
+		}
+		c.files[path] = state
+	}
+
+	return c
+}
+
+// pin records the policy entries of the roots of policy
+func (c *Checker) pin(policy *preprocess.Cache) {
+	for _, root := range policy.WatchRoots() {
+		key, err := statKey(root)
+		if err != nil {
+			continue
+		}
+		if _, ok := policy.LookupTable[key]; ok {
+			c.pinned[root] = key
+		}
+	}
+}
+
+// PolicyReloaded makes the checker expect policy, which replaced the one it
+// was created with, and the content config has now. Entries the reload
+// removed are not reported.
+func (c *Checker) PolicyReloaded(policy *preprocess.Cache, config string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pinned = make(map[string]bpfloader.TrackedFileKey)
+	c.pin(policy)
+	c.expect(config)
+}
+
+// ReloadPending tells the checker config changed and a reload of it is
+// coming. It isn't checked until ReloadDone or PolicyReloaded.
+func (c *Checker) ReloadPending(config string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[config] = true
+}
+
+// ReloadDone makes the checker expect the content config has now, after a
+// reload that rejected it or found it unchanged
+func (c *Checker) ReloadDone(config string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expect(config)
+}
+
+// expect takes the current state of config as the expected one
+func (c *Checker) expect(config string) {
+	delete(c.pending, config)
+	if _, ok := c.files[config]; ok {
+		if state, err := snapshot(config, nil); err == nil {
+			c.files[config] = state
+		}
+	}
+}
+
+// Close stops the checker, Check finds nothing from then on. Once it
+// returns, the checker doesn't touch the hooks of the attach report any
+// more and they can be closed.
+func (c *Checker) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+// Check runs all checks and returns what changed since the previous Check.
+// Each change is reported once.
+func (c *Checker) Check() []Finding {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	var findings []Finding
+
+	if c.report != nil {
+		findings = append(findings, c.checkLinks()...)
+	}
+	if c.bpf != nil {
+		findings = append(findings, c.checkPolicy()...)
+	}
+	findings = append(findings, c.checkFiles()...)
+
+	return findings
+}
+
+// checkLinks reports detached hooks, and re-attaches them if asked to
+func (c *Checker) checkLinks() []Finding {
+
+	var findings []Finding
+
+	for _, h := range c.report.VerifyLinks() {
+		reason := h.Err.Error()
+		if c.reattach {
+			if err := h.Reattach(); err != nil {
+				reason += ", " + err.Error()
+			} else {
+				reason += ", re-attached"
+			}
+		} else {
+			// report once, the hook stays detached
+			h.Link.Close()
+			h.Link = nil
+		}
+		findings = append(findings, Finding{Target: "hook " + h.Hook, Reason: reason})
+	}
+
+	return findings
+}
+
+// checkPolicy reports an emptied policy table and removed entries of the
+// policy roots
+func (c *Checker) checkPolicy() []Finding {
+
+	var findings []Finding
+
+	count, err := c.bpf.PolicyEntries()
+	if err != nil {
+		return []Finding{{Target: "policy_table", Reason: fmt.Sprintf("unreadable: %v", err)}}
+	}
+	if count == 0 && len(c.pinned) > 0 && !c.emptied {
+		findings = append(findings, Finding{Target: "policy_table", Reason: "emptied"})
+	}
+	c.emptied = count == 0
+
+	for root, key := range c.pinned {
+		// the root was deleted or replaced, its entry went legitimately
+		if current, err := statKey(root); err != nil || current != key {
+			delete(c.pinned, root)
+			continue
+		}
+		ok, err := c.bpf.HasPolicyEntry(key)
+		if err != nil || ok {
+			continue
+		}
+		findings = append(findings, Finding{Target: "policy_table", Reason: fmt.Sprintf("entry of %s removed", root)})
+		delete(c.pinned, root)
+	}
+
+	return findings
+}
+
+// checkFiles reports watched files that were modified, replaced or removed
+func (c *Checker) checkFiles() []Finding {
+
+	var findings []Finding
+
+	for path, old := range c.files {
+		if c.pending[path] {
+			continue
+		}
+		state, err := snapshot(path, &old)
+		if errors.Is(err, os.ErrNotExist) {
+			if !old.gone {
+				findings = append(findings, Finding{Target: path, Reason: "removed"})
+				c.files[path] = fileState{gone: true}
+			}
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case old.gone:
+			findings = append(findings, Finding{Target: path, Reason: "recreated"})
+		case state.hash != old.hash:
+			findings = append(findings, Finding{Target: path, Reason: "content changed"})
+		case state.ino != old.ino:
+			findings = append(findings, Finding{Target: path, Reason: "replaced by another file with the same content"})
+		}
+		c.files[path] = state
+	}
+
+	return findings
+}
+
+// snapshot stats and hashes the file at path. The hash of old is reused if
+// the file looks unchanged.
+func snapshot(path string, old *fileState) (fileState, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	defer f.Close()
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return fileState{}, err
+	}
+
+	state := fileState{
+		ino:   st.Ino,
+		size:  st.Size,
+		mtime: st.Mtim,
+		ctime: st.Ctim,
+	}
+	if old != nil && !old.gone && old.ino == state.ino && old.size == state.size &&
+		old.mtime == state.mtime && old.ctime == state.ctime {
+		state.hash = old.hash
+		return state, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fileState{}, err
+	}
+	copy(state.hash[:], h.Sum(nil))
+	return state, nil
+}
+
+// statKey returns the policy table key of path
+func statKey(path string) (bpfloader.TrackedFileKey, error) {
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return bpfloader.TrackedFileKey{}, err
+	}
+	return bpfloader.TrackedFileKey{
+		InodeNumber: st.Ino,
+		Dev:         preprocess.KernelDev(&st),
+	}, nil
+}
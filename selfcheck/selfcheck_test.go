@@ -0,0 +1,116 @@
+package selfcheck
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"watchd/preprocess"
+)
+
+func TestCheckFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.txt")
+	auth := filepath.Join(dir, "api.json")
+
+	if err := os.WriteFile(config, []byte("D /etc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(auth, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(nil, nil, &preprocess.Cache{}, []string{config, auth, ""}, false)
+
+	expect := func(step string, want ...string) {
+		t.Helper()
+		findings := c.Check()
+		if len(findings) != len(want) {
+			t.Fatalf("%s: got %+v, want %v", step, findings, want)
+		}
+		for i, f := range findings {
+			if f.Reason != want[i] {
+				t.Errorf("%s: got %+v, want %s", step, f, want[i])
+			}
+		}
+	}
+
+	expect("untouched")
+
+	if err := os.WriteFile(config, []byte("D /\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expect("modified", "content changed")
+	expect("reported once")
+
+	// same content under a new inode
+	tmp := filepath.Join(dir, "api.json.new")
+	if err := os.WriteFile(tmp, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, auth); err != nil {
+		t.Fatal(err)
+	}
+	expect("replaced", "replaced by another file with the same content")
+
+	if err := os.Remove(auth); err != nil {
+		t.Fatal(err)
+	}
+	expect("removed", "removed")
+	expect("reported once")
+
+	if err := os.WriteFile(auth, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expect("recreated", "recreated")
+}
+
+func TestCheckAfterClose(t *testing.T) {
+
+	config := filepath.Join(t.TempDir(), "config.txt")
+	if err := os.WriteFile(config, []byte("D /etc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(nil, nil, &preprocess.Cache{}, []string{config}, false)
+	c.Close()
+
+	if err := os.Remove(config); err != nil {
+		t.Fatal(err)
+	}
+	if findings := c.Check(); findings != nil {
+		t.Errorf("closed checker found %+v", findings)
+	}
+}
+
+func TestCheckPendingReload(t *testing.T) {
+
+	config := filepath.Join(t.TempDir(), "config.txt")
+	if err := os.WriteFile(config, []byte("D /etc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := New(nil, nil, &preprocess.Cache{}, []string{config}, false)
+
+	// a check inside the debounce of the reload
+	c.ReloadPending(config)
+	if err := os.WriteFile(config, []byte("D /\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if findings := c.Check(); len(findings) != 0 {
+		t.Errorf("pending reload: got %+v", findings)
+	}
+
+	// the reload rejected it
+	c.ReloadDone(config)
+	if findings := c.Check(); len(findings) != 0 {
+		t.Errorf("rejected reload: got %+v", findings)
+	}
+
+	// a change without a reload coming
+	if err := os.WriteFile(config, []byte("D /etc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if findings := c.Check(); len(findings) != 1 || findings[0].Reason != "content changed" {
+		t.Errorf("no reload: got %+v", findings)
+	}
+}
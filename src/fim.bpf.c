@@ -1,7 +1,7 @@
-
 #include "maps.h"
 #include "mtypes.h"
 #include "vmlinux.h"
+#include "wire.h"
 #include <bpf/bpf_core_read.h>
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
@@ -14,11 +14,9 @@ SEC("lsm/inode_create")
 int BPF_PROG(watchd_inode_create, struct inode *dir, struct dentry *dentry,
              umode_t mode) {
   struct KEY key = {};
-  struct EVENT *event;
-  struct task_struct *task;
+  struct WIRE_EVENT *event;
   struct VALUE *val;
   struct inode *inode;
-  __u64 uid_gid;
 
   // parent key
   key.inode = BPF_CORE_READ(dir, i_ino);
@@ -29,32 +27,21 @@ int BPF_PROG(watchd_inode_create, struct inode *dir, struct dentry *dentry,
     return 0;
 
   inode = BPF_CORE_READ(dentry, d_inode);
-  event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+  event = wire_begin(wire_track(val, CREATE), 0);
   if (!event)
     return 0;
 
-  event->parent_dev = key.dev;
-  event->parent_inode_number = key.inode;
-
-  task = (struct task_struct *)bpf_get_current_task();
-  event->tty_major = BPF_CORE_READ(task, signal, tty, driver, major);
-  event->tty_index = BPF_CORE_READ(task, signal, tty, index);
-
-  event->change_type = CREATE;
+  event->file.parent_dev = key.dev;
+  event->file.parent_inode_number = key.inode;
 
-  event->before_size = 0;
-  event->after_size = 0; // new file starts empty
+  event->file.before_size = 0;
+  event->file.after_size = 0; // new file starts empty
 
-  event->inode_number = BPF_CORE_READ(inode, i_ino);
-  event->dev = BPF_CORE_READ(inode, i_sb, s_dev);
-
-  uid_gid = bpf_get_current_uid_gid();
-  event->uid = (__u32)(uid_gid & 0xffffffff);
+  event->file.inode_number = BPF_CORE_READ(inode, i_ino);
+  event->file.dev = BPF_CORE_READ(inode, i_sb, s_dev);
 
   const unsigned char *name = BPF_CORE_READ(dentry, d_name.name);
-  bpf_probe_read_kernel_str(event->filename, sizeof(event->filename), name);
-
-  bpf_ringbuf_submit(event, 0);
+  wire_submit(event, name);
   return 0;
 }
 
@@ -64,11 +51,9 @@ SEC("lsm/inode_mkdir")
 int BPF_PROG(watchd_inode_mkdir, struct inode *dir, struct dentry *dentry,
              umode_t mode) {
   struct KEY key = {};
-  struct EVENT *event;
-  struct task_struct *task;
+  struct WIRE_EVENT *event;
   struct VALUE *val;
   struct inode *inode;
-  __u64 uid_gid;
 
   key.inode = BPF_CORE_READ(dir, i_ino);
   key.dev = BPF_CORE_READ(dir, i_sb, s_dev);
@@ -81,46 +66,44 @@ int BPF_PROG(watchd_inode_mkdir, struct inode *dir, struct dentry *dentry,
   if (!inode)
     return 0;
 
-  event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+  event = wire_begin(wire_track(val, CREATE), 0);
   if (!event)
     return 0;
 
-  event->parent_dev = key.dev;
-  event->parent_inode_number = key.inode;
-
-  task = (struct task_struct *)bpf_get_current_task();
-  event->tty_major = BPF_CORE_READ(task, signal, tty, driver, major);
-  event->tty_index = BPF_CORE_READ(task, signal, tty, index);
+  event->file.parent_dev = key.dev;
+  event->file.parent_inode_number = key.inode;
 
-  event->change_type = CREATE;
+  event->file.before_size = 0;
+  event->file.after_size = DIR_SIZE; // your constant for directory
 
-  event->before_size = 0;
-  event->after_size = DIR_SIZE; // your constant for directory
-
-  event->inode_number = BPF_CORE_READ(inode, i_ino);
-  event->dev = BPF_CORE_READ(inode, i_sb, s_dev);
-
-  uid_gid = bpf_get_current_uid_gid();
-  event->uid = (__u32)(uid_gid & 0xffffffff);
+  event->file.inode_number = BPF_CORE_READ(inode, i_ino);
+  event->file.dev = BPF_CORE_READ(inode, i_sb, s_dev);
 
   const unsigned char *name = BPF_CORE_READ(dentry, d_name.name);
-  bpf_probe_read_kernel_str(event->filename, sizeof(event->filename), name);
-
-  bpf_ringbuf_submit(event, 0);
+  wire_submit(event, name);
   return 0;
 }
 
 //------------------------------------ DELETE ---------------------------------
+// remaining_links returns the links the inode of dentry keeps once dentry is
+// unlinked. A file with other names stays tracked and is reported as UNLINK,
+// the last name goes as DELETE.
+static __always_inline __u32 remaining_links(struct dentry *dentry) {
+  __u32 nlink = BPF_CORE_READ(dentry, d_inode, i_nlink);
+
+  return nlink > 1 ? nlink - 1 : 0;
+}
+
 // For files
 SEC("lsm/inode_unlink")
 int BPF_PROG(watchd_inode_unlink, struct inode *dir, struct dentry *dentry) {
 
   struct KEY key = {};
-  struct EVENT *event;
-  struct task_struct *task;
+  struct WIRE_EVENT *event;
   struct VALUE *val;
-  umode_t mode;
-  __u64 uid_gid;
+  __s64 before_size;
+  __u32 links;
+  __u16 type;
 
   // make key
   key.inode = BPF_CORE_READ(dentry, d_inode, i_ino);
@@ -129,37 +112,33 @@ int BPF_PROG(watchd_inode_unlink, struct inode *dir, struct dentry *dentry) {
   val = bpf_map_lookup_elem(&policy_table, &key);
   if (!val)
     return 0;
+  before_size = val->file_size;
 
-  // delete from policy table
-  bpf_map_delete_elem(&policy_table, &key);
+  // keep the entry while other names link the inode
+  links = remaining_links(dentry);
+  type = wire_track(val, links ? UNLINK : DELETE);
+  if (!links)
+    bpf_map_delete_elem(&policy_table, &key);
 
-  event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+  event = wire_begin(type, links);
   if (!event) {
     return 0;
   }
 
-  event->parent_dev = BPF_CORE_READ(dir, i_sb, s_dev);
-  event->parent_inode_number = BPF_CORE_READ(dir, i_ino);
+  event->file.parent_dev = BPF_CORE_READ(dir, i_sb, s_dev);
+  event->file.parent_inode_number = BPF_CORE_READ(dir, i_ino);
 
-  task = (struct task_struct *)bpf_get_current_task();
-  event->tty_major = BPF_CORE_READ(task, signal, tty, driver, major);
-  event->tty_index = BPF_CORE_READ(task, signal, tty, index);
-
-  event->change_type = DELETE;
-  event->before_size = val->file_size;
-  event->after_size = 0;
+  event->file.before_size = before_size;
+  event->file.after_size = links ? before_size : 0;
 
   // populate rest of the event structure
 
-  event->inode_number = BPF_CORE_READ(dentry, d_inode, i_ino);
-  event->dev = BPF_CORE_READ(dentry, d_inode, i_sb, s_dev);
-  uid_gid = bpf_get_current_uid_gid();
-  event->uid = (__u32)(uid_gid & 0xffffffff);
+  event->file.inode_number = key.inode;
+  event->file.dev = key.dev;
   const unsigned char *name = BPF_CORE_READ(dentry, d_name.name);
-  bpf_probe_read_kernel_str(event->filename, sizeof(event->filename), name);
 
   // submit event to ring buffer
-  bpf_ringbuf_submit(event, 0);
+  wire_submit(event, name);
 
   return 0;
 }
@@ -168,11 +147,10 @@ SEC("lsm/inode_rmdir")
 int BPF_PROG(watchd_inode_rmdir, struct inode *dir, struct dentry *dentry) {
 
   struct KEY key = {};
-  struct EVENT *event;
-  struct task_struct *task;
+  struct WIRE_EVENT *event;
   struct VALUE *val;
-  umode_t mode;
-  __u64 uid_gid;
+  __s64 before_size;
+  __u16 type;
 
   // make key
   key.inode = BPF_CORE_READ(dentry, d_inode, i_ino);
@@ -181,37 +159,31 @@ int BPF_PROG(watchd_inode_rmdir, struct inode *dir, struct dentry *dentry) {
   val = bpf_map_lookup_elem(&policy_table, &key);
   if (!val)
     return 0;
+  before_size = val->file_size;
+  type = wire_track(val, DELETE);
 
   // delete from policy table
   bpf_map_delete_elem(&policy_table, &key);
 
-  event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+  event = wire_begin(type, 0);
   if (!event) {
     return 0;
   }
 
-  event->parent_dev = BPF_CORE_READ(dir, i_sb, s_dev);
-  event->parent_inode_number = BPF_CORE_READ(dir, i_ino);
-
-  task = (struct task_struct *)bpf_get_current_task();
-  event->tty_major = BPF_CORE_READ(task, signal, tty, driver, major);
-  event->tty_index = BPF_CORE_READ(task, signal, tty, index);
+  event->file.parent_dev = BPF_CORE_READ(dir, i_sb, s_dev);
+  event->file.parent_inode_number = BPF_CORE_READ(dir, i_ino);
 
-  event->change_type = DELETE;
-  event->before_size = val->file_size;
-  event->after_size = 0;
+  event->file.before_size = before_size;
+  event->file.after_size = 0;
 
   // populate rest of the event structure
 
-  event->inode_number = BPF_CORE_READ(dentry, d_inode, i_ino);
-  event->dev = BPF_CORE_READ(dentry, d_inode, i_sb, s_dev);
-  uid_gid = bpf_get_current_uid_gid();
-  event->uid = (__u32)(uid_gid & 0xffffffff);
+  event->file.inode_number = key.inode;
+  event->file.dev = key.dev;
   const unsigned char *name = BPF_CORE_READ(dentry, d_name.name);
-  bpf_probe_read_kernel_str(event->filename, sizeof(event->filename), name);
 
   // submit event to ring buffer
-  bpf_ringbuf_submit(event, 0);
+  wire_submit(event, name);
 
   return 0;
 }
@@ -223,10 +195,9 @@ int BPF_PROG(vfs_write_exit_hook, struct file *file, const char *buf,
              size_t count, loff_t *pos, ssize_t ret) {
 
   struct KEY key = {};
-  struct EVENT *event;
-  struct task_struct *task;
+  struct WIRE_EVENT *event;
   struct VALUE *val;
-  __u64 uid_gid;
+  __s64 before_size;
 
   // if no bytes are written then return early
   if (ret <= 0) {
@@ -241,41 +212,37 @@ int BPF_PROG(vfs_write_exit_hook, struct file *file, const char *buf,
   if (!val)
     return 0;
 
-  event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+  // update map for new size, also when MODIFY is masked out, so the size
+  // before the next reported change is right
+  before_size = val->file_size;
+  val->file_size = BPF_CORE_READ(file, f_inode, i_size);
+  bpf_map_update_elem(&policy_table, &key, val, BPF_ANY);
+
+  if (!wire_wanted(val, MODIFY))
+    return 0;
+
+  event = wire_begin(MODIFY, ret);
   if (!event) {
     return 0;
   }
 
-  event->parent_dev =
+  event->file.parent_dev =
       BPF_CORE_READ(file, f_path.dentry, d_parent, d_inode, i_sb, s_dev);
-  event->parent_inode_number =
+  event->file.parent_inode_number =
       BPF_CORE_READ(file, f_path.dentry, d_parent, d_inode, i_ino);
 
-  task = (struct task_struct *)bpf_get_current_task();
-  event->tty_major = BPF_CORE_READ(task, signal, tty, driver, major);
-  event->tty_index = BPF_CORE_READ(task, signal, tty, index);
-
-  event->change_type = MODIFY;
-  event->change_type |= ret << 4;
-  event->before_size = val->file_size;
-  event->after_size = BPF_CORE_READ(file, f_inode, i_size);
-  val->file_size = event->after_size;
-
-  // update map for new size
-  bpf_map_update_elem(&policy_table, &key, val, BPF_ANY);
+  event->file.before_size = before_size;
+  event->file.after_size = val->file_size;
 
   // populate rest of the event structure
 
-  event->inode_number = key.inode;
-  event->dev = key.dev;
-  uid_gid = bpf_get_current_uid_gid();
-  event->uid = (__u32)(uid_gid & 0xffffffff);
+  event->file.inode_number = key.inode;
+  event->file.dev = key.dev;
 
   const unsigned char *name = BPF_CORE_READ(file->f_path.dentry, d_name.name);
-  bpf_probe_read_kernel_str(event->filename, sizeof(event->filename), name);
 
   // submit event to ring buffer
-  bpf_ringbuf_submit(event, 0);
+  wire_submit(event, name);
 
   return 0;
 }
@@ -289,3 +256,328 @@ int BPF_PROG(watchd_inode_rename, struct inode *old_dir,
 
   return 0;
 }
+
+// ----------------------------- Inode flags ------------------------------
+// chattr +i / +a etc. goes through FS_IOC_SETFLAGS, xfs_io chattr through
+// FS_IOC_FSSETXATTR. 32-bit processes use FS_IOC32_SETFLAGS, which reaches
+// file_ioctl before 6.8 and file_ioctl_compat since.
+
+static __always_inline int submit_flags_event(struct file *file,
+                                              unsigned int cmd,
+                                              unsigned long arg) {
+
+  struct KEY key = {};
+  struct WIRE_EVENT *event;
+  struct VALUE *val;
+  __u32 new_flags = 0;
+  __u32 kind;
+
+  if (cmd == FS_IOC_SETFLAGS || cmd == FS_IOC32_SETFLAGS) {
+    kind = FLAGS_KIND_SETFLAGS;
+  } else if (cmd == FS_IOC_FSSETXATTR) {
+    kind = FLAGS_KIND_FSSETXATTR;
+  } else {
+    return 0;
+  }
+
+  key.inode = BPF_CORE_READ(file, f_inode, i_ino);
+  key.dev = BPF_CORE_READ(file, f_inode, i_sb, s_dev);
+
+  val = bpf_map_lookup_elem(&policy_table, &key);
+  if (!val || !wire_wanted(val, FLAGS_CHANGED))
+    return 0;
+
+  // FS_IOC_SETFLAGS takes an int, FS_IOC_FSSETXATTR a struct fsxattr whose
+  // first member is fsx_xflags. Both are a __u32 at arg.
+  if (bpf_probe_read_user(&new_flags, sizeof(new_flags), (void *)arg) < 0)
+    return 0;
+
+  event = wire_begin(FLAGS_CHANGED, kind);
+  if (!event) {
+    return 0;
+  }
+
+  event->file.parent_dev =
+      BPF_CORE_READ(file, f_path.dentry, d_parent, d_inode, i_sb, s_dev);
+  event->file.parent_inode_number =
+      BPF_CORE_READ(file, f_path.dentry, d_parent, d_inode, i_ino);
+
+  event->file.before_size = val->file_size;
+  event->file.after_size = val->file_size;
+  event->file.old_flags = BPF_CORE_READ(file, f_inode, i_flags);
+  event->file.new_flags = new_flags;
+
+  event->file.inode_number = key.inode;
+  event->file.dev = key.dev;
+
+  const unsigned char *name = BPF_CORE_READ(file, f_path.dentry, d_name.name);
+
+  // submit event to ring buffer
+  wire_submit(event, name);
+
+  return 0;
+}
+
+SEC("lsm/file_ioctl")
+int BPF_PROG(watchd_file_ioctl, struct file *file, unsigned int cmd,
+             unsigned long arg) {
+  return submit_flags_event(file, cmd, arg);
+}
+
+// Linux 6.8+, userspace loads it on its own
+SEC("lsm/file_ioctl_compat")
+int BPF_PROG(watchd_file_ioctl_compat, struct file *file, unsigned int cmd,
+             unsigned long arg) {
+  return submit_flags_event(file, cmd, arg);
+}
+
+// ----------------------------- Mounts ---------------------------------
+// A mount over (or above) a tracked directory shadows every tracked inode
+// under it. Mounts are rare, so every mount change is reported and
+// userspace decides whether it touches a tracked directory.
+
+static __always_inline int submit_mount_event(struct dentry *mountpoint,
+                                              __u32 kind) {
+  struct WIRE_EVENT *event;
+
+  if (!mountpoint)
+    return 0;
+
+  event = wire_begin(MOUNT, kind);
+  if (!event) {
+    return 0;
+  }
+
+  event->file.parent_dev =
+      BPF_CORE_READ(mountpoint, d_parent, d_inode, i_sb, s_dev);
+  event->file.parent_inode_number =
+      BPF_CORE_READ(mountpoint, d_parent, d_inode, i_ino);
+
+  event->file.inode_number = BPF_CORE_READ(mountpoint, d_inode, i_ino);
+  event->file.dev = BPF_CORE_READ(mountpoint, d_inode, i_sb, s_dev);
+
+  const unsigned char *name = BPF_CORE_READ(mountpoint, d_name.name);
+
+  // submit event to ring buffer
+  wire_submit(event, name);
+
+  return 0;
+}
+
+SEC("lsm/sb_mount")
+int BPF_PROG(watchd_sb_mount, const char *dev_name, const struct path *path,
+             const char *type, unsigned long flags, void *data) {
+
+  // remount and propagation changes don't change what is mounted where
+  if (flags & (MS_REMOUNT | MS_PROPAGATION))
+    return 0;
+
+  return submit_mount_event(BPF_CORE_READ(path, dentry), MOUNT_KIND_MOUNT);
+}
+
+SEC("lsm/sb_umount")
+int BPF_PROG(watchd_sb_umount, struct vfsmount *mnt, int flags) {
+
+  struct mount *m = container_of(mnt, struct mount, mnt);
+
+  return submit_mount_event(BPF_CORE_READ(m, mnt_mountpoint),
+                            MOUNT_KIND_UMOUNT);
+}
+
+SEC("lsm/move_mount")
+int BPF_PROG(watchd_move_mount, const struct path *from_path,
+             const struct path *to_path) {
+
+  return submit_mount_event(BPF_CORE_READ(to_path, dentry), MOUNT_KIND_MOVE);
+}
+
+// ----------------------------- Fallback hooks ---------------------------
+// Used when bpf is not in the active LSM list (lsm= boot parameter), the
+// LSM programs above load but cannot be attached. The vfs_* functions are
+// traced instead, create/mkdir on exit so the new inode is instantiated and
+// unlink/rmdir on entry while the inode is still alive. Userspace loads them
+// only when an LSM program fails to attach, picking the _noidmap variants on
+// kernels before 5.12.
+
+static __always_inline int submit_create_event(struct inode *dir,
+                                               struct dentry *dentry,
+                                               __s64 after_size) {
+  struct KEY key = {};
+  struct WIRE_EVENT *event;
+  struct VALUE *val;
+  struct inode *inode;
+
+  key.inode = BPF_CORE_READ(dir, i_ino);
+  key.dev = BPF_CORE_READ(dir, i_sb, s_dev);
+
+  val = bpf_map_lookup_elem(&policy_table, &key);
+  if (!val)
+    return 0;
+
+  inode = BPF_CORE_READ(dentry, d_inode);
+  if (!inode)
+    return 0;
+
+  event = wire_begin(wire_track(val, CREATE), 0);
+  if (!event)
+    return 0;
+
+  event->file.parent_dev = key.dev;
+  event->file.parent_inode_number = key.inode;
+
+  event->file.before_size = 0;
+  event->file.after_size = after_size;
+
+  event->file.inode_number = BPF_CORE_READ(inode, i_ino);
+  event->file.dev = BPF_CORE_READ(inode, i_sb, s_dev);
+
+  const unsigned char *name = BPF_CORE_READ(dentry, d_name.name);
+  wire_submit(event, name);
+  return 0;
+}
+
+// is_dir: directories are always deleted, their i_nlink counts subdirectories
+static __always_inline int submit_delete_event(struct inode *dir,
+                                               struct dentry *dentry,
+                                               int is_dir) {
+  struct KEY key = {};
+  struct WIRE_EVENT *event;
+  struct VALUE *val;
+  __s64 before_size;
+  __u32 links;
+  __u16 type;
+
+  key.inode = BPF_CORE_READ(dentry, d_inode, i_ino);
+  key.dev = BPF_CORE_READ(dentry, d_inode, i_sb, s_dev);
+
+  val = bpf_map_lookup_elem(&policy_table, &key);
+  if (!val)
+    return 0;
+  before_size = val->file_size;
+
+  // keep the entry while other names link the inode
+  links = is_dir ? 0 : remaining_links(dentry);
+  type = wire_track(val, links ? UNLINK : DELETE);
+  if (!links)
+    bpf_map_delete_elem(&policy_table, &key);
+
+  event = wire_begin(type, links);
+  if (!event) {
+    return 0;
+  }
+
+  event->file.parent_dev = BPF_CORE_READ(dir, i_sb, s_dev);
+  event->file.parent_inode_number = BPF_CORE_READ(dir, i_ino);
+
+  event->file.before_size = before_size;
+  event->file.after_size = links ? before_size : 0;
+
+  event->file.inode_number = key.inode;
+  event->file.dev = key.dev;
+  const unsigned char *name = BPF_CORE_READ(dentry, d_name.name);
+
+  // submit event to ring buffer
+  wire_submit(event, name);
+
+  return 0;
+}
+
+SEC("fexit/vfs_create")
+int BPF_PROG(vfs_create_exit_hook, struct mnt_idmap *idmap, struct inode *dir,
+             struct dentry *dentry, umode_t mode, bool want_excl, int ret) {
+  if (ret)
+    return 0;
+
+  return submit_create_event(dir, dentry, 0);
+}
+
+// vfs_mkdir returns int up to 6.14 and struct dentry * since, the return
+// value is not used and a failed mkdir leaves a negative dentry
+SEC("fexit/vfs_mkdir")
+int BPF_PROG(vfs_mkdir_exit_hook, struct mnt_idmap *idmap, struct inode *dir,
+             struct dentry *dentry, umode_t mode) {
+  return submit_create_event(dir, dentry, DIR_SIZE);
+}
+
+SEC("fentry/vfs_unlink")
+int BPF_PROG(vfs_unlink_entry_hook, struct mnt_idmap *idmap, struct inode *dir,
+             struct dentry *dentry) {
+  return submit_delete_event(dir, dentry, 0);
+}
+
+SEC("fentry/vfs_rmdir")
+int BPF_PROG(vfs_rmdir_entry_hook, struct mnt_idmap *idmap, struct inode *dir,
+             struct dentry *dentry) {
+  return submit_delete_event(dir, dentry, 1);
+}
+
+// Before 5.12 the vfs_* functions take no idmap (mnt_userns up to 6.2), the
+// directory comes first
+SEC("fexit/vfs_create")
+int BPF_PROG(vfs_create_exit_hook_noidmap, struct inode *dir,
+             struct dentry *dentry, umode_t mode, bool want_excl, int ret) {
+  if (ret)
+    return 0;
+
+  return submit_create_event(dir, dentry, 0);
+}
+
+SEC("fexit/vfs_mkdir")
+int BPF_PROG(vfs_mkdir_exit_hook_noidmap, struct inode *dir,
+             struct dentry *dentry, umode_t mode) {
+  return submit_create_event(dir, dentry, DIR_SIZE);
+}
+
+SEC("fentry/vfs_unlink")
+int BPF_PROG(vfs_unlink_entry_hook_noidmap, struct inode *dir,
+             struct dentry *dentry) {
+  return submit_delete_event(dir, dentry, 0);
+}
+
+SEC("fentry/vfs_rmdir")
+int BPF_PROG(vfs_rmdir_entry_hook_noidmap, struct inode *dir,
+             struct dentry *dentry) {
+  return submit_delete_event(dir, dentry, 1);
+}
+
+//------------------------------- HEARTBEAT ---------------------------------
+// Run by userspace with BPF_PROG_RUN. The record goes through the priority
+// ring buffer like every other event, so it arriving proves the kernel side
+// and the reader are alive.
+SEC("syscall")
+int watchd_heartbeat(void *ctx) {
+  struct HEARTBEAT_EVENT event = {};
+  struct STATS *s;
+  __u64 events, lost, rate_limited;
+  __u32 zero = 0;
+
+  s = bpf_map_lookup_elem(&stats, &zero);
+  if (!s)
+    return 0;
+
+  events = s->events;
+  lost = s->lost;
+  rate_limited = s->rate_limited;
+
+  event.header.magic = WIRE_MAGIC;
+  event.header.version = WIRE_VERSION;
+  event.header.type = HEARTBEAT;
+  event.header.length = sizeof(event);
+
+  event.counters_hdr.type = SECTION_COUNTERS;
+  event.counters_hdr.length = sizeof(event.counters);
+
+  event.counters.seq = __sync_fetch_and_add(&s->seq, 1) + 1;
+  event.counters.events = events - s->last_events;
+  event.counters.lost = lost - s->last_lost;
+  event.counters.rate_limited = rate_limited - s->last_rate_limited;
+
+  s->last_events = events;
+  s->last_lost = lost;
+  s->last_rate_limited = rate_limited;
+
+  if (bpf_ringbuf_output(&priority_events, &event, sizeof(event), 0))
+    stats_count(STAT_LOST);
+
+  return 0;
+}
@@ -1,3 +1,5 @@
+#ifndef MAPS_H
+#define MAPS_H
 
 #include "mtypes.h"
 #include <bpf/bpf_core_read.h>
@@ -5,8 +7,11 @@
 #include <bpf/bpf_tracing.h>
 
 #define POLICY_MAX_ENTRIES 4000
+// default ring buffer sizes, userspace may resize both before loading
 #define EVENTS_MAX_ENTRIES 1 << 22
+#define PRIORITY_EVENTS_MAX_ENTRIES 1 << 20
 #define DIR_SIZE 4096
+#define RATE_MAX_ENTRIES 8192
 
 /* policy table */
 struct {
@@ -16,8 +21,57 @@ struct {
   __type(value, struct VALUE);
 } policy_table SEC(".maps");
 
-/* Circular ring buffer */
+/* Circular ring buffer for bulk events (MODIFY) */
 struct {
   __uint(type, BPF_MAP_TYPE_RINGBUF);
   __uint(max_entries, EVENTS_MAX_ENTRIES);
 } events SEC(".maps");
+
+/* Ring buffer for everything else, drained first by userspace, so a flood
+ * of writes can't crowd out deletes */
+struct {
+  __uint(type, BPF_MAP_TYPE_RINGBUF);
+  __uint(max_entries, PRIORITY_EVENTS_MAX_ENTRIES);
+} priority_events SEC(".maps");
+
+/* Scratch space to build a variable length event before it is copied to the
+ * ring buffer, bpf_ringbuf_reserve only takes a constant size */
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, struct WIRE_EVENT);
+} wire_buf SEC(".maps");
+
+/* Rate limit configuration, a single entry written by userspace */
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, struct RATE_CONFIG);
+} rate_config SEC(".maps");
+
+/* Token buckets keyed by tgid and by uid, idle ones are evicted */
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, RATE_MAX_ENTRIES);
+  __type(key, __u32);
+  __type(value, struct BUCKET);
+} pid_buckets SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, RATE_MAX_ENTRIES);
+  __type(key, __u32);
+  __type(value, struct BUCKET);
+} uid_buckets SEC(".maps");
+
+/* Event counters for the heartbeat, a single entry */
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, struct STATS);
+} stats SEC(".maps");
+
+#endif
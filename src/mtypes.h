@@ -7,6 +7,61 @@
 #define CREATE 0x1
 #define MODIFY 0x2
 #define DELETE 0x3
+#define FLAGS_CHANGED 0x4
+#define MOUNT 0x5
+
+// RATE_LIMITED is never sent by the hooks, userspace builds it from the drop
+// counters of the rate limit buckets
+#define RATE_LIMITED 0x6
+// a name of a file that keeps other hard links, change_type[31:4] holds the
+// links left. The last name is reported as DELETE.
+#define UNLINK 0x7
+// liveness record, sent when userspace runs the heartbeat program
+#define HEARTBEAT 0x8
+
+#define EVENT_BIT(type) (1U << (type))
+
+// header.type flag of a CREATE, DELETE or UNLINK the event mask leaves out.
+// It is sent anyway for userspace to keep track of the file, and not
+// reported.
+#define TRACK_ONLY 0x100
+
+// ioctl kinds carried in change_type[31:4] for FLAGS_CHANGED
+#define FLAGS_KIND_SETFLAGS 0x0
+#define FLAGS_KIND_FSSETXATTR 0x1
+
+// mount kinds carried in change_type[31:4] for MOUNT
+#define MOUNT_KIND_MOUNT 0x0
+#define MOUNT_KIND_UMOUNT 0x1
+#define MOUNT_KIND_MOVE 0x2
+
+// not exported through vmlinux.h
+#ifndef MS_REMOUNT
+#define MS_REMOUNT 32
+#endif
+
+// propagation changes (MS_UNBINDABLE | MS_PRIVATE | MS_SLAVE | MS_SHARED)
+#ifndef MS_PROPAGATION
+#define MS_PROPAGATION ((1 << 17) | (1 << 18) | (1 << 19) | (1 << 20))
+#endif
+
+#ifndef FS_IOC_SETFLAGS
+#define FS_IOC_SETFLAGS 0x40086602
+#endif
+
+// FS_IOC_SETFLAGS of 32-bit processes, it takes an int as well
+#ifndef FS_IOC32_SETFLAGS
+#define FS_IOC32_SETFLAGS 0x40046602
+#endif
+
+#ifndef FS_IOC_FSSETXATTR
+#define FS_IOC_FSSETXATTR 0x401c5820
+#endif
+
+#ifndef container_of
+#define container_of(ptr, type, member)                                        \
+  ((type *)((void *)(ptr) - __builtin_offsetof(type, member)))
+#endif
 
 #ifndef S_IFMT
 #define S_IFMT 0170000
@@ -20,30 +75,97 @@
 #define S_ISDIR(m) (((m) & S_IFMT) == S_IFDIR)
 #endif
 
-struct EVENT {
+// ------------------------------ Wire format ------------------------------
+// Every event is a WIRE_HEADER followed by typed sections. Each section is
+// a SECTION header and length bytes of payload, padded to 8 bytes. The
+// last section may end unpadded, header.length covers everything.
+//
+// Section types may be added without bumping WIRE_VERSION, readers skip
+// types they don't know. Any change to the layout of the header or of an
+// existing section needs a new WIRE_VERSION and a decoder for it in
+// bpfloader/decode.go.
 
-  // parent Inode number and dev
-  __u64 parent_inode_number;
-  __u64 parent_dev;
+#define WIRE_MAGIC 0x57415443 // "CTAW" on the wire
+#define WIRE_VERSION 1
+
+#define SECTION_FILE 0x1       // struct FILE_SECTION
+#define SECTION_PROCESS 0x2    // struct PROCESS_SECTION
+#define SECTION_NAME 0x3       // file name, not NUL terminated
+#define SECTION_XATTR_NAME 0x4 // extended attribute name, not NUL terminated
+#define SECTION_COUNTERS 0x5   // struct COUNTERS_SECTION
+
+struct WIRE_HEADER {
+  __u32 magic;   // WIRE_MAGIC
+  __u16 version; // WIRE_VERSION
+  __u16 type;    // CREATE, MODIFY, ...
+  __u32 length;  // header and all sections
+  __u32 info;    // MODIFY: bytes written, FLAGS_CHANGED/MOUNT: kind,
+                 // UNLINK: links left
+};
+
+struct SECTION {
+  __u16 type;
+  __u16 reserved;
+  __u32 length; // payload without this header and padding
+};
 
+struct FILE_SECTION {
   // for map key in userspace
   __u64 inode_number;
   __u64 dev;
 
+  // parent Inode number and dev
+  __u64 parent_inode_number;
+  __u64 parent_dev;
+
+  // file size
+  __s64 before_size;
+  __s64 after_size;
+
+  // inode flags for FLAGS_CHANGED
+  // old_flags : inode->i_flags (S_*) before the ioctl, a different bit set
+  //             than new_flags covering sync, noatime, append, immutable
+  //             and dirsync only
+  // new_flags : FS_*_FL or FS_XFLAG_* requested by the ioctl
+  __u32 old_flags;
+  __u32 new_flags;
+};
+
+struct PROCESS_SECTION {
   // for username in userspace
   __u32 uid;
-  __u32 change_type; // [31:4] bytes written ,[3:0] event type
+  __u32 pid; // tgid
 
   // tty
   __u32 tty_index;
   __s32 tty_major;
+};
 
-  // file size
-  __s64 before_size;
-  __s64 after_size;
+// counters of a HEARTBEAT, since the previous one
+struct COUNTERS_SECTION {
+  __u64 seq;          // heartbeat number, starting at 1
+  __u64 events;       // events sent to the ring buffers
+  __u64 lost;         // events the ring buffers had no room for
+  __u64 rate_limited; // events dropped by the rate limits
+};
 
-  // filename
-  char filename[NAME_MAX];
+// What the hooks emit: the fixed sections, then the name. Only the used part
+// of name is sent.
+struct WIRE_EVENT {
+  struct WIRE_HEADER header;
+  struct SECTION file_hdr;
+  struct FILE_SECTION file;
+  struct SECTION process_hdr;
+  struct PROCESS_SECTION process;
+  struct SECTION name_hdr;
+  char name[NAME_MAX];
+};
+
+// What the heartbeat program emits, no file section as it is about no file
+struct HEARTBEAT_EVENT {
+  struct WIRE_HEADER header;
+  struct SECTION counters_hdr;
+  struct COUNTERS_SECTION counters;
 };
 
 struct KEY {
@@ -51,8 +173,44 @@ struct KEY {
   __u64 dev;
 };
 
+// event_mask has bit (1 << type) set for every type reported for the inode,
+// UNLINK goes with DELETE. 0 reports every type.
 struct VALUE {
   __s64 file_size;
+  __u32 event_mask;
+  __u32 pad;
+};
+
+// ------------------------------ Rate limiting ------------------------------
+// Token buckets per tgid and per uid, rate in events per second and burst in
+// events. A rate of 0 disables the bucket. Written by userspace.
+struct RATE_CONFIG {
+  __u64 pid_rate;
+  __u64 pid_burst;
+  __u64 uid_rate;
+  __u64 uid_burst;
+};
+
+// ------------------------------ Statistics ------------------------------
+// Running totals, the heartbeat program reports the difference to the
+// totals of the previous heartbeat.
+struct STATS {
+  __u64 events;
+  __u64 lost;
+  __u64 rate_limited;
+  __u64 seq;
+
+  __u64 last_events;
+  __u64 last_lost;
+  __u64 last_rate_limited;
+};
+
+struct BUCKET {
+  __u64 tokens;  // NSEC_PER_SEC per event
+  __u64 last_ns; // last refill
+  __u64 dropped; // events dropped since the bucket was created
+  __u32 uid;     // owner of the first event, for the summary
+  __u32 pad;
 };
 
 #endif
\ No newline at end of file
@@ -0,0 +1,84 @@
+#ifndef RATELIMIT_H
+#define RATELIMIT_H
+
+#include "maps.h"
+#include "mtypes.h"
+#include "stats.h"
+#include "vmlinux.h"
+#include <bpf/bpf_helpers.h>
+
+#ifndef NSEC_PER_SEC
+#define NSEC_PER_SEC 1000000000ULL
+#endif
+
+// Refill is capped so elapsed * rate can't overflow, userspace caps the
+// rate to RATE_MAX.
+#define RATE_MAX_REFILL_NS (60 * NSEC_PER_SEC)
+
+// bucket_take takes one token from the bucket of id in map. Tokens are kept
+// in nanoseconds worth of rate, one event costs NSEC_PER_SEC. Buckets are
+// updated without a lock, concurrent events of the same id may be let through
+// or dropped one too many, which is fine for a limiter.
+//
+// Returns 1 if the event may be sent, else counts it as dropped and returns 0.
+static __always_inline int bucket_take(void *map, __u32 id, __u32 uid,
+                                       __u64 rate, __u64 burst, __u64 now) {
+  struct BUCKET *bucket;
+  struct BUCKET fresh = {};
+  __u64 elapsed, tokens, cap;
+
+  if (!rate)
+    return 1;
+
+  bucket = bpf_map_lookup_elem(map, &id);
+  if (!bucket) {
+    fresh.tokens = (burst - 1) * NSEC_PER_SEC;
+    fresh.last_ns = now;
+    fresh.uid = uid;
+    bpf_map_update_elem(map, &id, &fresh, BPF_NOEXIST);
+    return 1;
+  }
+
+  elapsed = now - bucket->last_ns;
+  if (elapsed > RATE_MAX_REFILL_NS)
+    elapsed = RATE_MAX_REFILL_NS;
+
+  cap = burst * NSEC_PER_SEC;
+  tokens = bucket->tokens + elapsed * rate;
+  if (tokens > cap)
+    tokens = cap;
+  bucket->last_ns = now;
+
+  if (tokens < NSEC_PER_SEC) {
+    bucket->tokens = tokens;
+    __sync_fetch_and_add(&bucket->dropped, 1);
+    stats_count(STAT_RATE_LIMITED);
+    return 0;
+  }
+
+  bucket->tokens = tokens - NSEC_PER_SEC;
+  return 1;
+}
+
+// rate_allow checks the per-process bucket, then the per-user bucket.
+// Userspace sums up the drop counters of both maps as RATE_LIMITED events.
+static __always_inline int rate_allow(__u32 tgid, __u32 uid) {
+  struct RATE_CONFIG *cfg;
+  __u32 zero = 0;
+  __u64 now;
+
+  cfg = bpf_map_lookup_elem(&rate_config, &zero);
+  if (!cfg || (!cfg->pid_rate && !cfg->uid_rate))
+    return 1;
+
+  now = bpf_ktime_get_ns();
+
+  if (!bucket_take(&pid_buckets, tgid, uid, cfg->pid_rate, cfg->pid_burst,
+                   now))
+    return 0;
+
+  return bucket_take(&uid_buckets, uid, uid, cfg->uid_rate, cfg->uid_burst,
+                     now);
+}
+
+#endif
@@ -0,0 +1,35 @@
+#ifndef STATS_H
+#define STATS_H
+
+#include "maps.h"
+#include "mtypes.h"
+#include "vmlinux.h"
+#include <bpf/bpf_helpers.h>
+
+#define STAT_EVENTS 0
+#define STAT_LOST 1
+#define STAT_RATE_LIMITED 2
+
+// stats_count adds one to a counter of the stats map
+static __always_inline void stats_count(int which) {
+  struct STATS *s;
+  __u32 zero = 0;
+
+  s = bpf_map_lookup_elem(&stats, &zero);
+  if (!s)
+    return;
+
+  switch (which) {
+  case STAT_EVENTS:
+    __sync_fetch_and_add(&s->events, 1);
+    break;
+  case STAT_LOST:
+    __sync_fetch_and_add(&s->lost, 1);
+    break;
+  case STAT_RATE_LIMITED:
+    __sync_fetch_and_add(&s->rate_limited, 1);
+    break;
+  }
+}
+
+#endif
@@ -0,0 +1,115 @@
+#ifndef WIRE_H
+#define WIRE_H
+
+#include "maps.h"
+#include "mtypes.h"
+#include "ratelimit.h"
+#include "stats.h"
+#include "vmlinux.h"
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+
+// wire_wanted tells whether the policy entry val reports events of type.
+// Hooks check it before wire_begin, so a masked out event takes neither
+// ring buffer space nor rate limit tokens. CREATE, DELETE and UNLINK change
+// what is tracked, they go out as TRACK_ONLY instead, see wire_track.
+static __always_inline int wire_wanted(const struct VALUE *val, __u32 type) {
+  return !val->event_mask || (val->event_mask & EVENT_BIT(type));
+}
+
+// wire_track returns the header type of an event of type, which changes
+// what is tracked: type if val reports it, else type | TRACK_ONLY.
+static __always_inline __u16 wire_track(const struct VALUE *val, __u16 type) {
+  __u16 wanted = type == UNLINK ? DELETE : type;
+
+  return wire_wanted(val, wanted) ? type : type | TRACK_ONLY;
+}
+
+// wire_limited tells whether events of the header type go through the rate
+// limit. Only MODIFY and FLAGS_CHANGED do: CREATE, DELETE, UNLINK, MOUNT and
+// TRACK_ONLY change what is tracked, dropping one would leave files
+// untracked or stale entries behind.
+static __always_inline int wire_limited(__u16 type) {
+  return type == MODIFY || type == FLAGS_CHANGED;
+}
+
+// wire_begin prepares the per-CPU scratch event with the header, section
+// headers and process section filled in. The file section is zeroed, hooks
+// fill in what they know. Returns NULL if the scratch space is unavailable
+// or the process or user is over its rate limit, see wire_limited.
+static __always_inline struct WIRE_EVENT *wire_begin(__u16 type, __u32 info) {
+  struct WIRE_EVENT *event;
+  struct task_struct *task;
+  __u64 uid_gid;
+  __u32 uid, tgid;
+  __u32 zero = 0;
+
+  uid_gid = bpf_get_current_uid_gid();
+  uid = (__u32)(uid_gid & 0xffffffff);
+  tgid = bpf_get_current_pid_tgid() >> 32;
+
+  if (wire_limited(type) && !rate_allow(tgid, uid))
+    return NULL;
+
+  event = bpf_map_lookup_elem(&wire_buf, &zero);
+  if (!event)
+    return NULL;
+
+  event->header.magic = WIRE_MAGIC;
+  event->header.version = WIRE_VERSION;
+  event->header.type = type;
+  event->header.info = info;
+
+  event->file_hdr.type = SECTION_FILE;
+  event->file_hdr.reserved = 0;
+  event->file_hdr.length = sizeof(event->file);
+  __builtin_memset(&event->file, 0, sizeof(event->file));
+
+  event->process_hdr.type = SECTION_PROCESS;
+  event->process_hdr.reserved = 0;
+  event->process_hdr.length = sizeof(event->process);
+
+  event->process.uid = uid;
+  event->process.pid = tgid;
+
+  task = (struct task_struct *)bpf_get_current_task();
+  event->process.tty_major = BPF_CORE_READ(task, signal, tty, driver, major);
+  event->process.tty_index = BPF_CORE_READ(task, signal, tty, index);
+
+  event->name_hdr.type = SECTION_NAME;
+  event->name_hdr.reserved = 0;
+
+  return event;
+}
+
+// wire_submit appends name as the last section and copies the used part of
+// the event to the ring buffer. MODIFY goes to the bulk buffer, all other
+// types to the priority buffer.
+static __always_inline int wire_submit(struct WIRE_EVENT *event,
+                                       const unsigned char *name) {
+  long len, ret;
+  __u32 size;
+
+  // length includes the NUL, which is not sent
+  len = bpf_probe_read_kernel_str(event->name, sizeof(event->name), name);
+  if (len < 1)
+    len = 1;
+  len -= 1;
+  if (len > NAME_MAX)
+    len = NAME_MAX;
+
+  event->name_hdr.length = len;
+
+  size = __builtin_offsetof(struct WIRE_EVENT, name) + len;
+  event->header.length = size;
+
+  if (event->header.type == MODIFY)
+    ret = bpf_ringbuf_output(&events, event, size, 0);
+  else
+    ret = bpf_ringbuf_output(&priority_events, event, size, 0);
+
+  stats_count(ret ? STAT_LOST : STAT_EVENTS);
+  return ret;
+}
+
+#endif